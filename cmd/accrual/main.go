@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/emulator"
+)
+
+func main() {
+	config, err := emulator.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	var rules []emulator.Rule
+	if len(config.RulesFile) != 0 {
+		rules, err = emulator.LoadRules(config.RulesFile)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+
+	store := emulator.NewStore(config, rules)
+	server := &http.Server{
+		Addr:    config.Address,
+		Handler: emulator.NewHandler(store, config),
+	}
+
+	pusherContext, pusherCancel := context.WithCancel(context.Background())
+	defer pusherCancel()
+	if len(config.WebhookURL) != 0 {
+		go emulator.NewPusher(store, config).Start(pusherContext)
+	}
+	go func() {
+		if sErr := server.ListenAndServe(); sErr != nil && !errors.Is(sErr, http.ErrServerClosed) {
+			log.Error(sErr)
+		}
+	}()
+	log.Infof("Accrual emulator listening on %s", config.Address)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+	<-sigChan
+
+	if err = server.Shutdown(context.Background()); err != nil {
+		log.Error(err)
+	}
+}
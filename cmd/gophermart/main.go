@@ -2,65 +2,55 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 
-	"VladBag2022/gophermart/internal/accrual"
-
 	log "github.com/sirupsen/logrus"
-	flag "github.com/spf13/pflag"
 
+	"VladBag2022/gophermart/internal/accrual"
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/events"
 	"VladBag2022/gophermart/internal/server"
 	"VladBag2022/gophermart/internal/storage"
+	"VladBag2022/gophermart/internal/sweeper"
+	"VladBag2022/gophermart/internal/tiers"
+	"VladBag2022/gophermart/internal/webhooks"
 )
 
 func main() {
-	config, err := server.NewConfig()
-	if err != nil {
-		log.Error(fmt.Sprintf("Unable to read configuration from environment variables: %s", err))
-		return
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
 	}
 
-	addressPtr := flag.StringP("address", "a", "", "server address - host:port")
-	databasePtr := flag.StringP("database", "d", "", "database URI")
-	accrualPtr := flag.StringP("accrual", "r", "", "accrual system address")
-	flag.Parse()
-
-	if len(*addressPtr) != 0 {
-		config.Address = *addressPtr
-	}
-	if len(*databasePtr) != 0 {
-		config.Database = *databasePtr
-	}
-	if len(*accrualPtr) != 0 {
-		config.Accrual = *accrualPtr
-	}
-
-	if len(config.Database) == 0 {
-		log.Error("Database URI is required")
-		return
-	}
-
-	if len(config.Accrual) == 0 {
-		log.Error("Accrual system address is required")
+	args := os.Args[1:]
+	cfg, err := config.Load(args)
+	if err != nil {
+		log.Error(err)
 		return
 	}
+	applyLogLevel(cfg.Log)
 
 	repository, err := storage.NewPostgresRepository(
 		context.Background(),
-		config.Database,
+		cfg.Database,
 	)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	app := server.NewServer(repository, config)
-	daemon := accrual.NewDaemon(repository, config.Accrual)
-	daemonContext, daemonCancel := context.WithCancel(context.Background())
+	app := server.NewServer(repository, cfg)
+	if err = app.ConfigureTLS(); err != nil {
+		log.Error(err)
+		return
+	}
+	daemon := accrual.NewDaemon(repository, cfg)
 
+	daemonContext, daemonCancel := context.WithCancel(context.Background())
 	go func() {
 		dErr := daemon.Start(daemonContext)
 		if dErr != nil {
@@ -68,21 +58,139 @@ func main() {
 		}
 	}()
 
+	holdSweeper := sweeper.NewSweeper(repository, cfg)
+	go func() {
+		sErr := holdSweeper.Start(daemonContext)
+		if sErr != nil {
+			log.Error(sErr)
+		}
+	}()
+
+	tierRecalculator := tiers.NewRecalculator(repository, cfg)
+	go func() {
+		tErr := tierRecalculator.Start(daemonContext)
+		if tErr != nil {
+			log.Error(tErr)
+		}
+	}()
+
+	deliverer := webhooks.NewDeliverer(repository, cfg)
+	go func() {
+		wErr := deliverer.Start(daemonContext)
+		if wErr != nil {
+			log.Error(wErr)
+		}
+	}()
+
+	eventListener := events.NewListener(repository, app.Events(), cfg)
 	go func() {
-		app.ListenAndServer()
+		eErr := eventListener.Start(daemonContext)
+		if eErr != nil {
+			log.Error(eErr)
+		}
 	}()
 
+	// A server that cannot serve stops the process rather than leaving the jobs running alone.
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- app.ListenAndServer()
+	}()
+
+	// running is the configuration in effect, reloads update the parts they apply.
+	running := *cfg
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan,
 		syscall.SIGINT,
 		syscall.SIGTERM,
-		syscall.SIGQUIT)
-	<-sigChan
+		syscall.SIGQUIT,
+		syscall.SIGHUP)
+
+	for serving := true; serving; {
+		select {
+		case sErr := <-serveErr:
+			if sErr != nil {
+				log.Errorf("Server stopped: %s", sErr)
+			}
+			serving = false
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				reload(args, &running, app)
+				continue
+			}
+			serving = false
+		}
+	}
 
-	daemonCancel()
+	shutdownContext, shutdownCancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer shutdownCancel()
+	if err = app.Shutdown(shutdownContext); err != nil {
+		log.Error(err)
+	}
 
+	daemonCancel()
 	err = repository.Close()
 	if err != nil {
 		log.Error(err)
 	}
 }
+
+// reload re-reads the configuration and applies settings that are safe to change at runtime.
+func reload(args []string, current *config.Config, app server.Server) {
+	cfg, err := config.Load(args)
+	if err != nil {
+		log.Errorf("Configuration reload rejected: %s", err)
+		return
+	}
+
+	applyLogLevel(cfg.Log)
+	app.SetRateLimit(cfg.RateLimit)
+
+	next := *cfg
+	next.Log = current.Log
+	next.RateLimit = current.RateLimit
+	restartRequired := !reflect.DeepEqual(next, *current)
+	// Later reloads compare against what is applied now.
+	current.Log = cfg.Log
+	current.RateLimit = cfg.RateLimit
+	if restartRequired {
+		log.Warn("Configuration reloaded: only log level and rate limits are applied, other changes require restart")
+		return
+	}
+	log.Info("Configuration reloaded")
+}
+
+func applyLogLevel(cfg config.Log) {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.SetLevel(level)
+}
+
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: gophermart config print [flags]")
+		return 2
+	}
+
+	cfg, err := config.Load(args[1:])
+	var validationErr *config.ValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	content, pErr := cfg.Print()
+	if pErr != nil {
+		fmt.Fprintln(os.Stderr, pErr)
+		return 1
+	}
+	fmt.Print(content)
+
+	if validationErr != nil {
+		fmt.Fprintln(os.Stderr, validationErr)
+		return 1
+	}
+	return 0
+}
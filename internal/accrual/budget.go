@@ -0,0 +1,42 @@
+package accrual
+
+import "sync"
+
+// budget is the number of orders the daemon may look up in one request. It is
+// halved whenever the accrual system rate limits us and grows back by one with
+// every successful request, up to the configured batch size.
+type budget struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func newBudget(max int) *budget {
+	if max < 1 {
+		max = 1
+	}
+	return &budget{current: max, max: max}
+}
+
+func (b *budget) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
+}
+
+func (b *budget) shrink() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current /= 2
+	if b.current < 1 {
+		b.current = 1
+	}
+}
+
+func (b *budget) grow() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current < b.max {
+		b.current++
+	}
+}
@@ -1,24 +1,70 @@
 package accrual
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
-type orderInfoResponse struct {
+// OrderInfo is the accrual calculation state of an order.
+type OrderInfo struct {
 	Order   string  `json:"order"`
 	Status  string  `json:"status"`
 	Accrual float64 `json:"accrual"`
 }
 
-func (d Daemon) orderInfo(order int64) (info *orderInfoResponse, retryAfter int, err error) {
-	var response *http.Response
-	response, err = http.Get(fmt.Sprintf("%s/api/orders/%d", d.accrualAddress, order))
+// RateLimitError is returned when the accrual system asks to slow down.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual system rate limit exceeded, retry after %s", e.RetryAfter)
+}
+
+// Client looks up order accrual states. Orders unknown to the accrual system
+// are reported as nil by OrderInfo and omitted by OrdersInfo.
+type Client interface {
+	OrderInfo(ctx context.Context, order string) (*OrderInfo, error)
+	OrdersInfo(ctx context.Context, orders []string) ([]OrderInfo, error)
+}
+
+// NewClient returns a batch client when batchSize allows several orders per
+// request, and a per-order client otherwise.
+func NewClient(address string, timeout time.Duration, batchSize int) Client {
+	single := &httpClient{
+		address: address,
+		client:  &http.Client{Timeout: timeout},
+	}
+	if batchSize <= 1 {
+		return single
+	}
+	return &batchClient{httpClient: single}
+}
+
+// httpClient issues one GET /api/orders/{number} request per order.
+type httpClient struct {
+	address string
+	client  *http.Client
+}
+
+func (c *httpClient) OrderInfo(ctx context.Context, order string) (info *OrderInfo, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.address+"/api/orders/"+url.PathEscape(order), nil)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
 	}
 	defer response.Body.Close()
 
@@ -27,22 +73,105 @@ func (d Daemon) orderInfo(order int64) (info *orderInfoResponse, retryAfter int,
 		var content []byte
 		content, err = ioutil.ReadAll(response.Body)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 		if err = json.Unmarshal(content, &info); err != nil {
-			return nil, 0, err
+			return nil, err
 		}
-		return info, 0, nil
+		return info, nil
 	case http.StatusTooManyRequests:
-		header := response.Header.Get("Retry-After")
-		retryAfter, err = strconv.Atoi(header)
+		return nil, rateLimitError(response)
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown response status code: %d", response.StatusCode)
+	}
+}
+
+func (c *httpClient) OrdersInfo(ctx context.Context, orders []string) ([]OrderInfo, error) {
+	infos := make([]OrderInfo, 0, len(orders))
+	for _, order := range orders {
+		info, err := c.OrderInfo(ctx, order)
 		if err != nil {
-			return nil, 0, err
+			// Keep what was fetched before hitting the limit, the caller retries the rest.
+			return infos, err
 		}
-		return nil, retryAfter, nil
-	case http.StatusNoContent:
-		return nil, 1, nil
+		if info != nil {
+			infos = append(infos, *info)
+		}
+	}
+	return infos, nil
+}
+
+// batchClient uses POST /api/orders/batch and falls back to per-order lookups
+// for good once the accrual system turns out not to support it.
+type batchClient struct {
+	*httpClient
+	unsupported int32
+}
+
+func (c *batchClient) OrdersInfo(ctx context.Context, orders []string) ([]OrderInfo, error) {
+	if atomic.LoadInt32(&c.unsupported) == 1 {
+		return c.httpClient.OrdersInfo(ctx, orders)
+	}
+
+	body, err := json.Marshal(orders)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.address+"/api/orders/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		var infos []OrderInfo
+		if err = json.NewDecoder(response.Body).Decode(&infos); err != nil {
+			return nil, err
+		}
+		return infos, nil
+	case http.StatusTooManyRequests:
+		return nil, rateLimitError(response)
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		atomic.StoreInt32(&c.unsupported, 1)
+		return c.httpClient.OrdersInfo(ctx, orders)
 	default:
-		return nil, 0, fmt.Errorf("unknown response status code: %d", response.StatusCode)
+		return nil, fmt.Errorf("unknown response status code: %d", response.StatusCode)
+	}
+}
+
+// defaultRetryAfter is the pause asked by a 429 response that does not tell one.
+const defaultRetryAfter = 5 * time.Second
+
+// rateLimitError reads Retry-After as seconds or as an HTTP date.
+func rateLimitError(response *http.Response) error {
+	header := response.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return &RateLimitError{RetryAfter: time.Duration(seconds) * time.Second}
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		retryAfter := time.Until(date).Round(time.Second)
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+	return &RateLimitError{RetryAfter: defaultRetryAfter}
+}
+
+// IsRateLimited reports whether err asks to retry later and for how long.
+func IsRateLimited(err error) (time.Duration, bool) {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return rateLimitErr.RetryAfter, true
 	}
+	return 0, false
 }
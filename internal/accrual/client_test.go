@@ -0,0 +1,154 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_rateLimitError(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{name: "seconds", retryAfter: "7", want: 7 * time.Second},
+		{name: "http date", retryAfter: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), want: time.Minute},
+		{name: "past http date", retryAfter: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+		{name: "missing", want: defaultRetryAfter},
+		{name: "malformed", retryAfter: "soon", want: defaultRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{Header: http.Header{}}
+			if len(tt.retryAfter) > 0 {
+				response.Header.Set("Retry-After", tt.retryAfter)
+			}
+			retryAfter, ok := IsRateLimited(rateLimitError(response))
+			require.True(t, ok)
+			assert.InDelta(t, tt.want.Seconds(), retryAfter.Seconds(), 1)
+		})
+	}
+}
+
+func TestClient_OrdersInfo(t *testing.T) {
+	known := map[string]OrderInfo{
+		"12345678903": {Order: "12345678903", Status: StatusProcessed, Accrual: 500},
+		"79927398713": {Order: "79927398713", Status: StatusProcessing},
+		// Longer than an int64 and with leading zeros, to be passed on unchanged.
+		"000012345678901234567890123": {Order: "000012345678901234567890123", Status: StatusRegistered},
+	}
+	orders := []string{"12345678903", "4561261212345467", "79927398713", "000012345678901234567890123"}
+
+	tests := []struct {
+		name          string
+		batch         bool
+		batchStatus   int
+		wantBatches   int
+		wantSingles   int
+		wantRateLimit bool
+	}{
+		{
+			name:        "per-order client",
+			wantSingles: 4,
+		},
+		{
+			name:        "batch client",
+			batch:       true,
+			batchStatus: http.StatusOK,
+			wantBatches: 1,
+		},
+		{
+			name:        "batch not supported",
+			batch:       true,
+			batchStatus: http.StatusNotFound,
+			wantBatches: 1,
+			wantSingles: 4,
+		},
+		{
+			name:          "batch rate limited",
+			batch:         true,
+			batchStatus:   http.StatusTooManyRequests,
+			wantBatches:   1,
+			wantRateLimit: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batches, singles int
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/orders/batch", func(w http.ResponseWriter, r *http.Request) {
+				batches++
+				if tt.batchStatus == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "7")
+				}
+				if tt.batchStatus != http.StatusOK {
+					w.WriteHeader(tt.batchStatus)
+					return
+				}
+				var numbers []string
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&numbers))
+				var infos []OrderInfo
+				for _, number := range numbers {
+					if info, ok := known[number]; ok {
+						infos = append(infos, info)
+					}
+				}
+				require.NoError(t, json.NewEncoder(w).Encode(infos))
+			})
+			mux.HandleFunc("/api/orders/", func(w http.ResponseWriter, r *http.Request) {
+				singles++
+				info, ok := known[r.URL.Path[len("/api/orders/"):]]
+				if !ok {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				require.NoError(t, json.NewEncoder(w).Encode(info))
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			batchSize := 1
+			if tt.batch {
+				batchSize = 10
+			}
+			client := NewClient(ts.URL, time.Second, batchSize)
+
+			infos, err := client.OrdersInfo(context.Background(), orders)
+			retryAfter, rateLimited := IsRateLimited(err)
+			assert.Equal(t, tt.wantRateLimit, rateLimited)
+			if tt.wantRateLimit {
+				assert.Equal(t, 7*time.Second, retryAfter)
+			} else {
+				require.NoError(t, err)
+				require.Len(t, infos, 3)
+				assert.Equal(t, known["12345678903"], infos[0])
+				assert.Equal(t, known["79927398713"], infos[1])
+				assert.Equal(t, known["000012345678901234567890123"], infos[2])
+			}
+			assert.Equal(t, tt.wantBatches, batches)
+			assert.Equal(t, tt.wantSingles, singles)
+		})
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := newBudget(10)
+	assert.Equal(t, 10, b.size())
+	b.shrink()
+	b.shrink()
+	assert.Equal(t, 2, b.size())
+	b.shrink()
+	b.shrink()
+	assert.Equal(t, 1, b.size())
+	for i := 0; i < 20; i++ {
+		b.grow()
+	}
+	assert.Equal(t, 10, b.size())
+}
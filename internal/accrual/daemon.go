@@ -2,20 +2,51 @@ package accrual
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/metrics"
 	"VladBag2022/gophermart/internal/storage"
 )
 
+// Daemon polls the accrual system for orders awaiting a final status. When the
+// accrual system pushes updates, it only reconciles orders that missed a push.
+// Orders that never reach a final status are dead-lettered.
 type Daemon struct {
-	repository     storage.Repository
-	accrualAddress string
+	repository   storage.Repository
+	pollInterval time.Duration
+	// systems are keyed by the accrual address of merchants, "" is the default accrual system.
+	systems   map[string]accrualSystem
+	timeout   time.Duration
+	batchSize int
+
+	fallback         bool
+	fallbackInterval time.Duration
+	fallbackAge      time.Duration
+
+	maxAge      time.Duration
+	maxAttempts int
 }
 
-func NewDaemon(repository storage.Repository, accrualAddress string) Daemon {
+func NewDaemon(repository storage.Repository, config *config.Config) Daemon {
 	return Daemon{
-		repository:     repository,
-		accrualAddress: accrualAddress,
+		repository:   repository,
+		pollInterval: config.Daemon.PollInterval,
+		systems: map[string]accrualSystem{
+			"": newSystem(config.Accrual.Address, config.Accrual.Timeout, config.Accrual.BatchSize),
+		},
+		timeout:   config.Accrual.Timeout,
+		batchSize: config.Accrual.BatchSize,
+
+		fallback:         config.Accrual.WebhookEnabled(),
+		fallbackInterval: config.Daemon.FallbackInterval,
+		fallbackAge:      config.Daemon.FallbackAge,
+
+		maxAge:      config.Daemon.MaxAge,
+		maxAttempts: config.Daemon.MaxAttempts,
 	}
 }
 
@@ -25,28 +56,170 @@ func (d Daemon) Start(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		default:
-			orders, err := d.repository.AccrualOrders(ctx)
+			if err := d.deadLetter(ctx); err != nil {
+				return err
+			}
+			var minAge time.Duration
+			if d.fallback {
+				minAge = d.fallbackAge
+			}
+			orders, err := d.repository.AccrualOrders(ctx, minAge)
 			if err != nil {
 				return err
 			}
-			for _, order := range orders {
-				info, retryAfter, err := d.orderInfo(order)
-				if err != nil {
-					return err
-				}
-				if info == nil {
-					select {
-					case <-ctx.Done():
-						return nil
-					case <-time.After(time.Duration(retryAfter) * time.Second):
-						continue
-					}
-				}
-				err = d.repository.UpdateOrder(ctx, order, info.Status, info.Accrual)
-				if err != nil {
+			failed, err := d.process(ctx, orders)
+			if err != nil {
+				return err
+			}
+			wait := d.pollInterval
+			if d.fallback {
+				wait = d.fallbackInterval
+			}
+			if len(orders) == 0 || d.fallback || failed {
+				select {
+				case <-ctx.Done():
 					return nil
+				case <-time.After(wait):
 				}
 			}
 		}
 	}
 }
+
+func (d Daemon) deadLetter(ctx context.Context) error {
+	if d.maxAge == 0 && d.maxAttempts == 0 {
+		return nil
+	}
+	marked, total, err := d.repository.DeadLetterOrders(ctx, d.maxAge, d.maxAttempts)
+	if err != nil {
+		return err
+	}
+	if marked > 0 {
+		log.Warnf("Dead-lettered %d orders, %d in total", marked, total)
+	}
+	metrics.DeadLettered.Add(marked)
+	metrics.DeadLetters.Set(total)
+	return nil
+}
+
+// accrualSystem is an accrual system with its own rate-limit budget, so that one
+// system slowing us down does not slow down the lookups in the others.
+type accrualSystem struct {
+	client Client
+	budget *budget
+}
+
+func newSystem(address string, timeout time.Duration, batchSize int) accrualSystem {
+	return accrualSystem{
+		client: NewClient(address, timeout, batchSize),
+		budget: newBudget(batchSize),
+	}
+}
+
+// system returns the accrual system at address.
+func (d Daemon) system(address string) accrualSystem {
+	system, ok := d.systems[address]
+	if !ok {
+		system = newSystem(address, d.timeout, d.batchSize)
+		d.systems[address] = system
+	}
+	return system
+}
+
+// process looks orders up in the accrual systems of their merchants.
+func (d Daemon) process(ctx context.Context, orders []storage.AccrualOrder) (failed bool, err error) {
+	var addresses []string
+	groups := make(map[string][]storage.AccrualOrder)
+	for _, order := range orders {
+		if _, ok := groups[order.AccrualAddress]; !ok {
+			addresses = append(addresses, order.AccrualAddress)
+		}
+		groups[order.AccrualAddress] = append(groups[order.AccrualAddress], order)
+	}
+	for _, address := range addresses {
+		groupFailed, pErr := d.processWith(ctx, d.system(address), groups[address])
+		failed = failed || groupFailed
+		if pErr != nil {
+			return failed, pErr
+		}
+	}
+	return failed, nil
+}
+
+// processWith looks orders up in batches sized by the rate-limit budget, backing
+// off whenever the accrual system answers with 429. Failed lookups are recorded
+// against the orders and reported so that the caller does not retry right away.
+func (d Daemon) processWith(
+	ctx context.Context,
+	system accrualSystem,
+	orders []storage.AccrualOrder,
+) (failed bool, err error) {
+	for len(orders) > 0 {
+		batch := orders
+		if size := system.budget.size(); len(batch) > size {
+			batch = batch[:size]
+		}
+		numbers := make([]string, len(batch))
+		ids := make([]int64, len(batch))
+		byNumber := make(map[string]int64, len(batch))
+		for i, order := range batch {
+			numbers[i] = order.Number
+			ids[i] = order.ID
+			byNumber[order.Number] = order.ID
+		}
+		infos, lookupErr := system.client.OrdersInfo(ctx, numbers)
+		if err = d.update(ctx, infos, byNumber); err != nil {
+			return failed, err
+		}
+		if retryAfter, ok := IsRateLimited(lookupErr); ok {
+			system.budget.shrink()
+			log.Debugf("Accrual system rate limited, batch size %d, retry after %s", system.budget.size(), retryAfter)
+			// Orders already answered will not be due on the next pass.
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryAfter):
+			}
+			return failed, nil
+		}
+		if lookupErr != nil {
+			if ctx.Err() != nil {
+				return failed, nil
+			}
+			failed = true
+			log.Warnf("Accrual status lookup failed: %s", lookupErr)
+			if err = d.fail(ctx, ids, lookupErr.Error()); err != nil {
+				return failed, err
+			}
+		} else {
+			system.budget.grow()
+		}
+		orders = orders[len(batch):]
+	}
+	return failed, nil
+}
+
+// update stores looked up statuses, byNumber maps the looked up numbers to order ids.
+func (d Daemon) update(ctx context.Context, infos []OrderInfo, byNumber map[string]int64) error {
+	for _, info := range infos {
+		order, ok := byNumber[info.Order]
+		if !ok {
+			log.Warnf("Accrual system returned unexpected order number %q", info.Order)
+			continue
+		}
+		if !IsKnownStatus(info.Status) {
+			if err := d.fail(ctx, []int64{order}, fmt.Sprintf("unknown status %q", info.Status)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.repository.UpdateOrder(ctx, order, info.Status, info.Accrual); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Daemon) fail(ctx context.Context, orders []int64, reason string) error {
+	metrics.AccrualFailures.Add(int64(len(orders)))
+	return d.repository.AccrualFailed(ctx, orders, reason)
+}
@@ -0,0 +1,131 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/storage"
+	"VladBag2022/gophermart/mocks"
+)
+
+func TestDaemon_process(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		merchant   bool
+		failed     bool
+		reason     string
+		updated    bool
+	}{
+		{
+			name:       "positive test",
+			statusCode: http.StatusOK,
+			body:       `[{"order": "12345678903", "status": "PROCESSED", "accrual": 500}]`,
+			updated:    true,
+		},
+		{
+			name:       "positive test - accrual system of the merchant",
+			statusCode: http.StatusOK,
+			body:       `[{"order": "12345678903", "status": "PROCESSED", "accrual": 500}]`,
+			merchant:   true,
+			updated:    true,
+		},
+		{
+			name:       "negative test - unknown status",
+			statusCode: http.StatusOK,
+			body:       `[{"order": "12345678903", "status": "DONE", "accrual": 500}]`,
+			reason:     `unknown status "DONE"`,
+		},
+		{
+			name:       "negative test - unknown status code",
+			statusCode: http.StatusBadGateway,
+			failed:     true,
+			reason:     "unknown response status code: 502",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+
+			cfg := config.Default()
+			cfg.Accrual.Address = ts.URL
+			order := storage.AccrualOrder{ID: 42, Number: "12345678903"}
+			if tt.merchant {
+				// The default accrual system is down, only the one of the merchant answers.
+				cfg.Accrual.Address = "http://127.0.0.1:1"
+				order.AccrualAddress = ts.URL
+			}
+			repository := new(mocks.Repository)
+			repository.On("UpdateOrder", mock.Anything, int64(42), StatusProcessed, 500.0).Return(nil)
+			repository.On("AccrualFailed", mock.Anything, []int64{42}, tt.reason).Return(nil)
+			d := NewDaemon(repository, cfg)
+
+			failed, err := d.process(context.Background(), []storage.AccrualOrder{order})
+			require.NoError(t, err)
+			assert.Equal(t, tt.failed, failed)
+			if tt.updated {
+				repository.AssertCalled(t, "UpdateOrder", mock.Anything, int64(42), StatusProcessed, 500.0)
+			} else {
+				repository.AssertCalled(t, "AccrualFailed", mock.Anything, []int64{42}, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDaemon_processRateLimitedSystem(t *testing.T) {
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	available := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"order": "12345678903", "status": "PROCESSED", "accrual": 500}]`))
+	}))
+	defer available.Close()
+
+	cfg := config.Default()
+	cfg.Accrual.Address = available.URL
+	cfg.Accrual.BatchSize = 8
+	repository := new(mocks.Repository)
+	repository.On("UpdateOrder", mock.Anything, int64(42), StatusProcessed, 500.0).Return(nil)
+	d := NewDaemon(repository, cfg)
+
+	failed, err := d.process(context.Background(), []storage.AccrualOrder{
+		{ID: 42, Number: "12345678903"},
+		{ID: 43, Number: "79927398713", AccrualAddress: limited.URL},
+	})
+	require.NoError(t, err)
+	assert.False(t, failed)
+	// Only the budget of the system that rate limited us shrinks.
+	assert.Equal(t, 4, d.system(limited.URL).budget.size())
+	assert.Equal(t, 8, d.system("").budget.size())
+	repository.AssertExpectations(t)
+}
+
+func TestDaemon_deadLetter(t *testing.T) {
+	cfg := config.Default()
+	repository := new(mocks.Repository)
+	repository.On("DeadLetterOrders", mock.Anything, cfg.Daemon.MaxAge, cfg.Daemon.MaxAttempts).
+		Return(int64(2), int64(5), nil)
+	require.NoError(t, NewDaemon(repository, cfg).deadLetter(context.Background()))
+	repository.AssertExpectations(t)
+
+	cfg.Daemon.MaxAge = 0
+	cfg.Daemon.MaxAttempts = 0
+	repository = new(mocks.Repository)
+	require.NoError(t, NewDaemon(repository, cfg).deadLetter(context.Background()))
+	repository.AssertNotCalled(t, "DeadLetterOrders", mock.Anything, time.Duration(0), 0)
+}
@@ -0,0 +1,70 @@
+package accrual
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Headers of an accrual status push. The signature is the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the shared secret.
+const (
+	SignatureHeader = "X-Accrual-Signature"
+	TimestampHeader = "X-Accrual-Timestamp"
+)
+
+var (
+	ErrBadSignature   = errors.New("bad webhook signature")
+	ErrStaleTimestamp = errors.New("webhook timestamp is outside of the replay window")
+)
+
+// Sign computes the signature of a push sent at timestamp (Unix seconds).
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the push signature and that it was sent within window of now.
+func Verify(secret []byte, signature, timestamp string, body []byte, window time.Duration, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	expected := Sign(secret, ts, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadSignature
+	}
+	sent := time.Unix(ts, 0)
+	if now.Sub(sent) > window || sent.Sub(now) > window {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+// IsFinal reports whether the accrual system will not change the status anymore.
+func IsFinal(status string) bool {
+	return status == StatusInvalid || status == StatusProcessed
+}
+
+// Statuses reported by the accrual system.
+const (
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+)
+
+// IsKnownStatus reports whether status is one of the accrual system statuses.
+func IsKnownStatus(status string) bool {
+	switch status {
+	case StatusRegistered, StatusInvalid, StatusProcessing, StatusProcessed:
+		return true
+	}
+	return false
+}
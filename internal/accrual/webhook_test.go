@@ -0,0 +1,79 @@
+package accrual
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"order":"12345678903","status":"PROCESSED","accrual":500}`)
+	now := time.Now()
+	sent := now.Add(-time.Minute).Unix()
+	signature := Sign(secret, sent, body)
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		signature string
+		timestamp string
+		body      []byte
+		window    time.Duration
+		want      error
+	}{
+		{
+			name:      "positive test",
+			secret:    secret,
+			signature: signature,
+			timestamp: strconv.FormatInt(sent, 10),
+			body:      body,
+			window:    5 * time.Minute,
+		},
+		{
+			name:      "negative test - wrong secret",
+			secret:    []byte("other"),
+			signature: signature,
+			timestamp: strconv.FormatInt(sent, 10),
+			body:      body,
+			window:    5 * time.Minute,
+			want:      ErrBadSignature,
+		},
+		{
+			name:      "negative test - tampered body",
+			secret:    secret,
+			signature: signature,
+			timestamp: strconv.FormatInt(sent, 10),
+			body:      []byte(`{"order":"12345678903","status":"PROCESSED","accrual":5000}`),
+			window:    5 * time.Minute,
+			want:      ErrBadSignature,
+		},
+		{
+			name:      "negative test - tampered timestamp",
+			secret:    secret,
+			signature: signature,
+			timestamp: strconv.FormatInt(sent+1, 10),
+			body:      body,
+			window:    5 * time.Minute,
+			want:      ErrBadSignature,
+		},
+		{
+			name:      "negative test - replayed outside window",
+			secret:    secret,
+			signature: signature,
+			timestamp: strconv.FormatInt(sent, 10),
+			body:      body,
+			window:    30 * time.Second,
+			want:      ErrStaleTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.signature, tt.timestamp, tt.body, tt.window, now)
+			assert.True(t, errors.Is(err, tt.want), "got %v", err)
+		})
+	}
+}
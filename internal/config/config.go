@@ -0,0 +1,578 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config is the effective configuration of the loyalty service.
+type Config struct {
+	Server    Server    `yaml:"server" toml:"server"`
+	TLS       TLS       `yaml:"tls" toml:"tls"`
+	Database  Database  `yaml:"database" toml:"database"`
+	Accrual   Accrual   `yaml:"accrual" toml:"accrual"`
+	Auth      Auth      `yaml:"auth" toml:"auth"`
+	Daemon    Daemon    `yaml:"daemon" toml:"daemon"`
+	Balance   Balance   `yaml:"balance" toml:"balance"`
+	Loyalty   Loyalty   `yaml:"loyalty" toml:"loyalty"`
+	Transfers Transfers `yaml:"transfers" toml:"transfers"`
+	Referrals Referrals `yaml:"referrals" toml:"referrals"`
+	Events    Events    `yaml:"events" toml:"events"`
+	Webhooks  Webhooks  `yaml:"webhooks" toml:"webhooks"`
+	Log       Log       `yaml:"log" toml:"log"`
+	RateLimit RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+// Server holds HTTP listener settings.
+type Server struct {
+	Address         string        `yaml:"address" toml:"address" env:"RUN_ADDRESS"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	// IdempotencyWindow is how long a response is replayed for a repeated Idempotency-Key.
+	IdempotencyWindow time.Duration `yaml:"idempotency_window" toml:"idempotency_window" env:"SERVER_IDEMPOTENCY_WINDOW"`
+	// IdempotencyLease is how long a request may hold its key before a retry may take it over.
+	IdempotencyLease time.Duration `yaml:"idempotency_lease" toml:"idempotency_lease" env:"SERVER_IDEMPOTENCY_LEASE"`
+	// MaxBatchOrders caps the order numbers of one batch upload.
+	MaxBatchOrders int `yaml:"max_batch_orders" toml:"max_batch_orders" env:"SERVER_MAX_BATCH_ORDERS"`
+	// TrustedProxies are CIDRs of proxies whose X-Forwarded-For and X-Real-IP
+	// headers tell the client address. Other peers are taken as the client.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"SERVER_TRUSTED_PROXIES" envSeparator:","`
+}
+
+// TLS holds HTTPS settings. TLS is enabled when both CertFile and KeyFile are set.
+type TLS struct {
+	CertFile        string        `yaml:"cert_file" toml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile         string        `yaml:"key_file" toml:"key_file" env:"TLS_KEY_FILE"`
+	ReloadInterval  time.Duration `yaml:"reload_interval" toml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+	MinVersion      string        `yaml:"min_version" toml:"min_version" env:"TLS_MIN_VERSION"`
+	CipherSuites    []string      `yaml:"cipher_suites" toml:"cipher_suites" env:"TLS_CIPHER_SUITES" envSeparator:","`
+	RedirectAddress string        `yaml:"redirect_address" toml:"redirect_address" env:"TLS_REDIRECT_ADDRESS"`
+	ClientCAFile    string        `yaml:"client_ca_file" toml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (t TLS) Enabled() bool {
+	return len(t.CertFile) > 0 && len(t.KeyFile) > 0
+}
+
+// Database holds connection and pool settings.
+type Database struct {
+	URI             string        `yaml:"uri" toml:"uri" env:"DATABASE_URI"`
+	MaxConns        int32         `yaml:"max_conns" toml:"max_conns" env:"DATABASE_MAX_CONNS"`
+	MinConns        int32         `yaml:"min_conns" toml:"min_conns" env:"DATABASE_MIN_CONNS"`
+	MaxConnLifetime time.Duration `yaml:"max_conn_lifetime" toml:"max_conn_lifetime" env:"DATABASE_MAX_CONN_LIFETIME"`
+	MaxConnIdleTime time.Duration `yaml:"max_conn_idle_time" toml:"max_conn_idle_time" env:"DATABASE_MAX_CONN_IDLE_TIME"`
+
+	HealthCheckPeriod  time.Duration `yaml:"health_check_period" toml:"health_check_period" env:"DATABASE_HEALTH_CHECK_PERIOD"`
+	StatementTimeout   time.Duration `yaml:"statement_timeout" toml:"statement_timeout" env:"DATABASE_STATEMENT_TIMEOUT"`
+	PreparedStatements bool          `yaml:"prepared_statements" toml:"prepared_statements" env:"DATABASE_PREPARED_STATEMENTS"`
+	StatementCacheSize int           `yaml:"statement_cache_size" toml:"statement_cache_size" env:"DATABASE_STATEMENT_CACHE_SIZE"`
+
+	// Replicas are read-only DSNs used for list and balance queries.
+	Replicas              []string      `yaml:"replicas" toml:"replicas" env:"DATABASE_REPLICAS" envSeparator:","`
+	ReplicaHealthInterval time.Duration `yaml:"replica_health_interval" toml:"replica_health_interval" env:"DATABASE_REPLICA_HEALTH_INTERVAL"`
+	// ReplicaMaxLag takes replicas replaying further behind the primary out of rotation. Zero disables the check.
+	ReplicaMaxLag time.Duration `yaml:"replica_max_lag" toml:"replica_max_lag" env:"DATABASE_REPLICA_MAX_LAG"`
+	// PrimaryPinWindow keeps a user's reads on the primary after their own writes.
+	// Pins live in the instance that served the write, so reads routed to
+	// another instance may still miss it.
+	PrimaryPinWindow time.Duration `yaml:"primary_pin_window" toml:"primary_pin_window" env:"DATABASE_PRIMARY_PIN_WINDOW"`
+}
+
+// Accrual holds accrual system client settings.
+type Accrual struct {
+	Address string        `yaml:"address" toml:"address" env:"ACCRUAL_SYSTEM_ADDRESS"`
+	Timeout time.Duration `yaml:"timeout" toml:"timeout" env:"ACCRUAL_TIMEOUT"`
+	// BatchSize caps orders per status lookup; 1 disables batch requests.
+	BatchSize int `yaml:"batch_size" toml:"batch_size" env:"ACCRUAL_BATCH_SIZE"`
+
+	// WebhookSecret enables status pushes signed with this HMAC key.
+	WebhookSecret       string        `yaml:"webhook_secret" toml:"webhook_secret" env:"ACCRUAL_WEBHOOK_SECRET"`
+	WebhookReplayWindow time.Duration `yaml:"webhook_replay_window" toml:"webhook_replay_window" env:"ACCRUAL_WEBHOOK_REPLAY_WINDOW"`
+}
+
+// WebhookEnabled reports whether the accrual system pushes status updates.
+func (a Accrual) WebhookEnabled() bool {
+	return len(a.WebhookSecret) > 0
+}
+
+// Auth holds authentication settings.
+type Auth struct {
+	JWTKey     string        `yaml:"jwt_key" toml:"jwt_key" env:"AUTH_KEY"`
+	TokenTTL   time.Duration `yaml:"token_ttl" toml:"token_ttl" env:"AUTH_TOKEN_TTL"`
+	APIClients []APIClient   `yaml:"api_clients" toml:"api_clients"`
+}
+
+// APIClient is a trusted application authenticating with an API key. With the
+// webhooks scope a client gets the order events of its merchants, by merchant
+// code; only with the admin scope as well it may see every order and balance.
+type APIClient struct {
+	Name      string   `yaml:"name" toml:"name"`
+	Key       string   `yaml:"key" toml:"key"`
+	Scopes    []string `yaml:"scopes" toml:"scopes"`
+	Merchants []string `yaml:"merchants" toml:"merchants"`
+}
+
+// HasScope reports whether the client was granted the scope.
+func (c APIClient) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Daemon holds accrual polling daemon settings.
+type Daemon struct {
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval" env:"DAEMON_POLL_INTERVAL"`
+	// With webhooks enabled the daemon only reconciles orders without a push for FallbackAge,
+	// sweeping every FallbackInterval.
+	FallbackInterval time.Duration `yaml:"fallback_interval" toml:"fallback_interval" env:"DAEMON_FALLBACK_INTERVAL"`
+	FallbackAge      time.Duration `yaml:"fallback_age" toml:"fallback_age" env:"DAEMON_FALLBACK_AGE"`
+	// Orders pending for longer than MaxAge or failing MaxAttempts lookups in a row
+	// are dead-lettered and no longer polled. Zero disables the respective limit.
+	MaxAge      time.Duration `yaml:"max_age" toml:"max_age" env:"DAEMON_MAX_AGE"`
+	MaxAttempts int           `yaml:"max_attempts" toml:"max_attempts" env:"DAEMON_MAX_ATTEMPTS"`
+}
+
+// Reversal policies decide what happens when clawing back an accrual the user has already spent.
+const (
+	// ReversalAllowDebt reverses the full amount, the balance may go negative.
+	ReversalAllowDebt = "allow_debt"
+	// ReversalCapAtZero reverses no more than the current balance.
+	ReversalCapAtZero = "cap_at_zero"
+)
+
+// Balance holds points balance settings.
+type Balance struct {
+	ReversalPolicy string `yaml:"reversal_policy" toml:"reversal_policy" env:"BALANCE_REVERSAL_POLICY"`
+	// HoldTTL is how long reserved points stay held unless captured or voided.
+	HoldTTL time.Duration `yaml:"hold_ttl" toml:"hold_ttl" env:"BALANCE_HOLD_TTL"`
+	// SweepInterval is how often expired holds are released.
+	SweepInterval time.Duration `yaml:"sweep_interval" toml:"sweep_interval" env:"BALANCE_SWEEP_INTERVAL"`
+	// WithdrawalOrderFormats are regular expressions of known merchant order numbers.
+	// When set, withdrawals are only accepted for order numbers matching one of them.
+	WithdrawalOrderFormats []string `yaml:"withdrawal_order_formats" toml:"withdrawal_order_formats" env:"BALANCE_WITHDRAWAL_ORDER_FORMATS" envSeparator:","`
+	// PointsTTL is how long credited points stay spendable, zero means they never expire.
+	// It applies to all points, including those credited before it changed.
+	PointsTTL time.Duration `yaml:"points_ttl" toml:"points_ttl" env:"BALANCE_POINTS_TTL"`
+	// ExpiryNotice is how far ahead the balance lists points about to expire.
+	ExpiryNotice time.Duration `yaml:"expiry_notice" toml:"expiry_notice" env:"BALANCE_EXPIRY_NOTICE"`
+}
+
+// Tier bases, what the rolling amount deciding a tier is made of.
+const (
+	// TierBasisAccrual ranks users by points accrued.
+	TierBasisAccrual = "accrual"
+	// TierBasisSpend ranks users by points withdrawn, less refunds.
+	TierBasisSpend = "spend"
+)
+
+// Loyalty holds tier settings. Without tiers every accrual is credited as is.
+type Loyalty struct {
+	Tiers []Tier `yaml:"tiers" toml:"tiers"`
+	Basis string `yaml:"basis" toml:"basis" env:"LOYALTY_BASIS"`
+	// Window is the rolling period the basis amount is summed over.
+	Window time.Duration `yaml:"window" toml:"window" env:"LOYALTY_WINDOW"`
+	// RecalculateInterval is how often tiers are recalculated.
+	RecalculateInterval time.Duration `yaml:"recalculate_interval" toml:"recalculate_interval" env:"LOYALTY_RECALCULATE_INTERVAL"`
+}
+
+// Tier is reached once the basis amount is at least Threshold. Accruals of its
+// members are multiplied by Multiplier.
+type Tier struct {
+	Name       string  `yaml:"name" toml:"name"`
+	Threshold  float64 `yaml:"threshold" toml:"threshold"`
+	Multiplier float64 `yaml:"multiplier" toml:"multiplier"`
+}
+
+// Transfers holds limits of points sent between users. Zero disables a limit.
+type Transfers struct {
+	// DailyLimit caps the points a user sends within 24 hours.
+	DailyLimit float64 `yaml:"daily_limit" toml:"daily_limit" env:"TRANSFER_DAILY_LIMIT"`
+	// ConfirmationThreshold is the amount from which the sender has to confirm a transfer.
+	ConfirmationThreshold float64 `yaml:"confirmation_threshold" toml:"confirmation_threshold" env:"TRANSFER_CONFIRMATION_THRESHOLD"`
+	// ConfirmationTTL is how long a transfer waits for confirmation.
+	ConfirmationTTL time.Duration `yaml:"confirmation_ttl" toml:"confirmation_ttl" env:"TRANSFER_CONFIRMATION_TTL"`
+	// MinAccountAge is how long after registration a user may start sending points.
+	MinAccountAge time.Duration `yaml:"min_account_age" toml:"min_account_age" env:"TRANSFER_MIN_ACCOUNT_AGE"`
+}
+
+// Referrals holds the points granted once a referred user has their first order processed.
+type Referrals struct {
+	// ReferrerBonus goes to the owner of the referral code, RefereeBonus to the new user.
+	ReferrerBonus float64 `yaml:"referrer_bonus" toml:"referrer_bonus" env:"REFERRAL_REFERRER_BONUS"`
+	RefereeBonus  float64 `yaml:"referee_bonus" toml:"referee_bonus" env:"REFERRAL_REFEREE_BONUS"`
+}
+
+// Events holds settings of the order and balance event streams.
+type Events struct {
+	// Heartbeat is how often an idle stream gets a comment, keeping proxies from closing it.
+	Heartbeat time.Duration `yaml:"heartbeat" toml:"heartbeat" env:"EVENTS_HEARTBEAT"`
+	// Buffer is how many events wait for a slow client before newer ones are dropped.
+	Buffer int `yaml:"buffer" toml:"buffer" env:"EVENTS_BUFFER"`
+	// ReconnectInterval is the pause before listening for database notifications again.
+	ReconnectInterval time.Duration `yaml:"reconnect_interval" toml:"reconnect_interval" env:"EVENTS_RECONNECT_INTERVAL"`
+}
+
+// Webhooks holds delivery settings of events pushed to subscribed API clients.
+type Webhooks struct {
+	// Interval is how often pending deliveries are looked for.
+	Interval  time.Duration `yaml:"interval" toml:"interval" env:"WEBHOOKS_INTERVAL"`
+	Timeout   time.Duration `yaml:"timeout" toml:"timeout" env:"WEBHOOKS_TIMEOUT"`
+	BatchSize int           `yaml:"batch_size" toml:"batch_size" env:"WEBHOOKS_BATCH_SIZE"`
+	// MaxAttempts is how many times a delivery is tried before it fails for good.
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts" env:"WEBHOOKS_MAX_ATTEMPTS"`
+	// A failed attempt is retried after BackoffBase, doubling with every attempt up to BackoffMax.
+	BackoffBase time.Duration `yaml:"backoff_base" toml:"backoff_base" env:"WEBHOOKS_BACKOFF_BASE"`
+	BackoffMax  time.Duration `yaml:"backoff_max" toml:"backoff_max" env:"WEBHOOKS_BACKOFF_MAX"`
+}
+
+// Log holds logging settings. Reloadable on SIGHUP.
+type Log struct {
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+}
+
+// RateLimit holds per-client request limits. Reloadable on SIGHUP.
+// Zero RequestsPerSecond disables limiting.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second" toml:"requests_per_second" env:"RATE_LIMIT_RPS"`
+	Burst             int     `yaml:"burst" toml:"burst" env:"RATE_LIMIT_BURST"`
+}
+
+// Default returns configuration with built-in defaults applied.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Address:           "localhost:8080",
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       time.Minute,
+			ShutdownTimeout:   5 * time.Second,
+			IdempotencyWindow: 24 * time.Hour,
+			IdempotencyLease:  time.Minute,
+			MaxBatchOrders:    1000,
+		},
+		TLS: TLS{
+			ReloadInterval: time.Minute,
+			MinVersion:     "1.2",
+		},
+		Database: Database{
+			MaxConns:        10,
+			MinConns:        2,
+			MaxConnLifetime: time.Hour,
+			MaxConnIdleTime: 30 * time.Minute,
+
+			HealthCheckPeriod:  time.Minute,
+			StatementTimeout:   30 * time.Second,
+			PreparedStatements: true,
+			StatementCacheSize: 512,
+
+			ReplicaHealthInterval: 5 * time.Second,
+			ReplicaMaxLag:         10 * time.Second,
+			PrimaryPinWindow:      5 * time.Second,
+		},
+		Accrual: Accrual{
+			Timeout:             5 * time.Second,
+			BatchSize:           50,
+			WebhookReplayWindow: 5 * time.Minute,
+		},
+		Auth: Auth{
+			JWTKey:   "gopher",
+			TokenTTL: time.Hour,
+		},
+		Daemon: Daemon{
+			PollInterval:     time.Second,
+			FallbackInterval: time.Minute,
+			FallbackAge:      5 * time.Minute,
+			MaxAge:           72 * time.Hour,
+			MaxAttempts:      20,
+		},
+		Balance: Balance{
+			ReversalPolicy: ReversalCapAtZero,
+			HoldTTL:        15 * time.Minute,
+			SweepInterval:  time.Minute,
+			ExpiryNotice:   30 * 24 * time.Hour,
+		},
+		Loyalty: Loyalty{
+			Basis:               TierBasisAccrual,
+			Window:              365 * 24 * time.Hour,
+			RecalculateInterval: 24 * time.Hour,
+		},
+		Transfers: Transfers{
+			DailyLimit:            5000,
+			ConfirmationThreshold: 1000,
+			ConfirmationTTL:       15 * time.Minute,
+			MinAccountAge:         7 * 24 * time.Hour,
+		},
+		Referrals: Referrals{
+			ReferrerBonus: 100,
+			RefereeBonus:  50,
+		},
+		Events: Events{
+			Heartbeat:         5 * time.Second,
+			Buffer:            16,
+			ReconnectInterval: 5 * time.Second,
+		},
+		Webhooks: Webhooks{
+			Interval:    time.Second,
+			Timeout:     10 * time.Second,
+			BatchSize:   50,
+			MaxAttempts: 10,
+			BackoffBase: 10 * time.Second,
+			BackoffMax:  time.Hour,
+		},
+		Log: Log{
+			Level: "info",
+		},
+		RateLimit: RateLimit{
+			RequestsPerSecond: 0,
+			Burst:             20,
+		},
+	}
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the configuration for missing or inconsistent settings.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Address); err != nil {
+		add("server.address %q must be host:port", c.Server.Address)
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		add("server timeouts must not be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		add("server.shutdown_timeout must be positive")
+	}
+	if c.Server.IdempotencyWindow <= 0 || c.Server.IdempotencyLease <= 0 {
+		add("server.idempotency_window and server.idempotency_lease must be positive")
+	}
+	if c.Server.MaxBatchOrders < 1 {
+		add("server.max_batch_orders must be at least 1")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			add("server.trusted_proxies %q is not a CIDR", proxy)
+		}
+	}
+
+	if len(c.TLS.CertFile) > 0 != (len(c.TLS.KeyFile) > 0) {
+		add("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		add("tls.reload_interval must be positive")
+	}
+	if _, ok := TLSVersions[c.TLS.MinVersion]; !ok {
+		add("tls.min_version %q must be one of 1.0, 1.1, 1.2, 1.3", c.TLS.MinVersion)
+	}
+	if ids, err := CipherSuiteIDs(c.TLS.CipherSuites); err != nil {
+		add("tls.cipher_suites: %s", err)
+	} else if !servesHTTP2(ids, TLSVersions[c.TLS.MinVersion]) {
+		add("tls.cipher_suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or " +
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires")
+	}
+	if len(c.TLS.RedirectAddress) > 0 && !c.TLS.Enabled() {
+		add("tls.redirect_address requires TLS to be enabled")
+	}
+	if len(c.TLS.ClientCAFile) > 0 && !c.TLS.Enabled() {
+		add("tls.client_ca_file requires TLS to be enabled")
+	}
+
+	if len(c.Database.URI) == 0 {
+		add("database.uri is required (DATABASE_URI or -d)")
+	}
+	if c.Database.MaxConns <= 0 {
+		add("database.max_conns must be positive")
+	}
+	if c.Database.MinConns < 0 || c.Database.MinConns > c.Database.MaxConns {
+		add("database.min_conns must be between 0 and database.max_conns")
+	}
+	if c.Database.MaxConnLifetime < 0 || c.Database.MaxConnIdleTime < 0 {
+		add("database connection lifetimes must not be negative")
+	}
+	if c.Database.HealthCheckPeriod <= 0 {
+		add("database.health_check_period must be positive")
+	}
+	if c.Database.StatementTimeout < 0 {
+		add("database.statement_timeout must not be negative")
+	}
+	if c.Database.PreparedStatements && c.Database.StatementCacheSize <= 0 {
+		add("database.statement_cache_size must be positive when prepared statements are enabled")
+	}
+	for i, replica := range c.Database.Replicas {
+		if len(replica) == 0 {
+			add("database.replicas[%d] must not be empty", i)
+		}
+	}
+	if len(c.Database.Replicas) > 0 && (c.Database.ReplicaHealthInterval <= 0 || c.Database.PrimaryPinWindow < 0 ||
+		c.Database.ReplicaMaxLag < 0) {
+		add("database.replica_health_interval must be positive, " +
+			"database.primary_pin_window and database.replica_max_lag not negative")
+	}
+
+	if len(c.Accrual.Address) == 0 {
+		add("accrual.address is required (ACCRUAL_SYSTEM_ADDRESS or -r)")
+	}
+	if c.Accrual.Timeout <= 0 {
+		add("accrual.timeout must be positive")
+	}
+	if c.Accrual.BatchSize < 1 {
+		add("accrual.batch_size must be at least 1")
+	}
+	if c.Accrual.WebhookEnabled() && c.Accrual.WebhookReplayWindow <= 0 {
+		add("accrual.webhook_replay_window must be positive")
+	}
+
+	if len(c.Auth.JWTKey) == 0 {
+		add("auth.jwt_key must not be empty")
+	}
+	if c.Auth.TokenTTL <= 0 {
+		add("auth.token_ttl must be positive")
+	}
+
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for i, client := range c.Auth.APIClients {
+		if len(client.Name) == 0 || len(client.Key) == 0 {
+			add("auth.api_clients[%d] must have name and key", i)
+		}
+		if names[client.Name] || keys[client.Key] {
+			add("auth.api_clients[%d] duplicates name or key of another client", i)
+		}
+		names[client.Name] = true
+		keys[client.Key] = true
+	}
+
+	if c.Daemon.PollInterval <= 0 {
+		add("daemon.poll_interval must be positive")
+	}
+	if c.Daemon.FallbackInterval <= 0 || c.Daemon.FallbackAge < 0 {
+		add("daemon.fallback_interval must be positive and daemon.fallback_age not negative")
+	}
+	if c.Daemon.MaxAge < 0 || c.Daemon.MaxAttempts < 0 {
+		add("daemon.max_age and daemon.max_attempts must not be negative")
+	}
+
+	if c.Balance.ReversalPolicy != ReversalAllowDebt && c.Balance.ReversalPolicy != ReversalCapAtZero {
+		add("balance.reversal_policy must be %q or %q", ReversalAllowDebt, ReversalCapAtZero)
+	}
+	if c.Balance.HoldTTL <= 0 || c.Balance.SweepInterval <= 0 {
+		add("balance.hold_ttl and balance.sweep_interval must be positive")
+	}
+	if c.Balance.PointsTTL < 0 || c.Balance.ExpiryNotice < 0 {
+		add("balance.points_ttl and balance.expiry_notice must not be negative")
+	}
+	for _, format := range c.Balance.WithdrawalOrderFormats {
+		if _, err := regexp.Compile(format); err != nil {
+			add("balance.withdrawal_order_formats: %s", err)
+		}
+	}
+
+	if c.Loyalty.Basis != TierBasisAccrual && c.Loyalty.Basis != TierBasisSpend {
+		add("loyalty.basis must be %q or %q", TierBasisAccrual, TierBasisSpend)
+	}
+	if c.Loyalty.Window <= 0 || c.Loyalty.RecalculateInterval <= 0 {
+		add("loyalty.window and loyalty.recalculate_interval must be positive")
+	}
+	tiers := make(map[string]bool)
+	for i, tier := range c.Loyalty.Tiers {
+		if len(tier.Name) == 0 || tiers[tier.Name] {
+			add("loyalty.tiers[%d] must have a unique name", i)
+		}
+		if tier.Threshold < 0 || tier.Multiplier <= 0 {
+			add("loyalty.tiers[%d] must have a non-negative threshold and a positive multiplier", i)
+		}
+		tiers[tier.Name] = true
+	}
+
+	if c.Transfers.DailyLimit < 0 || c.Transfers.ConfirmationThreshold < 0 || c.Transfers.MinAccountAge < 0 {
+		add("transfers.daily_limit, transfers.confirmation_threshold and transfers.min_account_age " +
+			"must not be negative")
+	}
+	if c.Transfers.ConfirmationTTL <= 0 {
+		add("transfers.confirmation_ttl must be positive")
+	}
+
+	if c.Referrals.ReferrerBonus < 0 || c.Referrals.RefereeBonus < 0 {
+		add("referrals.referrer_bonus and referrals.referee_bonus must not be negative")
+	}
+
+	if c.Events.Heartbeat <= 0 || c.Events.ReconnectInterval <= 0 {
+		add("events.heartbeat and events.reconnect_interval must be positive")
+	}
+	if c.Events.Buffer < 1 {
+		add("events.buffer must be at least 1")
+	}
+
+	if c.Webhooks.Interval <= 0 || c.Webhooks.Timeout <= 0 {
+		add("webhooks.interval and webhooks.timeout must be positive")
+	}
+	if c.Webhooks.BatchSize < 1 || c.Webhooks.MaxAttempts < 1 {
+		add("webhooks.batch_size and webhooks.max_attempts must be at least 1")
+	}
+	if c.Webhooks.BackoffBase <= 0 || c.Webhooks.BackoffMax < c.Webhooks.BackoffBase {
+		add("webhooks.backoff_base must be positive and not above webhooks.backoff_max")
+	}
+
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		add("log.level %q is not a valid level", c.Log.Level)
+	}
+
+	if c.RateLimit.RequestsPerSecond < 0 {
+		add("rate_limit.requests_per_second must not be negative")
+	}
+	if c.RateLimit.RequestsPerSecond > 0 && c.RateLimit.Burst <= 0 {
+		add("rate_limit.burst must be positive when rate limiting is enabled")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets masked, suitable for printing.
+func (c Config) Redacted() Config {
+	if len(c.Auth.JWTKey) > 0 {
+		c.Auth.JWTKey = redactedValue
+	}
+	c.Database.URI = redactURI(c.Database.URI)
+	if len(c.Accrual.WebhookSecret) > 0 {
+		c.Accrual.WebhookSecret = redactedValue
+	}
+	replicas := make([]string, len(c.Database.Replicas))
+	for i, replica := range c.Database.Replicas {
+		replicas[i] = redactURI(replica)
+	}
+	c.Database.Replicas = replicas
+	clients := make([]APIClient, len(c.Auth.APIClients))
+	for i, client := range c.Auth.APIClients {
+		client.Key = redactedValue
+		clients[i] = client
+	}
+	c.Auth.APIClients = clients
+	return c
+}
+
+const redactedValue = "REDACTED"
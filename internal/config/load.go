@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const configFileEnv = "CONFIG"
+
+// Load builds the effective configuration from built-in defaults, an optional
+// YAML or TOML file, environment variables and command line flags. Later sources
+// take precedence over earlier ones. The result is validated.
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	configPath := flags.StringP("config", "c", os.Getenv(configFileEnv), "configuration file (YAML or TOML)")
+	address := flags.StringP("address", "a", "", "server address - host:port")
+	database := flags.StringP("database", "d", "", "database URI")
+	accrual := flags.StringP("accrual", "r", "", "accrual system address")
+	logLevel := flags.String("log-level", "", "log level")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := Default()
+
+	if len(*configPath) != 0 {
+		if err := loadFile(*configPath, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := env.Parse(config); err != nil {
+		return nil, fmt.Errorf("unable to read configuration from environment variables: %w", err)
+	}
+
+	if flags.Changed("address") {
+		config.Server.Address = *address
+	}
+	if flags.Changed("database") {
+		config.Database.URI = *database
+	}
+	if flags.Changed("accrual") {
+		config.Accrual.Address = *accrual
+	}
+	if flags.Changed("log-level") {
+		config.Log.Level = *logLevel
+	}
+
+	return config, config.Validate()
+}
+
+func loadFile(path string, config *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, config)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(content), config)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys: %v", meta.Undecoded())
+		}
+	default:
+		return fmt.Errorf("unsupported configuration file format: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+			return u.String()
+		}
+	}
+	return dsnPassword.ReplaceAllString(uri, "password="+redactedValue)
+}
+
+// Print writes the configuration as YAML with secrets masked.
+func (c Config) Print() (string, error) {
+	content, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSVersions maps configuration values to TLS protocol versions.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CipherSuiteIDs resolves cipher suite names as reported by crypto/tls.
+// An empty list selects the Go defaults.
+func CipherSuiteIDs(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// servesHTTP2 tells whether HTTP/2 can be negotiated with the cipher suites,
+// which must include one of the suites it requires when TLS 1.2 is allowed.
+func servesHTTP2(ids []uint16, minVersion uint16) bool {
+	if len(ids) == 0 || minVersion >= tls.VersionTLS13 {
+		return true
+	}
+	for _, id := range ids {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Config controls the emulated accrual system behaviour.
+type Config struct {
+	Address string `env:"RUN_ADDRESS"`
+	// RulesFile is a YAML list of reward rules loaded at startup.
+	RulesFile string `env:"EMULATOR_RULES_FILE"`
+
+	// RegisteredFor and ProcessingFor define how long an order stays in each
+	// intermediate status before it becomes PROCESSED.
+	RegisteredFor time.Duration `env:"EMULATOR_REGISTERED_FOR"`
+	ProcessingFor time.Duration `env:"EMULATOR_PROCESSING_FOR"`
+
+	// RequestsPerMinute limits order lookups, single or batch, zero disables the limit.
+	RequestsPerMinute int `env:"EMULATOR_REQUESTS_PER_MINUTE"`
+
+	Latency   time.Duration `env:"EMULATOR_LATENCY"`
+	Jitter    time.Duration `env:"EMULATOR_JITTER"`
+	ErrorRate float64       `env:"EMULATOR_ERROR_RATE"`
+
+	// WebhookURL receives signed status pushes when set.
+	WebhookURL    string        `env:"EMULATOR_WEBHOOK_URL"`
+	WebhookSecret string        `env:"EMULATOR_WEBHOOK_SECRET"`
+	PushInterval  time.Duration `env:"EMULATOR_PUSH_INTERVAL"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Address:       "localhost:8081",
+		RegisteredFor: time.Second,
+		ProcessingFor: 2 * time.Second,
+		PushInterval:  200 * time.Millisecond,
+	}
+}
+
+// LoadConfig reads the configuration from environment variables and flags, flags win.
+func LoadConfig(args []string) (*Config, error) {
+	config := DefaultConfig()
+	if err := env.Parse(config); err != nil {
+		return nil, err
+	}
+
+	flags := flag.NewFlagSet("accrual", flag.ContinueOnError)
+	flags.StringVarP(&config.Address, "address", "a", config.Address, "server address - host:port")
+	flags.StringVar(&config.RulesFile, "rules", config.RulesFile, "reward rules file (YAML)")
+	flags.DurationVar(&config.RegisteredFor, "registered-for", config.RegisteredFor, "time in REGISTERED status")
+	flags.DurationVar(&config.ProcessingFor, "processing-for", config.ProcessingFor, "time in PROCESSING status")
+	flags.IntVar(&config.RequestsPerMinute, "rpm", config.RequestsPerMinute, "order info requests per minute, 0 - unlimited")
+	flags.DurationVar(&config.Latency, "latency", config.Latency, "artificial response latency")
+	flags.DurationVar(&config.Jitter, "jitter", config.Jitter, "random extra latency up to this value")
+	flags.Float64Var(&config.ErrorRate, "error-rate", config.ErrorRate, "share of requests failing with 500, 0..1")
+	flags.StringVar(&config.WebhookURL, "webhook-url", config.WebhookURL, "status push URL")
+	flags.StringVar(&config.WebhookSecret, "webhook-secret", config.WebhookSecret, "status push HMAC key")
+	flags.DurationVar(&config.PushInterval, "push-interval", config.PushInterval, "status push check interval")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if config.ErrorRate < 0 || config.ErrorRate > 1 {
+		return nil, fmt.Errorf("error rate must be between 0 and 1")
+	}
+	if config.RequestsPerMinute < 0 || config.Latency < 0 || config.Jitter < 0 {
+		return nil, fmt.Errorf("rate limit and latency must not be negative")
+	}
+	if len(config.WebhookURL) > 0 && (len(config.WebhookSecret) == 0 || config.PushInterval <= 0) {
+		return nil, fmt.Errorf("webhook requires a secret and a positive push interval")
+	}
+	return config, nil
+}
+
+// LoadRules reads reward rules from a YAML file.
+func LoadRules(path string) ([]Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = yaml.UnmarshalStrict(content, &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err = rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,157 @@
+package emulator
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_Order(t *testing.T) {
+	config := DefaultConfig()
+	store := NewStore(config, []Rule{
+		{Match: "Bork", Reward: 10, RewardType: RewardPercent},
+		{Match: "Acer", Reward: 50, RewardType: RewardPoints},
+	})
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.RegisterOrder("12345678903", []Good{
+		{Description: "Чайник Bork", Price: 7000},
+		{Description: "Ноутбук Acer", Price: 30000},
+		{Description: "Стол", Price: 1000},
+	}))
+	require.NoError(t, store.RegisterOrder("2377225624", nil))
+	assert.True(t, errors.Is(store.RegisterOrder("12345678903", nil), ErrOrderExists))
+
+	_, ok := store.Order("79927398713")
+	assert.False(t, ok)
+
+	tests := []struct {
+		name    string
+		after   time.Duration
+		order   string
+		status  string
+		accrual float64
+	}{
+		{name: "registered", after: 0, order: "12345678903", status: StatusRegistered},
+		{name: "processing", after: config.RegisteredFor, order: "12345678903", status: StatusProcessing},
+		{name: "processed", after: config.RegisteredFor + config.ProcessingFor, order: "12345678903",
+			status: StatusProcessed, accrual: 750},
+		{name: "invalid", after: config.RegisteredFor, order: "2377225624", status: StatusInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.now = func() time.Time { return now.Add(tt.after) }
+			info, found := store.Order(tt.order)
+			require.True(t, found)
+			assert.Equal(t, tt.status, info.Status)
+			if tt.accrual > 0 {
+				require.NotNil(t, info.Accrual)
+				assert.Equal(t, tt.accrual, *info.Accrual)
+			} else {
+				assert.Nil(t, info.Accrual)
+			}
+		})
+	}
+}
+
+func TestStore_Changes(t *testing.T) {
+	config := DefaultConfig()
+	store := NewStore(config, nil)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.RegisterOrder("12345678903", []Good{{Description: "Стол", Price: 1000}}))
+	changes := store.Changes()
+	require.Len(t, changes, 1)
+	assert.Equal(t, StatusRegistered, changes[0].Status)
+	assert.Empty(t, store.Changes())
+
+	store.now = func() time.Time { return now.Add(config.RegisteredFor) }
+	changes = store.Changes()
+	require.Len(t, changes, 1)
+	assert.Equal(t, StatusProcessing, changes[0].Status)
+
+	store.Unmark("12345678903")
+	assert.Len(t, store.Changes(), 1)
+}
+
+func TestHandler(t *testing.T) {
+	config := DefaultConfig()
+	config.RequestsPerMinute = 2
+	ts := httptest.NewServer(NewHandler(NewStore(config, nil), config))
+	defer ts.Close()
+
+	post := func(path, body string) int {
+		response, err := http.Post(ts.URL+path, contentTypeJSON, strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+		return response.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post("/api/goods", `{"match": "Bork", "reward": 10, "reward_type": "%"}`))
+	assert.Equal(t, http.StatusConflict, post("/api/goods", `{"match": "Bork", "reward": 5, "reward_type": "pt"}`))
+	assert.Equal(t, http.StatusBadRequest, post("/api/goods", `{"match": "Acer", "reward": 5, "reward_type": "x"}`))
+
+	assert.Equal(t, http.StatusAccepted,
+		post("/api/orders", `{"order": "12345678903", "goods": [{"description": "Bork", "price": 100}]}`))
+	assert.Equal(t, http.StatusConflict, post("/api/orders", `{"order": "12345678903", "goods": []}`))
+	assert.Equal(t, http.StatusBadRequest, post("/api/orders", `{"order": "12345678904", "goods": []}`))
+
+	response, err := http.Get(ts.URL + "/api/orders/12345678903")
+	require.NoError(t, err)
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	var info OrderInfo
+	require.NoError(t, json.Unmarshal(content, &info))
+	assert.Equal(t, StatusRegistered, info.Status)
+
+	response, err = http.Get(ts.URL + "/api/orders/79927398713")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+
+	response, err = http.Get(ts.URL + "/api/orders/12345678903")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.NotEmpty(t, response.Header.Get("Retry-After"))
+}
+
+func TestHandler_Batch(t *testing.T) {
+	config := DefaultConfig()
+	config.RequestsPerMinute = 1
+	store := NewStore(config, nil)
+	require.NoError(t, store.RegisterOrder("12345678903", nil))
+	require.NoError(t, store.RegisterOrder("79927398713", nil))
+	ts := httptest.NewServer(NewHandler(store, config))
+	defer ts.Close()
+
+	response, err := http.Post(ts.URL+"/api/orders/batch", contentTypeJSON,
+		strings.NewReader(`["12345678903", "4561261212345467", "79927398713"]`))
+	require.NoError(t, err)
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	var infos []OrderInfo
+	require.NoError(t, json.Unmarshal(content, &infos))
+	require.Len(t, infos, 2)
+	assert.Equal(t, "12345678903", infos[0].Order)
+	assert.Equal(t, "79927398713", infos[1].Order)
+
+	response, err = http.Post(ts.URL+"/api/orders/batch", contentTypeJSON, strings.NewReader(`["12345678903"]`))
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+}
@@ -0,0 +1,73 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/accrual"
+)
+
+// Pusher sends signed status updates to the loyalty system as orders progress.
+type Pusher struct {
+	store  *Store
+	config *Config
+	client *http.Client
+}
+
+func NewPusher(store *Store, config *Config) Pusher {
+	return Pusher{
+		store:  store,
+		config: config,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (p Pusher) Start(ctx context.Context) {
+	ticker := time.NewTicker(p.config.PushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, info := range p.store.Changes() {
+				if err := p.push(ctx, info); err != nil {
+					log.Errorf("Unable to push order %s status: %s", info.Order, err)
+					p.store.Unmark(info.Order)
+				}
+			}
+		}
+	}
+}
+
+func (p Pusher) push(ctx context.Context, info OrderInfo) error {
+	body, err := json.Marshal(&info)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", contentTypeJSON)
+	request.Header.Set(accrual.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(accrual.SignatureHeader, accrual.Sign([]byte(p.config.WebhookSecret), timestamp, body))
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package emulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/luhn"
+)
+
+const (
+	contentTypeJSON = "application/json"
+
+	// maxBatchSize caps the number of orders in one batch lookup.
+	maxBatchSize = 1000
+)
+
+type registerOrderRequest struct {
+	Order string `json:"order"`
+	Goods []Good `json:"goods"`
+}
+
+// windowLimiter allows a fixed number of requests per minute, like the real system.
+type windowLimiter struct {
+	mu          sync.Mutex
+	limit       int
+	windowStart time.Time
+	count       int
+}
+
+func (l *windowLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.windowStart) >= time.Minute {
+		l.windowStart = now
+		l.count = 0
+	}
+	if l.count >= l.limit {
+		return false, int(l.windowStart.Add(time.Minute).Sub(now).Seconds()) + 1
+	}
+	l.count++
+	return true, 0
+}
+
+// NewHandler serves the accrual system API on top of the store.
+func NewHandler(store *Store, config *Config) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(injectFaults(config))
+
+	var limiter *windowLimiter
+	if config.RequestsPerMinute > 0 {
+		limiter = &windowLimiter{limit: config.RequestsPerMinute}
+	}
+
+	r.Get("/api/orders/{number}", orderHandler(store, limiter))
+	r.Post("/api/orders/batch", batchOrdersHandler(store, limiter))
+	r.Post("/api/orders", registerOrderHandler(store))
+	r.Post("/api/goods", registerRuleHandler(store))
+	return r
+}
+
+// injectFaults delays responses and fails a share of requests as configured.
+func injectFaults(config *Config) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delay := config.Latency
+			if config.Jitter > 0 {
+				delay += time.Duration(rand.Int63n(int64(config.Jitter))) //nolint:gosec // not security sensitive
+			}
+			if delay > 0 {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(delay):
+				}
+			}
+			if config.ErrorRate > 0 && rand.Float64() < config.ErrorRate { //nolint:gosec // not security sensitive
+				http.Error(w, "Injected failure", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimited answers 429 and reports true when the request is over the limit.
+func rateLimited(w http.ResponseWriter, limiter *windowLimiter) bool {
+	if limiter == nil {
+		return false
+	}
+	ok, retryAfter := limiter.allow(time.Now())
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = fmt.Fprintf(w, "No more than %d requests per minute allowed", limiter.limit)
+	return true
+}
+
+func orderHandler(store *Store, limiter *windowLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(w, limiter) {
+			return
+		}
+
+		info, ok := store.Order(chi.URLParam(r, "number"))
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		response, err := json.Marshal(&info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+// batchOrdersHandler answers a JSON array of order numbers with the states of
+// the known ones. A batch counts as a single request against the rate limit.
+func batchOrdersHandler(store *Store, limiter *windowLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(w, limiter) {
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var numbers []string
+		if err = json.Unmarshal(body, &numbers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(numbers) > maxBatchSize {
+			http.Error(w, fmt.Sprintf("No more than %d orders per batch allowed", maxBatchSize), http.StatusBadRequest)
+			return
+		}
+
+		infos := make([]OrderInfo, 0, len(numbers))
+		for _, number := range numbers {
+			if info, ok := store.Order(number); ok {
+				infos = append(infos, info)
+			}
+		}
+		response, err := json.Marshal(infos)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func registerOrderHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var request registerOrderRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !luhn.Valid(request.Order) {
+			http.Error(w, "Bad order number", http.StatusBadRequest)
+			return
+		}
+
+		err = store.RegisterOrder(request.Order, request.Goods)
+		if errors.Is(err, ErrOrderExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func registerRuleHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var rule Rule
+		if err = json.Unmarshal(body, &rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = store.AddRule(rule)
+		if errors.Is(err, ErrRuleExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,197 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+var (
+	ErrOrderExists = errors.New("order is already registered")
+	ErrRuleExists  = errors.New("reward rule for this match is already registered")
+)
+
+// Rule rewards goods whose description contains Match.
+type Rule struct {
+	Match      string  `json:"match" yaml:"match"`
+	Reward     float64 `json:"reward" yaml:"reward"`
+	RewardType string  `json:"reward_type" yaml:"reward_type"`
+}
+
+func (r Rule) validate() error {
+	if len(r.Match) == 0 {
+		return fmt.Errorf("rule match must not be empty")
+	}
+	if r.Reward < 0 {
+		return fmt.Errorf("rule %q reward must not be negative", r.Match)
+	}
+	if r.RewardType != RewardPercent && r.RewardType != RewardPoints {
+		return fmt.Errorf("rule %q reward type must be %q or %q", r.Match, RewardPercent, RewardPoints)
+	}
+	return nil
+}
+
+func (r Rule) reward(price float64) float64 {
+	if r.RewardType == RewardPercent {
+		return price * r.Reward / 100
+	}
+	return r.Reward
+}
+
+type Good struct {
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+}
+
+type OrderInfo struct {
+	Order   string   `json:"order"`
+	Status  string   `json:"status"`
+	Accrual *float64 `json:"accrual,omitempty"`
+}
+
+type order struct {
+	number       string
+	goods        []Good
+	registeredAt time.Time
+	accrual      *float64
+	invalid      bool
+	pushed       string
+}
+
+// Store keeps registered orders and reward rules in memory.
+type Store struct {
+	mu     sync.RWMutex
+	orders map[string]*order
+	rules  []Rule
+	config *Config
+	now    func() time.Time
+}
+
+func NewStore(config *Config, rules []Rule) *Store {
+	return &Store{
+		orders: make(map[string]*order),
+		rules:  rules,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+func (s *Store) AddRule(rule Rule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.rules {
+		if existing.Match == rule.Match {
+			return ErrRuleExists
+		}
+	}
+	s.rules = append(s.rules, rule)
+	return nil
+}
+
+// RegisterOrder accepts an order for calculation. Orders without goods are
+// registered but end up INVALID, like the real system does with rejected orders.
+func (s *Store) RegisterOrder(number string, goods []Good) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orders[number]; ok {
+		return ErrOrderExists
+	}
+	s.orders[number] = &order{
+		number:       number,
+		goods:        goods,
+		registeredAt: s.now(),
+		invalid:      len(goods) == 0,
+	}
+	return nil
+}
+
+// Order reports the order status as of now, calculating the accrual once the
+// processing time has passed. The second result is false for unknown orders.
+func (s *Store) Order(number string) (OrderInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[number]
+	if !ok {
+		return OrderInfo{}, false
+	}
+	return s.info(o), true
+}
+
+// Changes returns orders whose status changed since the previous call and marks
+// them as pushed.
+func (s *Store) Changes() []OrderInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes []OrderInfo
+	for _, o := range s.orders {
+		info := s.info(o)
+		if info.Status != o.pushed {
+			o.pushed = info.Status
+			changes = append(changes, info)
+		}
+	}
+	return changes
+}
+
+// Unmark makes the order reported by the next Changes call again, e.g. after a failed push.
+func (s *Store) Unmark(number string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.orders[number]; ok {
+		o.pushed = ""
+	}
+}
+
+func (s *Store) info(o *order) OrderInfo {
+	info := OrderInfo{Order: o.number}
+	elapsed := s.now().Sub(o.registeredAt)
+	switch {
+	case elapsed < s.config.RegisteredFor:
+		info.Status = StatusRegistered
+	case o.invalid:
+		info.Status = StatusInvalid
+	case elapsed < s.config.RegisteredFor+s.config.ProcessingFor:
+		info.Status = StatusProcessing
+	default:
+		if o.accrual == nil {
+			accrual := s.calculate(o.goods)
+			o.accrual = &accrual
+		}
+		info.Status = StatusProcessed
+		if *o.accrual > 0 {
+			info.Accrual = o.accrual
+		}
+	}
+	return info
+}
+
+func (s *Store) calculate(goods []Good) float64 {
+	var accrual float64
+	for _, good := range goods {
+		for _, rule := range s.rules {
+			if strings.Contains(good.Description, rule.Match) {
+				accrual += rule.reward(good.Price)
+				break
+			}
+		}
+	}
+	return math.Round(accrual*100) / 100
+}
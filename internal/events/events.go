@@ -0,0 +1,101 @@
+// Package events fans order and balance changes out to the streams of their users.
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/storage"
+)
+
+// Bus delivers events to the subscribers of their login. Publishing never
+// blocks, a subscriber with a full buffer misses the event.
+type Bus struct {
+	buffer int
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan storage.Event]struct{}
+}
+
+func NewBus(buffer int) *Bus {
+	return &Bus{
+		buffer:      buffer,
+		subscribers: make(map[string]map[chan storage.Event]struct{}),
+	}
+}
+
+// Subscribe returns the events of login and a function ending the subscription.
+func (b *Bus) Subscribe(login string) (<-chan storage.Event, func()) {
+	ch := make(chan storage.Event, b.buffer)
+
+	b.mu.Lock()
+	if b.subscribers[login] == nil {
+		b.subscribers[login] = make(map[chan storage.Event]struct{})
+	}
+	b.subscribers[login][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers[login], ch)
+			if len(b.subscribers[login]) == 0 {
+				delete(b.subscribers, login)
+			}
+		})
+	}
+}
+
+func (b *Bus) Publish(event storage.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.Login] {
+		select {
+		case ch <- event:
+		default:
+			log.Debugf("Dropped %s event for a slow stream of %s", event.Type, event.Login)
+		}
+	}
+}
+
+// Listener publishes the database notifications of every instance on a bus,
+// listening again after a connection failure.
+type Listener struct {
+	repository        storage.Repository
+	bus               *Bus
+	reconnectInterval time.Duration
+}
+
+func NewListener(repository storage.Repository, bus *Bus, config *config.Config) Listener {
+	return Listener{
+		repository:        repository,
+		bus:               bus,
+		reconnectInterval: config.Events.ReconnectInterval,
+	}
+}
+
+func (l Listener) Start(ctx context.Context) error {
+	for {
+		err := l.repository.ListenEvents(ctx, l.bus.Publish)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("listening stopped")
+		}
+		log.Warnf("Event notifications lost, listening again in %s: %s", l.reconnectInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(l.reconnectInterval):
+		}
+	}
+}
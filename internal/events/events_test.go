@@ -0,0 +1,58 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/storage"
+	"VladBag2022/gophermart/mocks"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus(1)
+	alice, unsubscribe := bus.Subscribe("alice")
+	bob, _ := bus.Subscribe("bob")
+
+	processed := storage.Event{Type: storage.EventOrder, Login: "alice", Order: "12345678903", Status: "PROCESSED"}
+	bus.Publish(processed)
+	// The buffer is full, the balance event is dropped rather than blocking.
+	bus.Publish(storage.Event{Type: storage.EventBalance, Login: "alice"})
+
+	assert.Equal(t, processed, <-alice)
+	assert.Len(t, alice, 0)
+	assert.Len(t, bob, 0)
+
+	unsubscribe()
+	unsubscribe()
+	bus.Publish(processed)
+	assert.Len(t, alice, 0)
+	assert.NotContains(t, bus.subscribers, "alice")
+}
+
+func TestListener_Start(t *testing.T) {
+	cfg := config.Default()
+	cfg.Events.ReconnectInterval = time.Millisecond
+	bus := NewBus(cfg.Events.Buffer)
+	events, _ := bus.Subscribe("alice")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	repository := new(mocks.Repository)
+	repository.On("ListenEvents", mock.Anything, mock.Anything).
+		Return(errors.New("connection reset")).Once()
+	repository.On("ListenEvents", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			args.Get(1).(func(storage.Event))(storage.Event{Type: storage.EventBalance, Login: "alice"})
+			cancel()
+		}).
+		Return(context.Canceled).Once()
+
+	assert.NoError(t, NewListener(repository, bus, cfg).Start(ctx))
+	assert.Equal(t, storage.Event{Type: storage.EventBalance, Login: "alice"}, <-events)
+	repository.AssertExpectations(t)
+}
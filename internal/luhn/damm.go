@@ -0,0 +1,48 @@
+package luhn
+
+// dammTable is a totally anti-symmetric quasigroup of order 10.
+var dammTable = [10][10]byte{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// dammScheme detects all single digit errors and adjacent transpositions
+// with a single table.
+type dammScheme struct{}
+
+func (dammScheme) Name() string {
+	return "damm"
+}
+
+func (dammScheme) Validate(number string) error {
+	if err := validateLength(number, 1); err != nil {
+		return err
+	}
+	if dammInterim(number) != 0 {
+		return ErrCheckDigit
+	}
+	return nil
+}
+
+func (dammScheme) Compute(payload string) (string, error) {
+	if err := ValidateDigits(payload); err != nil {
+		return "", err
+	}
+	return string(rune('0' + dammInterim(payload))), nil
+}
+
+func dammInterim(number string) byte {
+	var interim byte
+	for i := 0; i < len(number); i++ {
+		interim = dammTable[interim][number[i]-'0']
+	}
+	return interim
+}
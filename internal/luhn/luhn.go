@@ -1,25 +1,152 @@
+// Package luhn validates and computes check digits of digit strings, order
+// numbers in particular. Besides the Luhn algorithm it has Verhoeff, Damm and
+// ISO 7064 MOD 97-10 schemes, looked up by name.
 package luhn
 
-// Valid check number is valid or not based on Luhn algorithm
-func Valid(number int64) bool {
-	return (number%10+checksum(number/10))%10 == 0
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmpty      = errors.New("number is empty")
+	ErrTooShort   = errors.New("number is not longer than its check digits")
+	ErrCheckDigit = errors.New("check digit does not match")
+)
+
+// DigitError reports a character of a number that is not a decimal digit.
+type DigitError struct {
+	Position int
+	Char     rune
+}
+
+func (e *DigitError) Error() string {
+	return fmt.Sprintf("%q at position %d is not a digit", e.Char, e.Position)
 }
 
-func checksum(number int64) int64 {
-	var luhn int64
+// Scheme is a check digit algorithm.
+type Scheme interface {
+	// Name is what merchants select the scheme by.
+	Name() string
+	// Validate returns nil when number is digits ending with its check digits.
+	Validate(number string) error
+	// Compute returns the check digits of payload, digits without them.
+	Compute(payload string) (string, error)
+}
 
-	for i := 0; number > 0; i++ {
-		cur := number % 10
+var (
+	Luhn     Scheme = luhnScheme{}
+	Verhoeff Scheme = verhoeffScheme{}
+	Damm     Scheme = dammScheme{}
+	Mod97    Scheme = mod97Scheme{}
+	// None checks that the number is digits only.
+	None Scheme = noneScheme{}
+)
 
-		if i%2 == 0 { // even
+var schemes = map[string]Scheme{
+	Luhn.Name():     Luhn,
+	Verhoeff.Name(): Verhoeff,
+	Damm.Name():     Damm,
+	Mod97.Name():    Mod97,
+	None.Name():     None,
+}
+
+// Lookup returns the scheme with name.
+func Lookup(name string) (Scheme, bool) {
+	scheme, ok := schemes[name]
+	return scheme, ok
+}
+
+// Append returns payload followed by its check digits of scheme.
+func Append(scheme Scheme, payload string) (string, error) {
+	check, err := scheme.Compute(payload)
+	if err != nil {
+		return "", err
+	}
+	return payload + check, nil
+}
+
+// Valid check number is a string of digits ending with a check digit of the Luhn algorithm
+func Valid(number string) bool {
+	return Luhn.Validate(number) == nil
+}
+
+// ValidateDigits returns nil when number is a non-empty string of decimal digits.
+func ValidateDigits(number string) error {
+	if len(number) == 0 {
+		return ErrEmpty
+	}
+	for i, c := range number {
+		if c < '0' || c > '9' {
+			return &DigitError{Position: i, Char: c}
+		}
+	}
+	return nil
+}
+
+// validateLength checks number is digits with a payload before checkLen check digits.
+func validateLength(number string, checkLen int) error {
+	if err := ValidateDigits(number); err != nil {
+		return err
+	}
+	if len(number) <= checkLen {
+		return ErrTooShort
+	}
+	return nil
+}
+
+type luhnScheme struct{}
+
+func (luhnScheme) Name() string {
+	return "luhn"
+}
+
+func (luhnScheme) Validate(number string) error {
+	if err := validateLength(number, 1); err != nil {
+		return err
+	}
+	if luhnSum(number, false) != 0 {
+		return ErrCheckDigit
+	}
+	return nil
+}
+
+func (luhnScheme) Compute(payload string) (string, error) {
+	if err := ValidateDigits(payload); err != nil {
+		return "", err
+	}
+	return string(rune('0' + (10-luhnSum(payload, true))%10)), nil
+}
+
+// luhnSum is the Luhn sum of number modulo 10. Every second digit from the
+// check one is doubled, from the last digit itself when it is a payload.
+func luhnSum(number string, payload bool) int {
+	var sum int
+	double := payload
+	for i := len(number) - 1; i >= 0; i-- {
+		cur := int(number[i] - '0')
+		if double {
 			cur *= 2
 			if cur > 9 {
-				cur = cur%10 + cur/10
+				cur -= 9
 			}
 		}
-
-		luhn += cur
-		number /= 10
+		sum += cur
+		double = !double
 	}
-	return luhn % 10
+	return sum % 10
+}
+
+type noneScheme struct{}
+
+func (noneScheme) Name() string {
+	return "none"
+}
+
+func (noneScheme) Validate(number string) error {
+	return ValidateDigits(number)
+}
+
+func (noneScheme) Compute(payload string) (string, error) {
+	return "", ValidateDigits(payload)
 }
@@ -0,0 +1,181 @@
+package luhn
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var allSchemes = []Scheme{Luhn, Verhoeff, Damm, Mod97}
+
+func TestScheme_Compute(t *testing.T) {
+	tests := []struct {
+		scheme  Scheme
+		payload string
+		want    string
+	}{
+		{scheme: Luhn, payload: "7992739871", want: "3"},
+		{scheme: Luhn, payload: "123456789012345678901234", want: "0"},
+		{scheme: Verhoeff, payload: "236", want: "3"},
+		{scheme: Verhoeff, payload: "12345", want: "1"},
+		{scheme: Damm, payload: "572", want: "4"},
+		{scheme: Damm, payload: "12345", want: "9"},
+		{scheme: Mod97, payload: "794", want: "44"},
+		{scheme: Mod97, payload: "0001", want: "95"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme.Name()+" "+tt.payload, func(t *testing.T) {
+			check, err := tt.scheme.Compute(tt.payload)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, check)
+			assert.NoError(t, tt.scheme.Validate(tt.payload+check))
+		})
+	}
+}
+
+func TestScheme_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		scheme  Scheme
+		number  string
+		wantErr error
+	}{
+		{name: "luhn", scheme: Luhn, number: "79927398713"},
+		{name: "luhn leading zeros", scheme: Luhn, number: "0079927398713"},
+		{name: "luhn wrong check digit", scheme: Luhn, number: "79927398710", wantErr: ErrCheckDigit},
+		{name: "luhn empty", scheme: Luhn, number: "", wantErr: ErrEmpty},
+		{name: "luhn check digit only", scheme: Luhn, number: "0", wantErr: ErrTooShort},
+		{name: "verhoeff", scheme: Verhoeff, number: "2363"},
+		{name: "verhoeff transposition", scheme: Verhoeff, number: "3263", wantErr: ErrCheckDigit},
+		{name: "damm", scheme: Damm, number: "5724"},
+		{name: "damm transposition", scheme: Damm, number: "7524", wantErr: ErrCheckDigit},
+		{name: "mod97", scheme: Mod97, number: "79444"},
+		{name: "mod97 too short", scheme: Mod97, number: "44", wantErr: ErrTooShort},
+		{name: "none", scheme: None, number: "12"},
+		{name: "none empty", scheme: None, number: "", wantErr: ErrEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scheme.Validate(tt.number)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.wantErr), err)
+		})
+	}
+}
+
+func TestValidate_notDigit(t *testing.T) {
+	for _, scheme := range append(allSchemes, None) {
+		err := scheme.Validate("1234 5678")
+		var digitErr *DigitError
+		require.True(t, errors.As(err, &digitErr), scheme.Name())
+		assert.Equal(t, 4, digitErr.Position)
+		assert.Equal(t, ' ', digitErr.Char)
+		assert.Equal(t, "' ' at position 4 is not a digit", err.Error())
+	}
+}
+
+func TestScheme_singleDigitErrors(t *testing.T) {
+	for _, scheme := range allSchemes {
+		number, err := Append(scheme, "4561261212345467")
+		require.NoError(t, err)
+		for i := range number {
+			for d := byte('0'); d <= '9'; d++ {
+				if d == number[i] {
+					continue
+				}
+				changed := number[:i] + string(d) + number[i+1:]
+				assert.True(t, errors.Is(scheme.Validate(changed), ErrCheckDigit), "%s %s", scheme.Name(), changed)
+			}
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, scheme := range append(allSchemes, None) {
+		found, ok := Lookup(scheme.Name())
+		assert.True(t, ok)
+		assert.Equal(t, scheme, found)
+	}
+	_, ok := Lookup("crc")
+	assert.False(t, ok)
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid("12345678903"))
+	assert.True(t, Valid("1234567890123456789012340"))
+	assert.False(t, Valid("12345678904"))
+	assert.False(t, Valid("-12345678903"))
+}
+
+func FuzzAppend(f *testing.F) {
+	f.Add("12345678903")
+	f.Add("0")
+	f.Add("0001234567890123456789012345678901234567890")
+	f.Fuzz(func(t *testing.T, payload string) {
+		for _, scheme := range allSchemes {
+			number, err := Append(scheme, payload)
+			if ValidateDigits(payload) != nil {
+				assert.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(number, payload))
+			assert.NoError(t, scheme.Validate(number), "%s %s", scheme.Name(), number)
+		}
+	})
+}
+
+func FuzzValidate(f *testing.F) {
+	f.Add("79927398713")
+	f.Add("12a4")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, number string) {
+		for _, scheme := range append(allSchemes, None) {
+			err := scheme.Validate(number)
+			if ValidateDigits(number) != nil {
+				assert.Error(t, err)
+			}
+		}
+	})
+}
+
+func BenchmarkValidate(b *testing.B) {
+	numbers := map[string]string{
+		"16 digits": "4561261212345467",
+		"64 digits": strings.Repeat("4561261212345467", 4),
+	}
+	for _, scheme := range allSchemes {
+		for size, payload := range numbers {
+			number, err := Append(scheme, payload)
+			require.NoError(b, err)
+			b.Run(scheme.Name()+" "+size, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := scheme.Validate(number); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCompute(b *testing.B) {
+	payload := "456126121234546"
+	for _, scheme := range allSchemes {
+		b.Run(scheme.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := scheme.Compute(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
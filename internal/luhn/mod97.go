@@ -0,0 +1,40 @@
+package luhn
+
+import "fmt"
+
+// mod97Scheme is ISO 7064 MOD 97-10, with two check digits making the whole
+// number one modulo 97, as in IBANs.
+type mod97Scheme struct{}
+
+func (mod97Scheme) Name() string {
+	return "mod97"
+}
+
+func (mod97Scheme) Validate(number string) error {
+	if err := validateLength(number, 2); err != nil {
+		return err
+	}
+	if mod97(number, 0) != 1 {
+		return ErrCheckDigit
+	}
+	return nil
+}
+
+func (mod97Scheme) Compute(payload string) (string, error) {
+	if err := ValidateDigits(payload); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%02d", 98-mod97(payload, 2)), nil
+}
+
+// mod97 is number followed by zeros zero digits modulo 97.
+func mod97(number string, zeros int) int {
+	var r int
+	for i := 0; i < len(number); i++ {
+		r = (r*10 + int(number[i]-'0')) % 97
+	}
+	for ; zeros > 0; zeros-- {
+		r = r * 10 % 97
+	}
+	return r
+}
@@ -0,0 +1,63 @@
+package luhn
+
+// Verhoeff tables: multiplication of the dihedral group D5, the position
+// permutations and the inverses.
+var (
+	verhoeffD = [10][10]byte{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]byte{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+	verhoeffInv = [10]byte{0, 4, 3, 2, 1, 5, 6, 7, 8, 9}
+)
+
+// verhoeffScheme detects all single digit errors and adjacent transpositions.
+type verhoeffScheme struct{}
+
+func (verhoeffScheme) Name() string {
+	return "verhoeff"
+}
+
+func (verhoeffScheme) Validate(number string) error {
+	if err := validateLength(number, 1); err != nil {
+		return err
+	}
+	if verhoeffChecksum(number, 0) != 0 {
+		return ErrCheckDigit
+	}
+	return nil
+}
+
+func (verhoeffScheme) Compute(payload string) (string, error) {
+	if err := ValidateDigits(payload); err != nil {
+		return "", err
+	}
+	return string(rune('0' + verhoeffInv[verhoeffChecksum(payload, 1)])), nil
+}
+
+// verhoeffChecksum runs number through the tables, offset is the position of
+// its last digit counted from the check digit.
+func verhoeffChecksum(number string, offset int) byte {
+	var c byte
+	for i := len(number) - 1; i >= 0; i-- {
+		c = verhoeffD[c][verhoeffP[(len(number)-1-i+offset)%8][number[i]-'0']]
+	}
+	return c
+}
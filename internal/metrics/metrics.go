@@ -0,0 +1,32 @@
+// Package metrics publishes operational counters through expvar.
+package metrics
+
+import "expvar"
+
+// Dead-letter volume of the accrual daemon.
+var (
+	// DeadLettered counts orders dead-lettered since startup.
+	DeadLettered = expvar.NewInt("accrual_dead_lettered_total")
+	// DeadLetters is the number of dead-lettered orders at the last daemon pass.
+	DeadLetters = expvar.NewInt("accrual_dead_letters")
+	// DeadLettersRetried and DeadLettersResolved count admin actions since startup.
+	DeadLettersRetried  = expvar.NewInt("accrual_dead_letters_retried_total")
+	DeadLettersResolved = expvar.NewInt("accrual_dead_letters_resolved_total")
+	// AccrualFailures counts failed order status lookups since startup.
+	AccrualFailures = expvar.NewInt("accrual_lookup_failures_total")
+)
+
+// HoldsExpired counts withdrawal holds released by the sweeper since startup.
+var HoldsExpired = expvar.NewInt("balance_holds_expired_total")
+
+// PointsExpired counts points of lots that expired unspent since startup.
+var PointsExpired = expvar.NewFloat("balance_points_expired_total")
+
+// TierChanges counts users moved to another loyalty tier since startup.
+var TierChanges = expvar.NewInt("loyalty_tier_changes_total")
+
+// Webhook deliveries since startup. Failed ones ran out of attempts.
+var (
+	WebhooksDelivered = expvar.NewInt("webhooks_delivered_total")
+	WebhooksFailed    = expvar.NewInt("webhooks_failed_total")
+)
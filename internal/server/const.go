@@ -3,7 +3,18 @@ package server
 type contextKey string
 
 const (
-	contextJWTLogin     contextKey = "login"
-	contentTypeJSON     string     = "application/json"
-	authorizationHeader string     = "Authorization"
+	contextJWTLogin          contextKey = "login"
+	contextAPIClient         contextKey = "api_client"
+	contextConn              contextKey = "conn"
+	apiKeyHeader             string     = "X-API-Key"
+	idempotencyKeyHeader     string     = "Idempotency-Key"
+	idempotentReplayedHeader string     = "Idempotent-Replayed"
+	scopeAdmin               string     = "admin"
+	scopeRefunds             string     = "refunds"
+	scopeWebhooks            string     = "webhooks"
+	contentTypeJSON          string     = "application/json"
+	contentTypeEventStream   string     = "text/event-stream"
+	authorizationHeader      string     = "Authorization"
+	lastEventIDHeader        string     = "Last-Event-ID"
+	eventResync              string     = "resync"
 )
@@ -1,22 +1,36 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt"
 	log "github.com/sirupsen/logrus"
 
+	"VladBag2022/gophermart/internal/accrual"
+	"VladBag2022/gophermart/internal/config"
 	"VladBag2022/gophermart/internal/luhn"
+	"VladBag2022/gophermart/internal/metrics"
+	"VladBag2022/gophermart/internal/storage"
+	"VladBag2022/gophermart/internal/webhooks"
 )
 
 type UserAuthRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	// ReferralCode is optional and only read on registration.
+	ReferralCode string `json:"referral_code,omitempty"`
 }
 
 type WithdrawRequest struct {
@@ -24,6 +38,12 @@ type WithdrawRequest struct {
 	Sum   float64 `json:"sum"`
 }
 
+type AccrualWebhookRequest struct {
+	Order   string  `json:"order"`
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual"`
+}
+
 type AuthClaims struct {
 	Login string `json:"login"`
 	jwt.StandardClaims
@@ -34,12 +54,12 @@ func getAuthJWT(s Server, login string) (token string, err error) {
 		login,
 		jwt.StandardClaims{
 			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: time.Now().Unix() + int64(time.Hour/time.Second),
+			ExpiresAt: time.Now().Add(s.config.Auth.TokenTTL).Unix(),
 		},
 	}
 
 	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString([]byte(s.config.JWTKey))
+	return t.SignedString([]byte(s.config.Auth.JWTKey))
 }
 
 func getAuthHeader(s Server, login string) (header string, err error) {
@@ -94,7 +114,14 @@ func registerHandler(s Server) http.HandlerFunc {
 			return
 		}
 
-		err = s.repository.Register(r.Context(), request.Login, request.Password)
+		// The address is the peer's unless it is a trusted proxy, see RealIP, so
+		// forwarding headers cannot dodge the same-address referral check.
+		err = s.repository.Register(r.Context(), request.Login, request.Password,
+			strings.TrimSpace(request.ReferralCode), clientAddress(r), s.config.Referrals)
+		if errors.Is(err, storage.ErrReferralCodeNotFound) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -162,6 +189,81 @@ func loginHandler(s Server) http.HandlerFunc {
 	}
 }
 
+// UploadOrderRequest is the JSON form of an order upload. Plain text uploads
+// take the merchant from the query.
+type UploadOrderRequest struct {
+	Number   string `json:"number"`
+	Merchant string `json:"merchant,omitempty"`
+}
+
+// defaultMerchant is the built-in merchant of orders uploaded without one.
+var defaultMerchant = storage.MerchantInfo{
+	Code:       storage.DefaultMerchant,
+	Name:       "Default",
+	CheckDigit: storage.CheckDigitLuhn,
+}
+
+// merchantOf returns the merchant with code, the default one when code is empty.
+func merchantOf(ctx context.Context, s Server, code string) (storage.MerchantInfo, error) {
+	if len(code) == 0 || code == storage.DefaultMerchant {
+		return defaultMerchant, nil
+	}
+	return s.repository.Merchant(ctx, code)
+}
+
+// numberPattern compiles the number pattern of a merchant to match whole
+// numbers only, it is nil when the merchant has none.
+func numberPattern(merchant storage.MerchantInfo) (*regexp.Regexp, error) {
+	if len(merchant.NumberPattern) == 0 {
+		return nil, nil
+	}
+	// On its own first, so that a pattern cannot close the anchoring group.
+	if _, err := regexp.Compile(merchant.NumberPattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + merchant.NumberPattern + ")$")
+}
+
+// validateOrderNumber checks an order number against the rules of its merchant,
+// pattern is the compiled number pattern of the merchant.
+// Order numbers are strings of digits, of any length and with leading zeros.
+func validateOrderNumber(merchant storage.MerchantInfo, pattern *regexp.Regexp, number string) error {
+	if err := luhn.ValidateDigits(number); err != nil {
+		return err
+	}
+	if pattern != nil && !pattern.MatchString(number) {
+		return fmt.Errorf("number does not match %q", merchant.NumberPattern)
+	}
+	scheme, ok := luhn.Lookup(merchant.CheckDigit)
+	if !ok {
+		return fmt.Errorf("unknown check digit scheme %q", merchant.CheckDigit)
+	}
+	return scheme.Validate(number)
+}
+
+// adminOrderID resolves an order number of merchant, the default one when empty,
+// answering the request itself when it cannot.
+func adminOrderID(s Server, w http.ResponseWriter, r *http.Request, merchant, number string) (id int64, ok bool) {
+	if err := luhn.ValidateDigits(number); err != nil {
+		http.Error(w, "Bad order number: "+err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	if len(merchant) == 0 {
+		merchant = storage.DefaultMerchant
+	}
+
+	id, err := s.repository.OrderID(r.Context(), merchant, number)
+	if errors.Is(err, storage.ErrOrderNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return id, true
+}
+
 func uploadHandler(s Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(r.Body)
@@ -170,23 +272,48 @@ func uploadHandler(s Server) http.HandlerFunc {
 			return
 		}
 
-		if r.Header.Get("Content-Type") != "text/plain" {
+		merchantCode := r.URL.Query().Get("merchant")
+		var number string
+		switch r.Header.Get("Content-Type") {
+		case "text/plain":
+			number = string(body)
+		case contentTypeJSON:
+			var request UploadOrderRequest
+			if err = json.Unmarshal(body, &request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			number = request.Number
+			if len(request.Merchant) > 0 {
+				merchantCode = request.Merchant
+			}
+		default:
 			http.Error(w, "Bad content type", http.StatusBadRequest)
 			return
 		}
 
-		order, err := strconv.ParseInt(string(body), 10, 64)
+		merchant, err := merchantOf(r.Context(), s, merchantCode)
+		if errors.Is(err, storage.ErrMerchantNotFound) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pattern, err := numberPattern(merchant)
 		if err != nil {
-			http.Error(w, "Bad order number", http.StatusUnprocessableEntity)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if !luhn.Valid(order) {
-			http.Error(w, "Bad order number", http.StatusUnprocessableEntity)
+		if err = validateOrderNumber(merchant, pattern, number); err != nil {
+			http.Error(w, "Bad order number: "+err.Error(), http.StatusUnprocessableEntity)
 			return
 		}
 
-		owner, err := s.repository.OrderOwner(r.Context(), order)
+		owner, err := s.repository.OrderOwner(r.Context(), merchant.Code, number)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -202,7 +329,7 @@ func uploadHandler(s Server) http.HandlerFunc {
 			return
 		}
 
-		err = s.repository.UploadOrder(r.Context(), jwtOwner, order)
+		err = s.repository.UploadOrder(r.Context(), jwtOwner, merchant.Code, number)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -212,6 +339,109 @@ func uploadHandler(s Server) http.HandlerFunc {
 	}
 }
 
+// orderLines reads one order number per line, skipping blank lines.
+func orderLines(body []byte) (numbers []string) {
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers
+}
+
+func uploadBatchHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// A JSON array of numbers or newline-delimited text.
+		var numbers []string
+		switch r.Header.Get("Content-Type") {
+		case "text/plain":
+			numbers = orderLines(body)
+		case contentTypeJSON:
+			if err = json.Unmarshal(body, &numbers); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+		if len(numbers) == 0 {
+			http.Error(w, "No order numbers", http.StatusBadRequest)
+			return
+		}
+		if len(numbers) > s.config.Server.MaxBatchOrders {
+			http.Error(w, fmt.Sprintf("At most %d order numbers per batch", s.config.Server.MaxBatchOrders),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		merchant, err := merchantOf(r.Context(), s, r.URL.Query().Get("merchant"))
+		if errors.Is(err, storage.ErrMerchantNotFound) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pattern, err := numberPattern(merchant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Invalid numbers are reported as such, the rest go to the repository
+		// together, positions maps them back to the report.
+		results := make([]storage.OrderUploadResult, len(numbers))
+		var (
+			valid     []string
+			positions []int
+		)
+		for i, number := range numbers {
+			if vErr := validateOrderNumber(merchant, pattern, number); vErr != nil {
+				results[i] = storage.OrderUploadResult{Number: number, Status: storage.UploadInvalid, Reason: vErr.Error()}
+				continue
+			}
+			valid = append(valid, number)
+			positions = append(positions, i)
+		}
+
+		if len(valid) > 0 {
+			jwtOwner, _ := r.Context().Value(contextJWTLogin).(string)
+
+			uploaded, uErr := s.repository.UploadOrders(r.Context(), jwtOwner, merchant.Code, valid)
+			if uErr != nil {
+				http.Error(w, uErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i, result := range uploaded {
+				results[positions[i]] = result
+			}
+		}
+
+		response, err := json.Marshal(&results)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
 func listHandler(s Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		jwtOwner, _ := r.Context().Value(contextJWTLogin).(string)
@@ -243,6 +473,99 @@ func listHandler(s Server) http.HandlerFunc {
 	}
 }
 
+// orderEventsHandler streams status changes of the orders of a user and
+// their balance after each change. Events missed while reconnecting are not
+// replayed: a client coming back with Last-Event-ID gets a resync event with
+// the current balance and should list its orders again.
+func orderEventsHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jwtOwner, _ := r.Context().Value(contextJWTLogin).(string)
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := s.events.Subscribe(jwtOwner)
+		defer unsubscribe()
+
+		// An HTTP/1 stream outlives the write timeout once the deadline of its
+		// connection is lifted. HTTP/2 streams share their connection, so they
+		// end before the timeout instead and clients reconnect.
+		var deadline <-chan time.Time
+		conn, _ := r.Context().Value(contextConn).(net.Conn)
+		if r.ProtoMajor == 1 && conn != nil {
+			if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if timeout := s.config.Server.WriteTimeout; timeout > 0 {
+			timer := time.NewTimer(timeout - timeout/10)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		heartbeat := time.NewTicker(s.config.Events.Heartbeat)
+		defer heartbeat.Stop()
+
+		w.Header().Set("Content-Type", contentTypeEventStream)
+		w.Header().Set("Cache-Control", "no-cache")
+		// Compressing middleware buffers output, an encoded response is passed through.
+		w.Header().Set("Content-Encoding", "identity")
+		w.WriteHeader(http.StatusOK)
+
+		// Events are not replayed, a reconnecting client is told to resync
+		// instead, starting from the balance.
+		var id int64
+		send := func(event string, data interface{}) error {
+			response, mErr := json.Marshal(data)
+			if mErr != nil {
+				log.Error(mErr)
+				return nil
+			}
+			id++
+			_, wErr := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, response)
+			return wErr
+		}
+		balance := func() (storage.BalanceInfo, error) {
+			return s.repository.Balance(storage.WithPrimary(r.Context()), jwtOwner)
+		}
+
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", time.Second.Milliseconds())
+		if err == nil && len(r.Header.Get(lastEventIDHeader)) > 0 {
+			current, bErr := balance()
+			if bErr != nil {
+				log.Errorf("Failed to get balance of %s: %s", jwtOwner, bErr)
+				return
+			}
+			err = send(eventResync, current)
+		}
+		for err == nil {
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-deadline:
+				return
+			case <-heartbeat.C:
+				_, err = io.WriteString(w, ": heartbeat\n\n")
+			case event := <-events:
+				if event.Type != storage.EventBalance {
+					err = send(event.Type, event)
+					continue
+				}
+				current, bErr := balance()
+				if bErr != nil {
+					log.Errorf("Failed to get balance of %s: %s", jwtOwner, bErr)
+					continue
+				}
+				err = send(event.Type, current)
+			}
+		}
+	}
+}
+
 func balanceHandler(s Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		jwtOwner, _ := r.Context().Value(contextJWTLogin).(string)
@@ -252,6 +575,13 @@ func balanceHandler(s Server) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if ttl, notice := s.config.Balance.PointsTTL, s.config.Balance.ExpiryNotice; ttl > 0 && notice > 0 {
+			balance.ExpiringSoon, err = s.repository.ExpiringPoints(r.Context(), jwtOwner, ttl, notice)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
 		response, err := json.Marshal(&balance)
 		if err != nil {
@@ -293,20 +623,23 @@ func withdrawHandler(s Server) http.HandlerFunc {
 			return
 		}
 
-		order, err := strconv.ParseInt(request.Order, 10, 64)
-		if err != nil {
-			http.Error(w, "Bad order number", http.StatusUnprocessableEntity)
+		if request.Sum <= 0 {
+			http.Error(w, "Sum must be positive", http.StatusBadRequest)
 			return
 		}
 
-		if !luhn.Valid(order) {
-			http.Error(w, "Bad order number", http.StatusUnprocessableEntity)
+		if err = luhn.Luhn.Validate(request.Order); err != nil {
+			http.Error(w, "Bad order number: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if !s.knownWithdrawalOrder(request.Order) {
+			http.Error(w, "Bad order number: no merchant format matches", http.StatusUnprocessableEntity)
 			return
 		}
 
 		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
 
-		balance, err := s.repository.Balance(r.Context(), jwtLogin)
+		balance, err := s.repository.Balance(storage.WithPrimary(r.Context()), jwtLogin)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -317,7 +650,15 @@ func withdrawHandler(s Server) http.HandlerFunc {
 			return
 		}
 
-		err = s.repository.Withdraw(r.Context(), jwtLogin, order, request.Sum)
+		err = s.repository.Withdraw(r.Context(), jwtLogin, request.Order, request.Sum)
+		if errors.Is(err, storage.ErrWithdrawalExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ErrInsufficientFunds) {
+			http.Error(w, "No money - no honey", http.StatusPaymentRequired)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -357,3 +698,1294 @@ func withdrawalsHandler(s Server) http.HandlerFunc {
 		}
 	}
 }
+
+func pingHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.repository.Ping(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func accrualWebhookHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = accrual.Verify(
+			[]byte(s.config.Accrual.WebhookSecret),
+			r.Header.Get(accrual.SignatureHeader),
+			r.Header.Get(accrual.TimestampHeader),
+			body,
+			s.config.Accrual.WebhookReplayWindow,
+			time.Now(),
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var request AccrualWebhookRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = luhn.ValidateDigits(request.Order); err != nil {
+			http.Error(w, "Bad order number: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !accrual.IsKnownStatus(request.Status) {
+			http.Error(w, "Unknown status", http.StatusBadRequest)
+			return
+		}
+
+		// Accrual systems of merchants push to their own path.
+		merchant := chi.URLParam(r, "merchant")
+		if len(merchant) == 0 {
+			merchant = storage.DefaultMerchant
+		}
+		order, err := s.repository.OrderID(r.Context(), merchant, request.Order)
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			// Updates of unknown orders are dropped, as the accrual system would only repeat them.
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = s.repository.UpdateOrder(r.Context(), order, request.Status, request.Accrual)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type ResolveDeadLetterRequest struct {
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual"`
+}
+
+func deadLettersHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orders, err := s.repository.DeadLetters(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(orders) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		response, err := json.Marshal(&orders)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func retryDeadLetterHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		order, ok := adminOrderID(s, w, r, r.URL.Query().Get("merchant"), chi.URLParam(r, "number"))
+		if !ok {
+			return
+		}
+
+		err := s.repository.RetryDeadLetter(r.Context(), order)
+		if errors.Is(err, storage.ErrNotDeadLettered) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		metrics.DeadLettersRetried.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func resolveDeadLetterHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		var request ResolveDeadLetterRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !accrual.IsFinal(request.Status) {
+			http.Error(w, "Status must be final", http.StatusBadRequest)
+			return
+		}
+
+		if request.Accrual < 0 {
+			http.Error(w, "Accrual must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		order, ok := adminOrderID(s, w, r, r.URL.Query().Get("merchant"), chi.URLParam(r, "number"))
+		if !ok {
+			return
+		}
+
+		err = s.repository.ResolveDeadLetter(r.Context(), order, request.Status, request.Accrual)
+		if errors.Is(err, storage.ErrNotDeadLettered) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		metrics.DeadLettersResolved.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type ReverseAccrualRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+func profileHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		profile, err := s.repository.Profile(r.Context(), jwtLogin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&profile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func referralsHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		referrals, err := s.repository.Referrals(r.Context(), jwtLogin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if referrals.Referees == nil {
+			referrals.Referees = []storage.ReferralInfo{}
+		}
+
+		response, err := json.Marshal(&referrals)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func balanceHistoryHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		entries, err := s.repository.BalanceHistory(r.Context(), jwtLogin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(entries) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		response, err := json.Marshal(&entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func reverseAccrualHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		var request ReverseAccrualRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Amount < 0 {
+			http.Error(w, "Amount must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		order, ok := adminOrderID(s, w, r, r.URL.Query().Get("merchant"), chi.URLParam(r, "number"))
+		if !ok {
+			return
+		}
+
+		adjustment, err := s.repository.ReverseAccrual(r.Context(), order, request.Amount, request.Reason,
+			s.config.Balance.ReversalPolicy == config.ReversalAllowDebt)
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrNotProcessed), errors.Is(err, storage.ErrReversalExceedsAccrual),
+			errors.Is(err, storage.ErrNothingToReverse):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&adjustment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+type HoldRequest struct {
+	Order string  `json:"order"`
+	Sum   float64 `json:"sum"`
+}
+
+func createHoldHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		var request HoldRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Sum <= 0 {
+			http.Error(w, "Sum must be positive", http.StatusBadRequest)
+			return
+		}
+
+		if err = luhn.Luhn.Validate(request.Order); err != nil {
+			http.Error(w, "Bad order number: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if !s.knownWithdrawalOrder(request.Order) {
+			http.Error(w, "Bad order number: no merchant format matches", http.StatusUnprocessableEntity)
+			return
+		}
+
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		hold, err := s.repository.CreateHold(r.Context(), jwtLogin, request.Order, request.Sum,
+			s.config.Balance.HoldTTL)
+		switch {
+		case errors.Is(err, storage.ErrInsufficientFunds):
+			http.Error(w, "No money - no honey", http.StatusPaymentRequired)
+			return
+		case errors.Is(err, storage.ErrWithdrawalExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeHold(w, hold)
+	}
+}
+
+func captureHoldHandler(s Server) http.HandlerFunc {
+	return settleHoldHandler(s, s.repository.CaptureHold)
+}
+
+func voidHoldHandler(s Server) http.HandlerFunc {
+	return settleHoldHandler(s, s.repository.VoidHold)
+}
+
+func settleHoldHandler(
+	s Server,
+	settle func(ctx context.Context, login string, id int64) (storage.HoldInfo, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad hold id", http.StatusBadRequest)
+			return
+		}
+
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		hold, err := settle(r.Context(), jwtLogin, id)
+		switch {
+		case errors.Is(err, storage.ErrHoldNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrHoldNotActive):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, storage.ErrHoldShortfall):
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeHold(w, hold)
+	}
+}
+
+func writeHold(w http.ResponseWriter, hold storage.HoldInfo) {
+	response, err := json.Marshal(&hold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(response)
+	if err != nil {
+		log.Trace("Log in prod")
+	}
+}
+
+type RefundRequest struct {
+	RefundID string  `json:"refund_id"`
+	Amount   float64 `json:"amount"`
+	Reason   string  `json:"reason"`
+}
+
+func refundHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		order := chi.URLParam(r, "order")
+		if err = luhn.ValidateDigits(order); err != nil {
+			http.Error(w, "Bad order number: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var request RefundRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(request.RefundID) == 0 {
+			http.Error(w, "Refund id is required", http.StatusBadRequest)
+			return
+		}
+
+		if request.Amount < 0 {
+			http.Error(w, "Amount must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		refund, err := s.repository.RefundWithdrawal(r.Context(), order, request.Amount, request.RefundID, request.Reason)
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrRefundExceedsWithdrawal), errors.Is(err, storage.ErrRefundConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&refund)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+type DryRunCampaignsRequest struct {
+	Order    string  `json:"order"`
+	Merchant string  `json:"merchant,omitempty"`
+	Accrual  float64 `json:"accrual"`
+}
+
+// validateCampaign checks the rules of a campaign and normalizes its window to UTC.
+func validateCampaign(s Server, campaign *storage.CampaignInfo) error {
+	if len(campaign.Name) == 0 {
+		return errors.New("campaign name is required")
+	}
+	startsAt, err := time.Parse(time.RFC3339, campaign.StartsAt)
+	if err != nil {
+		return errors.New("starts_at must be an RFC 3339 time")
+	}
+	campaign.StartsAt = startsAt.UTC().Format(time.RFC3339)
+	if len(campaign.EndsAt) > 0 {
+		endsAt, pErr := time.Parse(time.RFC3339, campaign.EndsAt)
+		if pErr != nil || !endsAt.After(startsAt) {
+			return errors.New("ends_at must be an RFC 3339 time after starts_at")
+		}
+		campaign.EndsAt = endsAt.UTC().Format(time.RFC3339)
+	}
+	if campaign.MinAccrual < 0 || campaign.Bonus < 0 || campaign.PerUserCap < 0 {
+		return errors.New("min_accrual, bonus and per_user_cap must not be negative")
+	}
+	if campaign.Multiplier != 0 && campaign.Multiplier < 1 {
+		return errors.New("multiplier must be at least 1")
+	}
+	if campaign.Bonus == 0 && campaign.Multiplier <= 1 {
+		return errors.New("campaign must grant a bonus or a multiplier above 1")
+	}
+	if len(campaign.Tier) > 0 {
+		for _, tier := range s.config.Loyalty.Tiers {
+			if tier.Name == campaign.Tier {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown tier %q", campaign.Tier)
+	}
+	return nil
+}
+
+// readCampaign decodes and validates a campaign from the request body, answering
+// the request itself when it is not valid.
+func readCampaign(s Server, w http.ResponseWriter, r *http.Request) (campaign storage.CampaignInfo, ok bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return campaign, false
+	}
+
+	if r.Header.Get("Content-Type") != contentTypeJSON {
+		http.Error(w, "Bad content type", http.StatusBadRequest)
+		return campaign, false
+	}
+
+	if err = json.Unmarshal(body, &campaign); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return campaign, false
+	}
+
+	if err = validateCampaign(s, &campaign); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return campaign, false
+	}
+	return campaign, true
+}
+
+func campaignsHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		campaigns, err := s.repository.Campaigns(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(campaigns) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		response, err := json.Marshal(&campaigns)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func createCampaignHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		campaign, ok := readCampaign(s, w, r)
+		if !ok {
+			return
+		}
+
+		created, err := s.repository.CreateCampaign(r.Context(), campaign)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&created)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusCreated)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func campaignHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad campaign id", http.StatusBadRequest)
+			return
+		}
+
+		campaign, err := s.repository.Campaign(r.Context(), id)
+		if errors.Is(err, storage.ErrCampaignNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&campaign)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func updateCampaignHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad campaign id", http.StatusBadRequest)
+			return
+		}
+
+		campaign, ok := readCampaign(s, w, r)
+		if !ok {
+			return
+		}
+		campaign.ID = id
+
+		updated, err := s.repository.UpdateCampaign(r.Context(), campaign)
+		if errors.Is(err, storage.ErrCampaignNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&updated)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func deleteCampaignHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad campaign id", http.StatusBadRequest)
+			return
+		}
+
+		err = s.repository.DeleteCampaign(r.Context(), id)
+		if errors.Is(err, storage.ErrCampaignNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func dryRunCampaignsHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		var request DryRunCampaignsRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Accrual < 0 {
+			http.Error(w, "Accrual must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		order, ok := adminOrderID(s, w, r, request.Merchant, request.Order)
+		if !ok {
+			return
+		}
+
+		evaluations, err := s.repository.DryRunCampaigns(r.Context(), order, request.Accrual)
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(evaluations) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		response, err := json.Marshal(&evaluations)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+// validateMerchant checks the rules and the accrual system of a merchant.
+func validateMerchant(merchant *storage.MerchantInfo) error {
+	if len(merchant.Code) == 0 {
+		return errors.New("merchant code is required")
+	}
+	if merchant.Code == storage.DefaultMerchant {
+		return errors.New("the default merchant is built in")
+	}
+	if len(merchant.Name) == 0 {
+		merchant.Name = merchant.Code
+	}
+	if _, err := numberPattern(*merchant); err != nil {
+		return fmt.Errorf("bad number_pattern: %w", err)
+	}
+	if len(merchant.CheckDigit) == 0 {
+		merchant.CheckDigit = storage.CheckDigitLuhn
+	}
+	if _, ok := luhn.Lookup(merchant.CheckDigit); !ok {
+		return fmt.Errorf("unknown check_digit %q", merchant.CheckDigit)
+	}
+	if len(merchant.AccrualAddress) > 0 {
+		address, err := url.Parse(merchant.AccrualAddress)
+		if err != nil || (address.Scheme != "http" && address.Scheme != "https") || len(address.Host) == 0 {
+			return errors.New("accrual_address must be an http(s) URL")
+		}
+	}
+	return nil
+}
+
+// readMerchant decodes and validates a merchant from the request body, answering
+// the request itself when it is not valid.
+func readMerchant(w http.ResponseWriter, r *http.Request) (merchant storage.MerchantInfo, ok bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return merchant, false
+	}
+
+	if r.Header.Get("Content-Type") != contentTypeJSON {
+		http.Error(w, "Bad content type", http.StatusBadRequest)
+		return merchant, false
+	}
+
+	if err = json.Unmarshal(body, &merchant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return merchant, false
+	}
+
+	if code := chi.URLParam(r, "code"); len(code) > 0 {
+		merchant.Code = code
+	}
+	if err = validateMerchant(&merchant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return merchant, false
+	}
+	return merchant, true
+}
+
+func merchantsHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merchants, err := s.repository.Merchants(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&merchants)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func createMerchantHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merchant, ok := readMerchant(w, r)
+		if !ok {
+			return
+		}
+
+		created, err := s.repository.CreateMerchant(r.Context(), merchant)
+		if errors.Is(err, storage.ErrMerchantExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&created)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusCreated)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func merchantHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merchant, err := s.repository.Merchant(r.Context(), chi.URLParam(r, "code"))
+		if errors.Is(err, storage.ErrMerchantNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&merchant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func updateMerchantHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merchant, ok := readMerchant(w, r)
+		if !ok {
+			return
+		}
+
+		updated, err := s.repository.UpdateMerchant(r.Context(), merchant)
+		if errors.Is(err, storage.ErrMerchantNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&updated)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+type TransferRequest struct {
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+func transferHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		var request TransferRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(request.To) == 0 {
+			http.Error(w, "Recipient is required", http.StatusBadRequest)
+			return
+		}
+
+		if request.Amount <= 0 {
+			http.Error(w, "Amount must be positive", http.StatusBadRequest)
+			return
+		}
+
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		transfer, err := s.repository.Transfer(r.Context(), jwtLogin, request.To, request.Amount, s.config.Transfers)
+		if !transferError(w, err) {
+			return
+		}
+
+		// A pending transfer is accepted but waits for the sender to confirm it.
+		statusCode := http.StatusOK
+		if transfer.Status == storage.TransferPending {
+			statusCode = http.StatusAccepted
+		}
+		writeTransfer(w, statusCode, transfer)
+	}
+}
+
+func confirmTransferHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad transfer id", http.StatusBadRequest)
+			return
+		}
+
+		jwtLogin, _ := r.Context().Value(contextJWTLogin).(string)
+
+		transfer, err := s.repository.ConfirmTransfer(r.Context(), jwtLogin, id, s.config.Transfers)
+		if !transferError(w, err) {
+			return
+		}
+
+		writeTransfer(w, http.StatusOK, transfer)
+	}
+}
+
+// transferError answers the request for a failed transfer and reports whether err was nil.
+func transferError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, storage.ErrSelfTransfer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrInsufficientFunds):
+		http.Error(w, "No money - no honey", http.StatusPaymentRequired)
+	case errors.Is(err, storage.ErrAccountTooNew):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, storage.ErrRecipientNotFound), errors.Is(err, storage.ErrTransferNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrTransferNotPending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrTransferLimitExceeded):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+func writeTransfer(w http.ResponseWriter, statusCode int, transfer storage.TransferInfo) {
+	response, err := json.Marshal(&transfer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(statusCode)
+
+	_, err = w.Write(response)
+	if err != nil {
+		log.Trace("Log in prod")
+	}
+}
+
+// validateWebhook checks that webhook has an HTTPS URL of a public host and
+// known event types, dropping repeated ones.
+func (s Server) validateWebhook(ctx context.Context, webhook *storage.WebhookInfo) error {
+	target, err := url.Parse(webhook.URL)
+	if err != nil || target.Scheme != "https" || len(target.Hostname()) == 0 {
+		return errors.New("url must be an absolute HTTPS URL")
+	}
+	if err = webhooks.CheckHost(ctx, s.resolver, target.Hostname()); err != nil {
+		return err
+	}
+	if len(webhook.Events) == 0 {
+		return errors.New("events must not be empty")
+	}
+	seen := make(map[string]bool)
+	events := webhook.Events[:0]
+	for _, event := range webhook.Events {
+		if event != storage.EventOrder && event != storage.EventBalance {
+			return fmt.Errorf("unknown event type %q", event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	webhook.Events = events
+	return nil
+}
+
+// grantWebhook limits webhook to what the API client may see: the orders of
+// its merchants, or everything with the admin scope. Requested merchants
+// narrow it down.
+func (s Server) grantWebhook(name string, webhook *storage.WebhookInfo) error {
+	var client config.APIClient
+	for _, c := range s.config.Auth.APIClients {
+		if c.Name == name {
+			client = c
+			break
+		}
+	}
+	if !client.HasScope(scopeAdmin) {
+		granted := make(map[string]bool)
+		for _, merchant := range client.Merchants {
+			granted[merchant] = true
+		}
+		if len(webhook.Merchants) == 0 {
+			webhook.Merchants = client.Merchants
+		}
+		if len(webhook.Merchants) == 0 {
+			return errors.New("the client is granted no merchants")
+		}
+		for _, merchant := range webhook.Merchants {
+			if !granted[merchant] {
+				return fmt.Errorf("the client is not granted merchant %q", merchant)
+			}
+		}
+	}
+	if len(webhook.Merchants) == 0 {
+		return nil
+	}
+	for _, event := range webhook.Events {
+		if event == storage.EventBalance {
+			return errors.New("balance events need a subscription to every merchant")
+		}
+	}
+	return nil
+}
+
+func webhooksHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, _ := r.Context().Value(contextAPIClient).(string)
+
+		subscriptions, err := s.repository.Webhooks(r.Context(), client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(subscriptions) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		response, err := json.Marshal(&subscriptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func createWebhookHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("Content-Type") != contentTypeJSON {
+			http.Error(w, "Bad content type", http.StatusBadRequest)
+			return
+		}
+
+		var webhook storage.WebhookInfo
+		if err = json.Unmarshal(body, &webhook); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = s.validateWebhook(r.Context(), &webhook); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The secret is always generated.
+		webhook.Secret = ""
+		webhook.Client, _ = r.Context().Value(contextAPIClient).(string)
+		if err = s.grantWebhook(webhook.Client, &webhook); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		created, err := s.repository.CreateWebhook(r.Context(), webhook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(&created)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusCreated)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
+
+func deleteWebhookHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad webhook id", http.StatusBadRequest)
+			return
+		}
+		client, _ := r.Context().Value(contextAPIClient).(string)
+
+		err = s.repository.DeleteWebhook(r.Context(), client, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func webhookDeliveriesHandler(s Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad webhook id", http.StatusBadRequest)
+			return
+		}
+		client, _ := r.Context().Value(contextAPIClient).(string)
+
+		deliveries, err := s.repository.WebhookDeliveries(r.Context(), client, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(deliveries) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		response, err := json.Marshal(&deliveries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+
+		_, err = w.Write(response)
+		if err != nil {
+			log.Trace("Log in prod")
+		}
+	}
+}
@@ -1,18 +1,28 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"VladBag2022/gophermart/internal/accrual"
+	"VladBag2022/gophermart/internal/config"
 	"VladBag2022/gophermart/internal/storage"
 	"VladBag2022/gophermart/mocks"
 )
@@ -53,17 +63,81 @@ func makeTestRequest(
 func getTestEntities(
 	addExpectationsFunc func(repository *mocks.Repository),
 ) (*Server, *httptest.Server) {
-	config, err := NewConfig()
-	if err != nil {
-		return nil, nil
-	}
 	repository := new(mocks.Repository)
 	addExpectationsFunc(repository)
-	server := NewServer(repository, config)
+	server := NewServer(repository, config.Default())
 	router := rootRouter(server)
 	return &server, httptest.NewServer(router)
 }
 
+// mockOrderIDs gives orders of the default merchant their numbers as ids.
+func mockOrderIDs(repository *mocks.Repository) {
+	repository.On("OrderID", mock.Anything, storage.DefaultMerchant, mock.Anything).Return(
+		func(_ context.Context, _, number string) int64 {
+			id, _ := strconv.ParseInt(number, 10, 64)
+			return id
+		}, nil)
+}
+
+func TestServer_realIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{
+			name:      "positive test - client behind trusted proxy",
+			peer:      "10.0.0.5:41000",
+			forwarded: "198.51.100.7, 10.0.0.9",
+			want:      "198.51.100.7",
+		},
+		{
+			name:      "positive test - prepended entries are ignored",
+			peer:      "10.0.0.5:41000",
+			forwarded: "127.0.0.1, 198.51.100.7",
+			want:      "198.51.100.7",
+		},
+		{
+			name:   "positive test - real ip header",
+			peer:   "10.0.0.5:41000",
+			realIP: "198.51.100.7",
+			want:   "198.51.100.7",
+		},
+		{
+			name:      "negative test - untrusted peer",
+			peer:      "203.0.113.4:41000",
+			forwarded: "198.51.100.7",
+			realIP:    "198.51.100.7",
+			want:      "203.0.113.4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Server.TrustedProxies = []string{"10.0.0.0/8"}
+			s := NewServer(new(mocks.Repository), cfg)
+
+			var got string
+			handler := RealIP(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientAddress(r)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			req.RemoteAddr = tt.peer
+			if len(tt.forwarded) > 0 {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if len(tt.realIP) > 0 {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func TestServer_register(t *testing.T) {
 	type want struct {
 		statusCode int
@@ -111,6 +185,24 @@ func TestServer_register(t *testing.T) {
 				statusCode: 400,
 			},
 		},
+		{
+			name:        "positive test - referral code",
+			logins:      []string{"a", "b"},
+			contentType: contentTypeJSON,
+			content:     "{\"login\": \"c\",\"password\": \"123\",\"referral_code\": \"5f3a9c01d2e4\"}",
+			want: want{
+				statusCode: 200,
+			},
+		},
+		{
+			name:        "negative test - unknown referral code",
+			logins:      []string{"a", "b"},
+			contentType: contentTypeJSON,
+			content:     "{\"login\": \"c\",\"password\": \"123\",\"referral_code\": \"unknown\"}",
+			want: want{
+				statusCode: 400,
+			},
+		},
 		{
 			name:        "negative test - empty login and password",
 			logins:      []string{},
@@ -166,8 +258,10 @@ func TestServer_register(t *testing.T) {
 				}
 				repository.On("IsLoginAvailable",
 					mock.Anything, mock.Anything).Return(true, nil)
-				repository.On("Register",
-					mock.Anything, mock.Anything, mock.Anything).Return(nil)
+				repository.On("Register", mock.Anything, mock.Anything, mock.Anything, "unknown",
+					mock.Anything, mock.Anything).Return(storage.ErrReferralCodeNotFound)
+				repository.On("Register", mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+					mock.Anything, mock.Anything).Return(nil)
 			})
 			require.NotNil(t, ts)
 			defer ts.Close()
@@ -182,6 +276,27 @@ func TestServer_register(t *testing.T) {
 	}
 }
 
+func TestServer_registerIgnoresSpoofedAddress(t *testing.T) {
+	_, ts := getTestEntities(func(repository *mocks.Repository) {
+		repository.On("IsLoginAvailable", mock.Anything, "c").Return(true, nil)
+		repository.On("Register", mock.Anything, "c", "123", "FRIEND", "127.0.0.1", mock.Anything).Return(nil)
+	})
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/user/register",
+		strings.NewReader("{\"login\": \"c\",\"password\": \"123\",\"referral_code\": \"FRIEND\"}"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentTypeJSON)
+	// The test client is not a trusted proxy, so the referral check sees its socket address.
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	req.Header.Set("X-Real-IP", "198.51.100.7")
+
+	response, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
 func TestServer_login(t *testing.T) {
 	type want struct {
 		statusCode int
@@ -294,17 +409,18 @@ func TestServer_upload(t *testing.T) {
 
 	tests := []struct {
 		name        string
-		userOrders  map[string][]int64
+		userOrders  map[string][]string
 		user        string
+		query       string
 		contentType string
 		content     string
 		want        want
 	}{
 		{
 			name: "positive test - order already uploaded",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "a",
 			contentType: "text/plain",
@@ -315,9 +431,9 @@ func TestServer_upload(t *testing.T) {
 		},
 		{
 			name: "positive test - new order",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "a",
 			contentType: "text/plain",
@@ -326,11 +442,35 @@ func TestServer_upload(t *testing.T) {
 				statusCode: 202,
 			},
 		},
+		{
+			name: "positive test - order number longer than int64",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+			},
+			user:        "a",
+			contentType: "text/plain",
+			content:     "1234567890123456789012340",
+			want: want{
+				statusCode: 202,
+			},
+		},
+		{
+			name: "positive test - leading zeros are part of the number",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "12345678903"},
+			},
+			user:        "a",
+			contentType: "text/plain",
+			content:     "0012345678903",
+			want: want{
+				statusCode: 202,
+			},
+		},
 		{
 			name: "negative test - wrong content type",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "a",
 			contentType: contentTypeJSON,
@@ -341,9 +481,9 @@ func TestServer_upload(t *testing.T) {
 		},
 		{
 			name: "negative test - wrong content",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "a",
 			contentType: "text/plain",
@@ -354,9 +494,9 @@ func TestServer_upload(t *testing.T) {
 		},
 		{
 			name: "negative test - unauthorized",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "",
 			contentType: "text/plain",
@@ -367,9 +507,9 @@ func TestServer_upload(t *testing.T) {
 		},
 		{
 			name: "negative test - order already uploaded by another user",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "b",
 			contentType: "text/plain",
@@ -380,17 +520,109 @@ func TestServer_upload(t *testing.T) {
 		},
 		{
 			name: "negative test - bad Luhn check",
-			userOrders: map[string][]int64{
-				"a": {123456789031, 566165445},
-				"b": {9579343, 58568287791534},
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
+			},
+			user:        "b",
+			contentType: "text/plain",
+			content:     "123456789035",
+			want: want{
+				statusCode: 422,
+			},
+		},
+		{
+			name: "positive test - merchant without check digit",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
 			},
 			user:        "b",
+			query:       "?merchant=corner-shop",
 			contentType: "text/plain",
 			content:     "123456789035",
+			want: want{
+				statusCode: 202,
+			},
+		},
+		{
+			name: "positive test - merchant in JSON",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+				"b": {"9579343", "58568287791534"},
+			},
+			user:        "a",
+			contentType: contentTypeJSON,
+			content:     `{"number": "123456789031", "merchant": "corner-shop"}`,
+			want: want{
+				statusCode: 202,
+			},
+		},
+		{
+			name: "negative test - merchant number pattern",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+			},
+			user:        "a",
+			query:       "?merchant=corner-shop",
+			contentType: "text/plain",
+			content:     "12345",
+			want: want{
+				statusCode: 422,
+			},
+		},
+		{
+			name: "negative test - merchant number pattern matches part of the number",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+			},
+			user:        "a",
+			query:       "?merchant=corner-shop",
+			contentType: "text/plain",
+			content:     "1234567890315",
+			want: want{
+				statusCode: 422,
+			},
+		},
+		{
+			name: "positive test - merchant with Damm check digit",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+			},
+			user:        "a",
+			query:       "?merchant=kiosk",
+			contentType: "text/plain",
+			content:     "5724",
+			want: want{
+				statusCode: 202,
+			},
+		},
+		{
+			name: "negative test - merchant with Damm check digit",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+			},
+			user:        "a",
+			query:       "?merchant=kiosk",
+			contentType: "text/plain",
+			content:     "7524",
 			want: want{
 				statusCode: 422,
 			},
 		},
+		{
+			name: "negative test - unknown merchant",
+			userOrders: map[string][]string{
+				"a": {"123456789031", "566165445"},
+			},
+			user:        "a",
+			query:       "?merchant=nowhere",
+			contentType: "text/plain",
+			content:     "123456789031",
+			want: want{
+				statusCode: 400,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -399,8 +631,8 @@ func TestServer_upload(t *testing.T) {
 			s, ts := getTestEntities(func(repository *mocks.Repository) {
 				for tUser, tOrders := range tt.userOrders {
 					for _, tOrder := range tOrders {
-						repository.On("OrderOwner", mock.Anything, tOrder).Return(tUser, nil)
-						if strconv.FormatInt(tOrder, 10) == tt.content {
+						repository.On("OrderOwner", mock.Anything, storage.DefaultMerchant, tOrder).Return(tUser, nil)
+						if tOrder == tt.content {
 							orderUploaded = true
 						}
 					}
@@ -409,12 +641,22 @@ func TestServer_upload(t *testing.T) {
 					}
 				}
 				if !orderUploaded {
-					order, err := strconv.ParseInt(tt.content, 10, 64)
-					if err == nil {
-						repository.On("OrderOwner", mock.Anything, order).Return("", nil)
-					}
+					repository.On("OrderOwner", mock.Anything, storage.DefaultMerchant, tt.content).Return("", nil)
 				}
-				repository.On("UploadOrder", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+				repository.On("Merchant", mock.Anything, "corner-shop").Return(storage.MerchantInfo{
+					Code:          "corner-shop",
+					NumberPattern: "[0-9]{12}",
+					CheckDigit:    storage.CheckDigitNone,
+				}, nil)
+				repository.On("Merchant", mock.Anything, "kiosk").Return(storage.MerchantInfo{
+					Code:       "kiosk",
+					CheckDigit: storage.CheckDigitDamm,
+				}, nil)
+				repository.On("Merchant", mock.Anything, "nowhere").Return(storage.MerchantInfo{},
+					storage.ErrMerchantNotFound)
+				repository.On("OrderOwner", mock.Anything, "corner-shop", mock.Anything).Return("", nil)
+				repository.On("OrderOwner", mock.Anything, "kiosk", mock.Anything).Return("", nil)
+				repository.On("UploadOrder", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 			})
 			require.NotNil(t, ts)
 			defer ts.Close()
@@ -426,7 +668,7 @@ func TestServer_upload(t *testing.T) {
 				h = nh
 			}
 
-			response, _ := makeTestRequest(t, ts, http.MethodPost, "/api/user/orders", tt.contentType,
+			response, _ := makeTestRequest(t, ts, http.MethodPost, "/api/user/orders"+tt.query, tt.contentType,
 				h, strings.NewReader(tt.content))
 			err := response.Body.Close()
 			require.NoError(t, err)
@@ -436,6 +678,142 @@ func TestServer_upload(t *testing.T) {
 	}
 }
 
+func TestServer_uploadBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		content     string
+		gzip        bool
+		statusCode  int
+		statuses    []string
+	}{
+		{
+			name:        "positive test - JSON array",
+			contentType: contentTypeJSON,
+			content:     `["12345678903", "79927398713", "4561261212345467", "12345678904", "12345678903"]`,
+			statusCode:  200,
+			statuses: []string{storage.UploadAccepted, storage.UploadAlreadyUploaded, storage.UploadConflict,
+				storage.UploadInvalid, storage.UploadAlreadyUploaded},
+		},
+		{
+			name:        "positive test - gzipped lines",
+			contentType: "text/plain",
+			content:     "12345678903\r\n\n79927398713\n1234 5678\n",
+			gzip:        true,
+			statusCode:  200,
+			statuses:    []string{storage.UploadAccepted, storage.UploadAlreadyUploaded, storage.UploadInvalid},
+		},
+		{
+			name:        "positive test - nothing valid",
+			contentType: "text/plain",
+			content:     "12345678904",
+			statusCode:  200,
+			statuses:    []string{storage.UploadInvalid},
+		},
+		{
+			name:        "negative test - empty batch",
+			contentType: contentTypeJSON,
+			content:     "[]",
+			statusCode:  400,
+		},
+		{
+			name:        "negative test - too many numbers",
+			contentType: "text/plain",
+			content:     strings.Repeat("12345678903\n", 1001),
+			statusCode:  413,
+		},
+		{
+			name:        "negative test - wrong content type",
+			contentType: "application/xml",
+			content:     "<orders/>",
+			statusCode:  400,
+		},
+		{
+			name:        "negative test - unknown merchant",
+			query:       "?merchant=nowhere",
+			contentType: "text/plain",
+			content:     "12345678903",
+			statusCode:  400,
+		},
+		{
+			name:        "positive test - merchant number pattern",
+			query:       "?merchant=corner-shop",
+			contentType: "text/plain",
+			content:     "123456789035\n1234567890315\n12345",
+			statusCode:  200,
+			statuses:    []string{storage.UploadAccepted, storage.UploadInvalid, storage.UploadInvalid},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := getTestEntities(func(repository *mocks.Repository) {
+				owners := map[string]string{"79927398713": "a", "4561261212345467": "b"}
+				repository.On("UploadOrders", mock.Anything, "a", mock.Anything, mock.Anything).Return(
+					func(_ context.Context, login, _ string, numbers []string) []storage.OrderUploadResult {
+						var results []storage.OrderUploadResult
+						for _, number := range numbers {
+							status := storage.UploadAccepted
+							switch owners[number] {
+							case login:
+								status = storage.UploadAlreadyUploaded
+							case "":
+								owners[number] = login
+							default:
+								status = storage.UploadConflict
+							}
+							results = append(results, storage.OrderUploadResult{Number: number, Status: status})
+						}
+						return results
+					}, nil)
+				repository.On("Merchant", mock.Anything, "corner-shop").Return(storage.MerchantInfo{
+					Code:          "corner-shop",
+					NumberPattern: "[0-9]{12}",
+					CheckDigit:    storage.CheckDigitNone,
+				}, nil)
+				repository.On("Merchant", mock.Anything, "nowhere").Return(storage.MerchantInfo{},
+					storage.ErrMerchantNotFound)
+			})
+			defer ts.Close()
+
+			h, err := getAuthHeader(*s, "a")
+			require.NoError(t, err)
+
+			body := []byte(tt.content)
+			if tt.gzip {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				_, err = gz.Write(body)
+				require.NoError(t, err)
+				require.NoError(t, gz.Close())
+				body = buf.Bytes()
+			}
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/user/orders/batch"+tt.query, bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set(authorizationHeader, h)
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+			var results []storage.OrderUploadResult
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+			statuses := make([]string, len(results))
+			for i, result := range results {
+				statuses[i] = result.Status
+			}
+			assert.Equal(t, tt.statuses, statuses)
+		})
+	}
+}
+
 func TestServer_list(t *testing.T) {
 	type want struct {
 		statusCode  int
@@ -531,6 +909,111 @@ func TestServer_list(t *testing.T) {
 	}
 }
 
+func TestServer_orderEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventID string
+		liftable    bool
+		want        []string
+	}{
+		{
+			name:     "positive test - stream outlives the write timeout",
+			liftable: true,
+			want: []string{
+				"id: 1\nevent: order\n" +
+					`data: {"type":"order","login":"a","order":"12345678903","status":"PROCESSING"}` + "\n",
+				"id: 2\nevent: balance\n" + `data: {"current":729.98,"withdrawn":0,"held":0}` + "\n",
+			},
+		},
+		{
+			name:        "positive test - reconnecting client resyncs",
+			lastEventID: "7",
+			liftable:    true,
+			want: []string{
+				"id: 1\nevent: resync\n" + `data: {"current":729.98,"withdrawn":0,"held":0}` + "\n",
+				"id: 2\nevent: order\n" +
+					`data: {"type":"order","login":"a","order":"12345678903","status":"PROCESSING"}` + "\n",
+				"id: 3\nevent: balance\n" + `data: {"current":729.98,"withdrawn":0,"held":0}` + "\n",
+			},
+		},
+		{
+			// Without its connection, as for HTTP/2, the stream ends before the write timeout.
+			name: "positive test - stream without connection ends in time",
+			want: []string{
+				"id: 1\nevent: order\n" +
+					`data: {"type":"order","login":"a","order":"12345678903","status":"PROCESSING"}` + "\n",
+				"id: 2\nevent: balance\n" + `data: {"current":729.98,"withdrawn":0,"held":0}` + "\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Server.WriteTimeout = 500 * time.Millisecond
+			repository := new(mocks.Repository)
+			repository.On("Balance", mock.Anything, "a").Return(storage.BalanceInfo{Current: 729.98}, nil)
+			s := NewServer(repository, cfg)
+			ts := httptest.NewUnstartedServer(rootRouter(s))
+			ts.Config.WriteTimeout = cfg.Server.WriteTimeout
+			if tt.liftable {
+				ts.Config.ConnContext = connContext
+			}
+			ts.Start()
+			defer ts.Close()
+
+			h, err := getAuthHeader(s, "a")
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/user/orders/events", nil)
+			require.NoError(t, err)
+			req.Header.Set(authorizationHeader, h)
+			req.Header.Set("Accept-Encoding", "gzip")
+			if len(tt.lastEventID) > 0 {
+				req.Header.Set(lastEventIDHeader, tt.lastEventID)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			response, err := http.DefaultClient.Do(req.WithContext(ctx))
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, contentTypeEventStream, response.Header.Get("Content-Type"))
+			reader := bufio.NewReader(response.Body)
+			readEvent := func() string {
+				var event string
+				for {
+					line, rErr := reader.ReadString('\n')
+					require.NoError(t, rErr)
+					if line == "\n" {
+						return event
+					}
+					event += line
+				}
+			}
+			// The retry hint is sent once subscribed.
+			assert.Equal(t, "retry: 1000\n", readEvent())
+
+			if tt.liftable {
+				time.Sleep(2 * cfg.Server.WriteTimeout)
+			}
+			s.Events().Publish(storage.Event{Type: storage.EventOrder, Login: "b", Order: "79927398713", Status: "PROCESSED"})
+			s.Events().Publish(storage.Event{Type: storage.EventOrder, Login: "a", Order: "12345678903", Status: "PROCESSING"})
+			s.Events().Publish(storage.Event{Type: storage.EventBalance, Login: "a"})
+
+			for _, want := range tt.want {
+				assert.Equal(t, want, readEvent())
+			}
+			if tt.liftable {
+				return
+			}
+			rest, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Empty(t, strings.ReplaceAll(string(rest), ": heartbeat\n\n", ""))
+			repository.AssertExpectations(t)
+		})
+	}
+}
+
 func TestServer_balance(t *testing.T) {
 	type want struct {
 		statusCode  int
@@ -600,59 +1083,220 @@ func TestServer_balance(t *testing.T) {
 	}
 }
 
-func TestServer_withdraw(t *testing.T) {
-	type want struct {
-		statusCode int
-	}
+func TestServer_balanceExpiringSoon(t *testing.T) {
 	tests := []struct {
-		name         string
-		userBalances map[string]float64
-		user         string
-		contentType  string
-		content      string
-		want         want
+		name      string
+		pointsTTL time.Duration
+		want      string
 	}{
 		{
-			name: "positive test",
-			userBalances: map[string]float64{
-				"a": 100.0,
-				"b": 200.0,
-			},
-			user:        "a",
-			contentType: contentTypeJSON,
-			content:     "{\"order\": \"2377225624\",\"sum\": 10}",
-			want: want{
-				statusCode: 200,
-			},
-		},
-		{
-			name: "negative test - malformed content",
-			userBalances: map[string]float64{
-				"a": 100.0,
-				"b": 200.0,
-			},
-			user:        "a",
-			contentType: contentTypeJSON,
-			content:     "{\"login\": \"cd\",\"password\": \"12",
-			want: want{
-				statusCode: 400,
-			},
+			name:      "positive test - points expire",
+			pointsTTL: 365 * 24 * time.Hour,
+			want: `{"current":500,"withdrawn":0,"held":0,` +
+				`"expiring_soon":[{"amount":200,"expires_at":"2026-11-01T00:00:00Z"}]}`,
 		},
 		{
-			name: "negative test - wrong content type",
-			userBalances: map[string]float64{
-				"a": 100.0,
-				"b": 200.0,
-			},
-			user:        "a",
-			contentType: "text",
-			content:     "{\"order\": \"cd\",\"sum\": 1234}",
-			want: want{
-				statusCode: 400,
-			},
+			name: "positive test - points never expire",
+			want: `{"current":500,"withdrawn":0,"held":0}`,
 		},
-		{
-			name: "negative test - wrong content",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Balance.PointsTTL = tt.pointsTTL
+			repository := new(mocks.Repository)
+			repository.On("Balance", mock.Anything, "a").Return(storage.BalanceInfo{Current: 500}, nil)
+			repository.On("ExpiringPoints", mock.Anything, "a", tt.pointsTTL, cfg.Balance.ExpiryNotice).
+				Return([]storage.ExpiringInfo{{Amount: 200, ExpiresAt: "2026-11-01T00:00:00Z"}}, nil)
+			s := NewServer(repository, cfg)
+			ts := httptest.NewServer(rootRouter(s))
+			defer ts.Close()
+
+			h, err := getAuthHeader(s, "a")
+			require.NoError(t, err)
+			response, content := makeTestRequest(t, ts, http.MethodGet, "/api/user/balance", "", h, nil)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.JSONEq(t, tt.want, content)
+		})
+	}
+}
+
+func TestServer_profile(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       string
+		statusCode int
+		want       string
+	}{
+		{
+			name:       "positive test",
+			user:       "a",
+			statusCode: 200,
+			want: `{"login":"a","tier":"silver","tier_since":"2026-10-01T00:00:00Z","multiplier":1.1,` +
+				`"tier_changes":[{"to":"silver","basis_amount":1200,"multiplier":1.1,` +
+				`"changed_at":"2026-10-01T00:00:00Z"}]}`,
+		},
+		{
+			name:       "negative test - unauthorized",
+			statusCode: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := getTestEntities(func(repository *mocks.Repository) {
+				repository.On("Profile", mock.Anything, "a").Return(storage.ProfileInfo{
+					Login:      "a",
+					Tier:       "silver",
+					TierSince:  "2026-10-01T00:00:00Z",
+					Multiplier: 1.1,
+					TierChanges: []storage.TierChangeInfo{
+						{To: "silver", BasisAmount: 1200, Multiplier: 1.1, ChangedAt: "2026-10-01T00:00:00Z"},
+					},
+				}, nil)
+			})
+			defer ts.Close()
+
+			h := ""
+			if len(tt.user) > 0 {
+				nh, err := getAuthHeader(*s, tt.user)
+				require.NoError(t, err)
+				h = nh
+			}
+
+			response, content := makeTestRequest(t, ts, http.MethodGet, "/api/user/profile", "", h, nil)
+			err := response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			if len(tt.want) > 0 {
+				assert.JSONEq(t, tt.want, content)
+			}
+		})
+	}
+}
+
+func TestServer_referrals(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       string
+		statusCode int
+		want       string
+	}{
+		{
+			name:       "positive test",
+			user:       "a",
+			statusCode: 200,
+			want: `{"code":"5f3a9c01d2e4","referees":[` +
+				`{"login":"b","status":"REWARDED","bonus":100,"created_at":"2026-10-01T00:00:00Z",` +
+				`"rewarded_at":"2026-10-02T00:00:00Z"},` +
+				`{"login":"c","status":"REJECTED","reason":"signed up from the IP address of the referrer",` +
+				`"bonus":100,"created_at":"2026-10-03T00:00:00Z"}]}`,
+		},
+		{
+			name:       "positive test - no referees",
+			user:       "b",
+			statusCode: 200,
+			want:       `{"code":"07b1e2d4c8aa","referees":[]}`,
+		},
+		{
+			name:       "negative test - unauthorized",
+			statusCode: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := getTestEntities(func(repository *mocks.Repository) {
+				repository.On("Referrals", mock.Anything, "a").Return(storage.ReferralsInfo{
+					Code: "5f3a9c01d2e4",
+					Referees: []storage.ReferralInfo{
+						{Login: "b", Status: storage.ReferralRewarded, Bonus: 100,
+							CreatedAt: "2026-10-01T00:00:00Z", RewardedAt: "2026-10-02T00:00:00Z"},
+						{Login: "c", Status: storage.ReferralRejected,
+							Reason: "signed up from the IP address of the referrer", Bonus: 100,
+							CreatedAt: "2026-10-03T00:00:00Z"},
+					},
+				}, nil)
+				repository.On("Referrals", mock.Anything, "b").Return(storage.ReferralsInfo{
+					Code: "07b1e2d4c8aa",
+				}, nil)
+			})
+			defer ts.Close()
+
+			h := ""
+			if len(tt.user) > 0 {
+				nh, err := getAuthHeader(*s, tt.user)
+				require.NoError(t, err)
+				h = nh
+			}
+
+			response, content := makeTestRequest(t, ts, http.MethodGet, "/api/user/referrals", "", h, nil)
+			err := response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			if len(tt.want) > 0 {
+				assert.JSONEq(t, tt.want, content)
+			}
+		})
+	}
+}
+
+func TestServer_withdraw(t *testing.T) {
+	type want struct {
+		statusCode int
+	}
+	tests := []struct {
+		name         string
+		userBalances map[string]float64
+		user         string
+		contentType  string
+		content      string
+		want         want
+	}{
+		{
+			name: "positive test",
+			userBalances: map[string]float64{
+				"a": 100.0,
+				"b": 200.0,
+			},
+			user:        "a",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"2377225624\",\"sum\": 10}",
+			want: want{
+				statusCode: 200,
+			},
+		},
+		{
+			name: "negative test - malformed content",
+			userBalances: map[string]float64{
+				"a": 100.0,
+				"b": 200.0,
+			},
+			user:        "a",
+			contentType: contentTypeJSON,
+			content:     "{\"login\": \"cd\",\"password\": \"12",
+			want: want{
+				statusCode: 400,
+			},
+		},
+		{
+			name: "negative test - wrong content type",
+			userBalances: map[string]float64{
+				"a": 100.0,
+				"b": 200.0,
+			},
+			user:        "a",
+			contentType: "text",
+			content:     "{\"order\": \"cd\",\"sum\": 1234}",
+			want: want{
+				statusCode: 400,
+			},
+		},
+		{
+			name: "negative test - wrong content",
 			userBalances: map[string]float64{
 				"a": 100.0,
 				"b": 200.0,
@@ -664,6 +1308,18 @@ func TestServer_withdraw(t *testing.T) {
 				statusCode: 400,
 			},
 		},
+		{
+			name: "negative test - non-positive sum",
+			userBalances: map[string]float64{
+				"a": 100.0,
+			},
+			user:        "a",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"2377225624\",\"sum\": -10}",
+			want: want{
+				statusCode: 400,
+			},
+		},
 		{
 			name: "negative test - unauthorized",
 			userBalances: map[string]float64{
@@ -703,6 +1359,31 @@ func TestServer_withdraw(t *testing.T) {
 				statusCode: 422,
 			},
 		},
+		{
+			name: "negative test - duplicate order number",
+			userBalances: map[string]float64{
+				"a": 100,
+				"b": 200,
+			},
+			user:        "a",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"12345678903\",\"sum\": 10}",
+			want: want{
+				statusCode: 409,
+			},
+		},
+		{
+			name: "negative test - balance spent meanwhile",
+			userBalances: map[string]float64{
+				"a": 100,
+			},
+			user:        "a",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"4111111111111111\",\"sum\": 90}",
+			want: want{
+				statusCode: 402,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -717,6 +1398,10 @@ func TestServer_withdraw(t *testing.T) {
 						userRegistered = true
 					}
 				}
+				repository.On("Withdraw", mock.Anything, mock.Anything, "12345678903", mock.Anything).
+					Return(storage.ErrWithdrawalExists)
+				repository.On("Withdraw", mock.Anything, mock.Anything, "4111111111111111", mock.Anything).
+					Return(storage.ErrInsufficientFunds)
 				repository.On("Withdraw", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 			})
 			require.NotNil(t, ts)
@@ -832,3 +1517,1135 @@ func TestServer_withdrawals(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_adminPing(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiKey     string
+		statusCode int
+	}{
+		{
+			name:       "positive test",
+			apiKey:     "admin-key",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - no API key",
+			apiKey:     "",
+			statusCode: 401,
+		},
+		{
+			name:       "negative test - unknown API key",
+			apiKey:     "unknown-key",
+			statusCode: 401,
+		},
+		{
+			name:       "negative test - missing scope",
+			apiKey:     "client-key",
+			statusCode: 403,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+				{Name: "mobile", Key: "client-key"},
+			}
+			repository := new(mocks.Repository)
+			repository.On("Ping", mock.Anything).Return(nil)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/admin/ping", nil)
+			require.NoError(t, err)
+			if len(tt.apiKey) > 0 {
+				req.Header.Set(apiKeyHeader, tt.apiKey)
+			}
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_accrualWebhook(t *testing.T) {
+	secret := []byte("webhook-secret")
+	tests := []struct {
+		name       string
+		content    string
+		sentAt     time.Time
+		secret     []byte
+		statusCode int
+		updated    bool
+	}{
+		{
+			name:       "positive test",
+			content:    "{\"order\": \"12345678903\",\"status\": \"PROCESSED\",\"accrual\": 500}",
+			sentAt:     time.Now(),
+			secret:     secret,
+			statusCode: 200,
+			updated:    true,
+		},
+		{
+			name:       "negative test - bad signature",
+			content:    "{\"order\": \"12345678903\",\"status\": \"PROCESSED\",\"accrual\": 500}",
+			sentAt:     time.Now(),
+			secret:     []byte("other"),
+			statusCode: 401,
+		},
+		{
+			name:       "negative test - replay",
+			content:    "{\"order\": \"12345678903\",\"status\": \"PROCESSED\",\"accrual\": 500}",
+			sentAt:     time.Now().Add(-time.Hour),
+			secret:     secret,
+			statusCode: 401,
+		},
+		{
+			name:       "negative test - unknown status",
+			content:    "{\"order\": \"12345678903\",\"status\": \"DONE\",\"accrual\": 500}",
+			sentAt:     time.Now(),
+			secret:     secret,
+			statusCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Accrual.WebhookSecret = string(secret)
+			repository := new(mocks.Repository)
+			mockOrderIDs(repository)
+			repository.On("UpdateOrder", mock.Anything, int64(12345678903), "PROCESSED", 500.0).Return(nil)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/accrual/webhook", strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(accrual.TimestampHeader, strconv.FormatInt(tt.sentAt.Unix(), 10))
+			req.Header.Set(accrual.SignatureHeader, accrual.Sign(tt.secret, tt.sentAt.Unix(), []byte(tt.content)))
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			if tt.updated {
+				repository.AssertCalled(t, "UpdateOrder", mock.Anything, int64(12345678903), "PROCESSED", 500.0)
+			} else {
+				repository.AssertNotCalled(t, "UpdateOrder", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestServer_deadLetters(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		content     string
+		statusCode  int
+	}{
+		{
+			name:       "positive test - list",
+			method:     http.MethodGet,
+			path:       "/api/admin/dead-letters",
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - retry",
+			method:     http.MethodPost,
+			path:       "/api/admin/dead-letters/12345678903/retry",
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - retry order of a merchant",
+			method:     http.MethodPost,
+			path:       "/api/admin/dead-letters/12345678903/retry?merchant=corner-shop",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - retry not dead-lettered",
+			method:     http.MethodPost,
+			path:       "/api/admin/dead-letters/79927398713/retry",
+			statusCode: 404,
+		},
+		{
+			name:        "positive test - resolve",
+			method:      http.MethodPost,
+			path:        "/api/admin/dead-letters/12345678903/resolve",
+			contentType: contentTypeJSON,
+			content:     "{\"status\": \"PROCESSED\",\"accrual\": 500}",
+			statusCode:  200,
+		},
+		{
+			name:        "negative test - resolve with pending status",
+			method:      http.MethodPost,
+			path:        "/api/admin/dead-letters/12345678903/resolve",
+			contentType: contentTypeJSON,
+			content:     "{\"status\": \"PROCESSING\",\"accrual\": 500}",
+			statusCode:  400,
+		},
+		{
+			name:        "negative test - resolve not dead-lettered",
+			method:      http.MethodPost,
+			path:        "/api/admin/dead-letters/79927398713/resolve",
+			contentType: contentTypeJSON,
+			content:     "{\"status\": \"INVALID\"}",
+			statusCode:  404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+			}
+			repository := new(mocks.Repository)
+			mockOrderIDs(repository)
+			repository.On("OrderID", mock.Anything, "corner-shop", "12345678903").Return(int64(7), nil)
+			repository.On("RetryDeadLetter", mock.Anything, int64(7)).Return(nil)
+			repository.On("DeadLetters", mock.Anything).Return([]storage.DeadLetterInfo{
+				{Number: "12345678903", Login: "a", Status: "PROCESSING", Attempts: 20, LastError: "timeout"},
+			}, nil)
+			repository.On("RetryDeadLetter", mock.Anything, int64(12345678903)).Return(nil)
+			repository.On("RetryDeadLetter", mock.Anything, int64(79927398713)).Return(storage.ErrNotDeadLettered)
+			repository.On("ResolveDeadLetter", mock.Anything, int64(12345678903), "PROCESSED", 500.0).Return(nil)
+			repository.On("ResolveDeadLetter", mock.Anything, int64(79927398713), "INVALID", 0.0).
+				Return(storage.ErrNotDeadLettered)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(apiKeyHeader, "admin-key")
+			if len(tt.contentType) > 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_balanceHistory(t *testing.T) {
+	tests := []struct {
+		name       string
+		entries    []storage.BalanceEntry
+		statusCode int
+	}{
+		{
+			name: "positive test",
+			entries: []storage.BalanceEntry{
+				{Type: storage.EntryAccrual, Order: "12345678903", Amount: 500},
+				{Type: storage.EntryAdjustment, Order: "12345678903", Amount: -100, Reason: "return"},
+			},
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - no entries",
+			statusCode: 204,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := getTestEntities(func(repository *mocks.Repository) {
+				repository.On("BalanceHistory", mock.Anything, "a").Return(tt.entries, nil)
+			})
+			defer ts.Close()
+
+			h, err := getAuthHeader(*s, "a")
+			require.NoError(t, err)
+
+			response, content := makeTestRequest(t, ts, http.MethodGet, "/api/user/balance/history", "", h, nil)
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			if len(tt.entries) > 0 {
+				assert.Contains(t, content, "\"type\":\"adjustment\"")
+			}
+		})
+	}
+}
+
+func TestServer_reverseAccrual(t *testing.T) {
+	tests := []struct {
+		name       string
+		order      string
+		content    string
+		policy     string
+		statusCode int
+	}{
+		{
+			name:       "positive test - allow debt",
+			order:      "12345678903",
+			content:    "{\"amount\": 100,\"reason\": \"return\"}",
+			policy:     config.ReversalAllowDebt,
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - cap at zero",
+			order:      "12345678903",
+			content:    "{\"amount\": 100,\"reason\": \"return\"}",
+			policy:     config.ReversalCapAtZero,
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - negative amount",
+			order:      "12345678903",
+			content:    "{\"amount\": -100}",
+			policy:     config.ReversalAllowDebt,
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - unknown order",
+			order:      "79927398713",
+			content:    "{\"amount\": 100,\"reason\": \"return\"}",
+			policy:     config.ReversalAllowDebt,
+			statusCode: 404,
+		},
+		{
+			name:       "negative test - exceeds accrual",
+			order:      "4561261212345467",
+			content:    "{\"amount\": 100,\"reason\": \"return\"}",
+			policy:     config.ReversalAllowDebt,
+			statusCode: 409,
+		},
+		{
+			name:       "negative test - cap at zero with nothing left",
+			order:      "4111111111111111",
+			content:    "{\"amount\": 100,\"reason\": \"return\"}",
+			policy:     config.ReversalCapAtZero,
+			statusCode: 409,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+			}
+			cfg.Balance.ReversalPolicy = tt.policy
+			allowDebt := tt.policy == config.ReversalAllowDebt
+			repository := new(mocks.Repository)
+			mockOrderIDs(repository)
+			repository.On("ReverseAccrual", mock.Anything, int64(12345678903), 100.0, "return", allowDebt).
+				Return(storage.AdjustmentInfo{Order: "12345678903", Amount: -100, Reason: "return"}, nil)
+			repository.On("ReverseAccrual", mock.Anything, int64(79927398713), 100.0, "return", allowDebt).
+				Return(storage.AdjustmentInfo{}, storage.ErrOrderNotFound)
+			repository.On("ReverseAccrual", mock.Anything, int64(4561261212345467), 100.0, "return", allowDebt).
+				Return(storage.AdjustmentInfo{}, storage.ErrReversalExceedsAccrual)
+			repository.On("ReverseAccrual", mock.Anything, int64(4111111111111111), 100.0, "return", allowDebt).
+				Return(storage.AdjustmentInfo{}, storage.ErrNothingToReverse)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/admin/orders/"+tt.order+"/reversal",
+				strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(apiKeyHeader, "admin-key")
+			req.Header.Set("Content-Type", contentTypeJSON)
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_holds(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		content     string
+		statusCode  int
+	}{
+		{
+			name:        "positive test - create",
+			path:        "/api/user/balance/holds",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"12345678903\",\"sum\": 100}",
+			statusCode:  200,
+		},
+		{
+			name:        "negative test - create with bad order",
+			path:        "/api/user/balance/holds",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"12345678904\",\"sum\": 100}",
+			statusCode:  422,
+		},
+		{
+			name:        "negative test - create with zero sum",
+			path:        "/api/user/balance/holds",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"12345678903\",\"sum\": 0}",
+			statusCode:  400,
+		},
+		{
+			name:        "negative test - create over balance",
+			path:        "/api/user/balance/holds",
+			contentType: contentTypeJSON,
+			content:     "{\"order\": \"79927398713\",\"sum\": 1000}",
+			statusCode:  402,
+		},
+		{
+			name:       "positive test - capture",
+			path:       "/api/user/balance/holds/1/capture",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - capture expired",
+			path:       "/api/user/balance/holds/2/capture",
+			statusCode: 409,
+		},
+		{
+			name:       "negative test - capture after held points expired",
+			path:       "/api/user/balance/holds/4/capture",
+			statusCode: 402,
+		},
+		{
+			name:       "positive test - void",
+			path:       "/api/user/balance/holds/1/void",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - void unknown",
+			path:       "/api/user/balance/holds/3/void",
+			statusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := getTestEntities(func(repository *mocks.Repository) {
+				ttl := config.Default().Balance.HoldTTL
+				repository.On("CreateHold", mock.Anything, "a", "12345678903", 100.0, ttl).
+					Return(storage.HoldInfo{ID: 1, Order: "12345678903", Sum: 100, Status: storage.HoldActive}, nil)
+				repository.On("CreateHold", mock.Anything, "a", "79927398713", 1000.0, ttl).
+					Return(storage.HoldInfo{}, storage.ErrInsufficientFunds)
+				repository.On("CaptureHold", mock.Anything, "a", int64(1)).
+					Return(storage.HoldInfo{ID: 1, Status: storage.HoldCaptured}, nil)
+				repository.On("CaptureHold", mock.Anything, "a", int64(2)).
+					Return(storage.HoldInfo{ID: 2, Status: storage.HoldExpired}, storage.ErrHoldNotActive)
+				repository.On("CaptureHold", mock.Anything, "a", int64(4)).
+					Return(storage.HoldInfo{ID: 4, Status: storage.HoldActive}, storage.ErrHoldShortfall)
+				repository.On("VoidHold", mock.Anything, "a", int64(1)).
+					Return(storage.HoldInfo{ID: 1, Status: storage.HoldVoided}, nil)
+				repository.On("VoidHold", mock.Anything, "a", int64(3)).
+					Return(storage.HoldInfo{}, storage.ErrHoldNotFound)
+			})
+			defer ts.Close()
+
+			h, err := getAuthHeader(*s, "a")
+			require.NoError(t, err)
+
+			response, _ := makeTestRequest(t, ts, http.MethodPost, tt.path, tt.contentType, h,
+				strings.NewReader(tt.content))
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_refund(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		apiKey     string
+		content    string
+		statusCode int
+	}{
+		{
+			name:       "positive test - refunds scope",
+			path:       "/api/withdrawals/12345678903/refund",
+			apiKey:     "shop-key",
+			content:    "{\"refund_id\": \"cancel-1\",\"amount\": 50}",
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - admin",
+			path:       "/api/admin/withdrawals/12345678903/refund",
+			apiKey:     "admin-key",
+			content:    "{\"refund_id\": \"cancel-1\",\"amount\": 50}",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - admin route with refunds scope",
+			path:       "/api/admin/withdrawals/12345678903/refund",
+			apiKey:     "shop-key",
+			content:    "{\"refund_id\": \"cancel-1\",\"amount\": 50}",
+			statusCode: 403,
+		},
+		{
+			name:       "negative test - no refund id",
+			path:       "/api/withdrawals/12345678903/refund",
+			apiKey:     "shop-key",
+			content:    "{\"amount\": 50}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - refund id reused",
+			path:       "/api/withdrawals/79927398713/refund",
+			apiKey:     "shop-key",
+			content:    "{\"refund_id\": \"cancel-1\",\"amount\": 50}",
+			statusCode: 409,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+				{Name: "shop", Key: "shop-key", Scopes: []string{scopeRefunds}},
+			}
+			repository := new(mocks.Repository)
+			repository.On("RefundWithdrawal", mock.Anything, "12345678903", 50.0, "cancel-1", "").
+				Return(storage.RefundInfo{Order: "12345678903", Amount: 50, Reference: "cancel-1"}, nil)
+			repository.On("RefundWithdrawal", mock.Anything, "79927398713", 50.0, "cancel-1", "").
+				Return(storage.RefundInfo{}, storage.ErrRefundConflict)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL+tt.path, strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(apiKeyHeader, tt.apiKey)
+			req.Header.Set("Content-Type", contentTypeJSON)
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_idempotency(t *testing.T) {
+	content := "{\"order\": \"12345678903\",\"sum\": 100}"
+	req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", nil)
+	fingerprint := requestFingerprint(req, []byte(content))
+
+	tests := []struct {
+		name       string
+		query      string
+		stored     *storage.IdempotentResponse
+		statusCode int
+		replayed   bool
+		withdrawn  bool
+	}{
+		{
+			name:       "positive test - first request",
+			statusCode: 200,
+			withdrawn:  true,
+		},
+		{
+			name: "positive test - retry",
+			stored: &storage.IdempotentResponse{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				StatusCode:  200,
+			},
+			statusCode: 200,
+			replayed:   true,
+		},
+		{
+			name: "negative test - key reused for another request",
+			stored: &storage.IdempotentResponse{
+				Fingerprint: "other",
+				Completed:   true,
+				StatusCode:  200,
+			},
+			statusCode: 422,
+		},
+		{
+			name:  "negative test - key reused for another merchant",
+			query: "?merchant=corner-shop",
+			stored: &storage.IdempotentResponse{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				StatusCode:  200,
+			},
+			statusCode: 422,
+		},
+		{
+			name: "negative test - first request in progress",
+			stored: &storage.IdempotentResponse{
+				Fingerprint: fingerprint,
+			},
+			statusCode: 409,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var repository *mocks.Repository
+			s, ts := getTestEntities(func(r *mocks.Repository) {
+				repository = r
+				window, lease := config.Default().Server.IdempotencyWindow, config.Default().Server.IdempotencyLease
+				sent := requestFingerprint(httptest.NewRequest(http.MethodPost,
+					"/api/user/balance/withdraw"+tt.query, nil), []byte(content))
+				r.On("ReserveIdempotencyKey", mock.Anything, "user:a", "key-1", sent, window, lease).
+					Return(tt.stored, nil)
+				r.On("SaveIdempotentResponse", mock.Anything, "user:a", "key-1", mock.Anything).Return(nil)
+				r.On("Balance", mock.Anything, "a").Return(storage.BalanceInfo{Current: 500}, nil)
+				r.On("Withdraw", mock.Anything, "a", "12345678903", 100.0).Return(nil)
+			})
+			defer ts.Close()
+
+			h, err := getAuthHeader(*s, "a")
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/user/balance/withdraw"+tt.query,
+				strings.NewReader(content))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentTypeJSON)
+			req.Header.Set(authorizationHeader, h)
+			req.Header.Set(idempotencyKeyHeader, "key-1")
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			assert.Equal(t, tt.replayed, response.Header.Get(idempotentReplayedHeader) == "true")
+			if tt.withdrawn {
+				repository.AssertCalled(t, "Withdraw", mock.Anything, "a", "12345678903", 100.0)
+				repository.AssertCalled(t, "SaveIdempotentResponse", mock.Anything, "user:a", "key-1", mock.Anything)
+			} else {
+				repository.AssertNotCalled(t, "Withdraw", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestServer_knownWithdrawalOrder(t *testing.T) {
+	cfg := config.Default()
+	s := NewServer(new(mocks.Repository), cfg)
+	assert.True(t, s.knownWithdrawalOrder("2377225624"))
+
+	cfg.Balance.WithdrawalOrderFormats = []string{"^2377", "^[0-9]{16}$"}
+	s = NewServer(new(mocks.Repository), cfg)
+	assert.True(t, s.knownWithdrawalOrder("2377225624"))
+	assert.True(t, s.knownWithdrawalOrder("4561261212345467"))
+	assert.False(t, s.knownWithdrawalOrder("12345678903"))
+}
+
+func TestServer_campaigns(t *testing.T) {
+	weekend := storage.CampaignInfo{
+		Name:       "double points",
+		StartsAt:   "2026-10-17T00:00:00Z",
+		EndsAt:     "2026-10-19T00:00:00Z",
+		Multiplier: 2,
+	}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		content    string
+		statusCode int
+	}{
+		{
+			name:   "positive test - create",
+			method: http.MethodPost,
+			path:   "/api/admin/campaigns",
+			content: "{\"name\": \"double points\",\"starts_at\": \"2026-10-17T03:00:00+03:00\"," +
+				"\"ends_at\": \"2026-10-19T03:00:00+03:00\",\"multiplier\": 2}",
+			statusCode: 201,
+		},
+		{
+			name:       "negative test - create without a bonus",
+			method:     http.MethodPost,
+			path:       "/api/admin/campaigns",
+			content:    "{\"name\": \"nothing\",\"starts_at\": \"2026-10-17T00:00:00Z\",\"multiplier\": 1}",
+			statusCode: 400,
+		},
+		{
+			name:   "negative test - create for an unknown tier",
+			method: http.MethodPost,
+			path:   "/api/admin/campaigns",
+			content: "{\"name\": \"platinum\",\"starts_at\": \"2026-10-17T00:00:00Z\"," +
+				"\"tier\": \"platinum\",\"bonus\": 100}",
+			statusCode: 400,
+		},
+		{
+			name:   "negative test - window ends before it starts",
+			method: http.MethodPost,
+			path:   "/api/admin/campaigns",
+			content: "{\"name\": \"double points\",\"starts_at\": \"2026-10-19T00:00:00Z\"," +
+				"\"ends_at\": \"2026-10-17T00:00:00Z\",\"multiplier\": 2}",
+			statusCode: 400,
+		},
+		{
+			name:       "positive test - get",
+			method:     http.MethodGet,
+			path:       "/api/admin/campaigns/1",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - get missing",
+			method:     http.MethodGet,
+			path:       "/api/admin/campaigns/2",
+			statusCode: 404,
+		},
+		{
+			name:       "positive test - delete",
+			method:     http.MethodDelete,
+			path:       "/api/admin/campaigns/1",
+			statusCode: 204,
+		},
+		{
+			name:       "positive test - dry run",
+			method:     http.MethodPost,
+			path:       "/api/admin/campaigns/dry-run",
+			content:    "{\"order\": \"12345678903\",\"accrual\": 500}",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - dry run of a missing order",
+			method:     http.MethodPost,
+			path:       "/api/admin/campaigns/dry-run",
+			content:    "{\"order\": \"79927398713\"}",
+			statusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "marketing", Key: "admin-key", Scopes: []string{scopeAdmin}},
+			}
+			cfg.Loyalty.Tiers = []config.Tier{{Name: "gold", Threshold: 5000, Multiplier: 1.25}}
+			created := weekend
+			created.ID = 1
+			repository := new(mocks.Repository)
+			mockOrderIDs(repository)
+			repository.On("CreateCampaign", mock.Anything, weekend).Return(created, nil)
+			repository.On("Campaign", mock.Anything, int64(1)).Return(created, nil)
+			repository.On("Campaign", mock.Anything, int64(2)).Return(storage.CampaignInfo{}, storage.ErrCampaignNotFound)
+			repository.On("DeleteCampaign", mock.Anything, int64(1)).Return(nil)
+			repository.On("DryRunCampaigns", mock.Anything, int64(12345678903), 500.0).Return(
+				[]storage.CampaignEvaluation{{CampaignID: 1, Name: "double points", Eligible: true, Bonus: 500}}, nil)
+			repository.On("DryRunCampaigns", mock.Anything, int64(79927398713), 0.0).
+				Return(nil, storage.ErrOrderNotFound)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(apiKeyHeader, "admin-key")
+			req.Header.Set("Content-Type", contentTypeJSON)
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_merchants(t *testing.T) {
+	cornerShop := storage.MerchantInfo{
+		Code:           "corner-shop",
+		Name:           "Corner shop",
+		NumberPattern:  "^[0-9]{12}$",
+		CheckDigit:     storage.CheckDigitNone,
+		AccrualAddress: "http://accrual.corner-shop.example",
+	}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		content    string
+		statusCode int
+	}{
+		{
+			name:   "positive test - create",
+			method: http.MethodPost,
+			path:   "/api/admin/merchants",
+			content: "{\"code\": \"corner-shop\",\"name\": \"Corner shop\",\"number_pattern\": \"^[0-9]{12}$\"," +
+				"\"check_digit\": \"none\",\"accrual_address\": \"http://accrual.corner-shop.example\"}",
+			statusCode: 201,
+		},
+		{
+			name:       "negative test - create taken code",
+			method:     http.MethodPost,
+			path:       "/api/admin/merchants",
+			content:    "{\"code\": \"bakery\"}",
+			statusCode: 409,
+		},
+		{
+			name:       "negative test - create default merchant",
+			method:     http.MethodPost,
+			path:       "/api/admin/merchants",
+			content:    "{\"code\": \"default\"}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - bad number pattern",
+			method:     http.MethodPost,
+			path:       "/api/admin/merchants",
+			content:    "{\"code\": \"corner-shop\",\"number_pattern\": \"(unclosed\"}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - number pattern escaping its anchors",
+			method:     http.MethodPost,
+			path:       "/api/admin/merchants",
+			content:    "{\"code\": \"corner-shop\",\"number_pattern\": \"1)|(2\"}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - unknown check digit",
+			method:     http.MethodPost,
+			path:       "/api/admin/merchants",
+			content:    "{\"code\": \"corner-shop\",\"check_digit\": \"crc\"}",
+			statusCode: 400,
+		},
+		{
+			name:       "positive test - list",
+			method:     http.MethodGet,
+			path:       "/api/admin/merchants",
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - get",
+			method:     http.MethodGet,
+			path:       "/api/admin/merchants/corner-shop",
+			statusCode: 200,
+		},
+		{
+			name:   "positive test - update",
+			method: http.MethodPut,
+			path:   "/api/admin/merchants/corner-shop",
+			content: "{\"name\": \"Corner shop\",\"number_pattern\": \"^[0-9]{12}$\",\"check_digit\": \"none\"," +
+				"\"accrual_address\": \"http://accrual.corner-shop.example\"}",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - update missing",
+			method:     http.MethodPut,
+			path:       "/api/admin/merchants/bakery",
+			content:    "{\"name\": \"bakery\"}",
+			statusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+			}
+			bakery := storage.MerchantInfo{Code: "bakery", Name: "bakery", CheckDigit: storage.CheckDigitLuhn}
+			repository := new(mocks.Repository)
+			repository.On("CreateMerchant", mock.Anything, cornerShop).Return(cornerShop, nil)
+			repository.On("CreateMerchant", mock.Anything, bakery).Return(storage.MerchantInfo{},
+				storage.ErrMerchantExists)
+			repository.On("Merchants", mock.Anything).Return([]storage.MerchantInfo{cornerShop}, nil)
+			repository.On("Merchant", mock.Anything, "corner-shop").Return(cornerShop, nil)
+			repository.On("UpdateMerchant", mock.Anything, cornerShop).Return(cornerShop, nil)
+			repository.On("UpdateMerchant", mock.Anything, bakery).Return(storage.MerchantInfo{},
+				storage.ErrMerchantNotFound)
+			ts := httptest.NewServer(rootRouter(NewServer(repository, cfg)))
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(apiKeyHeader, "admin-key")
+			req.Header.Set("Content-Type", contentTypeJSON)
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+// testResolver resolves hosts without DNS.
+type testResolver map[string][]net.IPAddr
+
+func (r testResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addresses, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addresses, nil
+}
+
+func TestServer_webhooks(t *testing.T) {
+	mobile := storage.WebhookInfo{
+		Client:    "mobile",
+		URL:       "https://mobile.example/hooks/gophermart",
+		Events:    []string{storage.EventOrder},
+		Merchants: []string{"corner-shop"},
+	}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		content    string
+		statusCode int
+	}{
+		{
+			name:       "positive test - create",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"https://mobile.example/hooks/gophermart\",\"events\": [\"order\", \"order\"]}",
+			statusCode: 201,
+		},
+		{
+			name:       "negative test - relative url",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"/hooks\",\"events\": [\"order\"]}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - plain http url",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"http://mobile.example/hooks\",\"events\": [\"order\"]}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - loopback url",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"https://127.0.0.1:8080/hooks\",\"events\": [\"order\"]}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - host resolving to a private address",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"https://intranet.example/hooks\",\"events\": [\"order\"]}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - unknown event",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"https://mobile.example/hooks\",\"events\": [\"refund\"]}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - merchant not granted",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"https://mobile.example/hooks\",\"events\": [\"order\"],\"merchants\": [\"kiosk\"]}",
+			statusCode: 403,
+		},
+		{
+			name:       "negative test - balance events of a merchant client",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			content:    "{\"url\": \"https://mobile.example/hooks\",\"events\": [\"order\", \"balance\"]}",
+			statusCode: 403,
+		},
+		{
+			name:       "negative test - client granted no merchants",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "kiosk-key",
+			content:    "{\"url\": \"https://mobile.example/hooks\",\"events\": [\"order\"]}",
+			statusCode: 403,
+		},
+		{
+			name:       "positive test - every merchant with the admin scope",
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			key:        "backoffice-key",
+			content:    "{\"url\": \"https://mobile.example/hooks\",\"events\": [\"order\", \"balance\"]}",
+			statusCode: 201,
+		},
+		{
+			name:       "negative test - lacks scope",
+			method:     http.MethodGet,
+			path:       "/api/webhooks",
+			key:        "admin-key",
+			statusCode: 403,
+		},
+		{
+			name:       "positive test - list",
+			method:     http.MethodGet,
+			path:       "/api/webhooks",
+			key:        "mobile-key",
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - deliveries",
+			method:     http.MethodGet,
+			path:       "/api/webhooks/1/deliveries",
+			key:        "mobile-key",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - deliveries of another client",
+			method:     http.MethodGet,
+			path:       "/api/webhooks/2/deliveries",
+			key:        "mobile-key",
+			statusCode: 404,
+		},
+		{
+			name:       "positive test - delete",
+			method:     http.MethodDelete,
+			path:       "/api/webhooks/1",
+			key:        "mobile-key",
+			statusCode: 204,
+		},
+		{
+			name:       "negative test - delete bad id",
+			method:     http.MethodDelete,
+			path:       "/api/webhooks/first",
+			key:        "mobile-key",
+			statusCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.APIClients = []config.APIClient{
+				{Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+				{Name: "mobile", Key: "mobile-key", Scopes: []string{scopeWebhooks}, Merchants: []string{"corner-shop"}},
+				{Name: "kiosk", Key: "kiosk-key", Scopes: []string{scopeWebhooks}},
+				{Name: "backoffice", Key: "backoffice-key", Scopes: []string{scopeAdmin, scopeWebhooks}},
+			}
+			created := mobile
+			created.ID = 1
+			created.Secret = "secret"
+			repository := new(mocks.Repository)
+			repository.On("CreateWebhook", mock.Anything, mobile).Return(created, nil)
+			repository.On("CreateWebhook", mock.Anything, storage.WebhookInfo{
+				Client: "backoffice",
+				URL:    "https://mobile.example/hooks",
+				Events: []string{storage.EventOrder, storage.EventBalance},
+			}).Return(storage.WebhookInfo{ID: 2}, nil)
+			repository.On("Webhooks", mock.Anything, "mobile").Return([]storage.WebhookInfo{mobile}, nil)
+			repository.On("WebhookDeliveries", mock.Anything, "mobile", int64(1)).Return(
+				[]storage.WebhookDeliveryInfo{{ID: 7, Event: storage.EventOrder, Status: storage.WebhookDelivered}}, nil)
+			repository.On("WebhookDeliveries", mock.Anything, "mobile", int64(2)).Return(nil,
+				storage.ErrWebhookNotFound)
+			repository.On("DeleteWebhook", mock.Anything, "mobile", int64(1)).Return(nil)
+			s := NewServer(repository, cfg)
+			s.resolver = testResolver{
+				"mobile.example":   {{IP: net.ParseIP("203.0.113.10")}},
+				"intranet.example": {{IP: net.ParseIP("203.0.113.11")}, {IP: net.ParseIP("10.0.0.7")}},
+			}
+			ts := httptest.NewServer(rootRouter(s))
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.content))
+			require.NoError(t, err)
+			req.Header.Set(apiKeyHeader, tt.key)
+			req.Header.Set("Content-Type", contentTypeJSON)
+			response, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			err = response.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
+
+func TestServer_transfer(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		content    string
+		statusCode int
+	}{
+		{
+			name:       "positive test - completed",
+			path:       "/api/user/balance/transfer",
+			content:    "{\"to\": \"b\",\"amount\": 100}",
+			statusCode: 200,
+		},
+		{
+			name:       "positive test - awaiting confirmation",
+			path:       "/api/user/balance/transfer",
+			content:    "{\"to\": \"b\",\"amount\": 2000}",
+			statusCode: 202,
+		},
+		{
+			name:       "negative test - not positive amount",
+			path:       "/api/user/balance/transfer",
+			content:    "{\"to\": \"b\",\"amount\": 0}",
+			statusCode: 400,
+		},
+		{
+			name:       "negative test - unknown recipient",
+			path:       "/api/user/balance/transfer",
+			content:    "{\"to\": \"c\",\"amount\": 100}",
+			statusCode: 404,
+		},
+		{
+			name:       "negative test - new account",
+			path:       "/api/user/balance/transfer",
+			content:    "{\"to\": \"d\",\"amount\": 100}",
+			statusCode: 403,
+		},
+		{
+			name:       "negative test - daily limit",
+			path:       "/api/user/balance/transfer",
+			content:    "{\"to\": \"b\",\"amount\": 4000}",
+			statusCode: 422,
+		},
+		{
+			name:       "positive test - confirm",
+			path:       "/api/user/balance/transfers/1/confirm",
+			statusCode: 200,
+		},
+		{
+			name:       "negative test - confirm expired",
+			path:       "/api/user/balance/transfers/2/confirm",
+			statusCode: 409,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := getTestEntities(func(repository *mocks.Repository) {
+				limits := config.Default().Transfers
+				repository.On("Transfer", mock.Anything, "a", "b", 100.0, limits).
+					Return(storage.TransferInfo{ID: 1, Status: storage.TransferCompleted}, nil)
+				repository.On("Transfer", mock.Anything, "a", "b", 2000.0, limits).
+					Return(storage.TransferInfo{ID: 2, Status: storage.TransferPending}, nil)
+				repository.On("Transfer", mock.Anything, "a", "b", 4000.0, limits).
+					Return(storage.TransferInfo{}, storage.ErrTransferLimitExceeded)
+				repository.On("Transfer", mock.Anything, "a", "c", 100.0, limits).
+					Return(storage.TransferInfo{}, storage.ErrRecipientNotFound)
+				repository.On("Transfer", mock.Anything, "a", "d", 100.0, limits).
+					Return(storage.TransferInfo{}, storage.ErrAccountTooNew)
+				repository.On("ConfirmTransfer", mock.Anything, "a", int64(1), limits).
+					Return(storage.TransferInfo{ID: 1, Status: storage.TransferCompleted}, nil)
+				repository.On("ConfirmTransfer", mock.Anything, "a", int64(2), limits).
+					Return(storage.TransferInfo{ID: 2, Status: storage.TransferExpired}, storage.ErrTransferNotPending)
+			})
+			defer ts.Close()
+
+			h, err := getAuthHeader(*s, "a")
+			require.NoError(t, err)
+
+			response, _ := makeTestRequest(t, ts, http.MethodPost, tt.path, contentTypeJSON, h,
+				strings.NewReader(tt.content))
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+		})
+	}
+}
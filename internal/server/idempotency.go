@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/storage"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRecorder passes the response through while keeping a copy to store.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// requestFingerprint identifies what a request asks for, so that a key reused
+// for a different request can be told from a retry.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	// The query selects the merchant of order numbers on several routes.
+	h.Write([]byte(r.URL.RawQuery))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Idempotent replays the stored response of mutating requests repeated with the
+// same Idempotency-Key header within the configured window. Reusing a key for a
+// different request is rejected with 422. Requests without the header, read-only
+// requests and requests failing with 5xx are not remembered.
+// It must run after authentication, keys are scoped to the caller.
+func Idempotent(s Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if len(key) == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				http.Error(w, "Idempotency key is too long", http.StatusBadRequest)
+				return
+			}
+
+			// Both kinds of callers are prefixed, so no login can name the scope of a client.
+			var scope string
+			if login, _ := r.Context().Value(contextJWTLogin).(string); len(login) > 0 {
+				scope = "user:" + login
+			} else {
+				client, _ := r.Context().Value(contextAPIClient).(string)
+				scope = "client:" + client
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := requestFingerprint(r, body)
+
+			stored, err := s.repository.ReserveIdempotencyKey(r.Context(), scope, key, fingerprint,
+				s.config.Server.IdempotencyWindow, s.config.Server.IdempotencyLease)
+			if errors.Is(err, storage.ErrIdempotencyKeyBusy) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if stored != nil {
+				switch {
+				case stored.Fingerprint != fingerprint:
+					http.Error(w, "Idempotency key was used for another request", http.StatusUnprocessableEntity)
+				case !stored.Completed:
+					http.Error(w, "Request with this idempotency key is in progress", http.StatusConflict)
+				default:
+					if len(stored.ContentType) > 0 {
+						w.Header().Set("Content-Type", stored.ContentType)
+					}
+					w.Header().Set(idempotentReplayedHeader, "true")
+					w.WriteHeader(stored.StatusCode)
+					if _, err = w.Write(stored.Body); err != nil {
+						log.Trace("Log in prod")
+					}
+				}
+				return
+			}
+
+			recorder := &idempotencyRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			// The client may be gone by now, the outcome must be recorded anyway.
+			ctx := context.Background()
+			if recorder.statusCode == 0 || recorder.statusCode >= http.StatusInternalServerError {
+				err = s.repository.ReleaseIdempotencyKey(ctx, scope, key)
+			} else {
+				err = s.repository.SaveIdempotentResponse(ctx, scope, key, storage.IdempotentResponse{
+					Fingerprint: fingerprint,
+					Completed:   true,
+					StatusCode:  recorder.statusCode,
+					ContentType: recorder.Header().Get("Content-Type"),
+					Body:        recorder.body.Bytes(),
+				})
+			}
+			if err != nil {
+				log.Errorf("Failed to record idempotent response: %s", err)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"net"
 	"net/http"
 	"strings"
 
@@ -24,6 +26,48 @@ func DecompressGZIP(next http.Handler) http.Handler {
 	})
 }
 
+// RealIP sets the remote address to the client behind trusted proxies. The
+// forwarded chain is read from the right, so entries a client prepends are
+// never taken for its address.
+func RealIP(s Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.trustedProxy(clientAddress(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+			if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+				hops := strings.Split(forwarded, ",")
+				for i := len(hops) - 1; i >= 0; i-- {
+					client = strings.TrimSpace(hops[i])
+					if !s.trustedProxy(client) {
+						break
+					}
+				}
+			}
+			if net.ParseIP(client) != nil {
+				r.RemoteAddr = client
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s Server) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func CheckJWT(s Server) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -41,7 +85,7 @@ func CheckJWT(s Server) func(next http.Handler) http.Handler {
 			jwtToken := authParts[1]
 
 			token, err := jwt.ParseWithClaims(jwtToken, &AuthClaims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(s.config.JWTKey), nil
+				return []byte(s.config.Auth.JWTKey), nil
 			})
 			if err != nil || token == nil {
 				http.Error(w, "Malformed JWT", http.StatusUnauthorized)
@@ -60,3 +104,43 @@ func CheckJWT(s Server) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// CheckAPIKey authenticates trusted applications by their API key and requires the given scope.
+func CheckAPIKey(s Server, scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(apiKeyHeader)
+			if len(key) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			for _, client := range s.config.Auth.APIClients {
+				if subtle.ConstantTimeCompare([]byte(client.Key), []byte(key)) != 1 {
+					continue
+				}
+				if !client.HasScope(scope) {
+					http.Error(w, "API key lacks required scope", http.StatusForbidden)
+					return
+				}
+				ctx := context.WithValue(r.Context(), contextAPIClient, client.Name)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			http.Error(w, "Unknown API key", http.StatusUnauthorized)
+		})
+	}
+}
+
+// RequireClientCertificate demands a verified client certificate when mutual TLS is configured.
+func RequireClientCertificate(s Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(s.config.TLS.ClientCAFile) > 0 && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				http.Error(w, "Client certificate required", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/NYTimes/gziphandler"
@@ -12,9 +13,10 @@ func rootRouter(s Server) chi.Router {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(RealIP(s))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(RateLimit(s))
 
 	r.Use(DecompressGZIP)
 	r.Use(gziphandler.GzipHandler)
@@ -26,17 +28,77 @@ func rootRouter(s Server) chi.Router {
 		r.Mount("/", func(s Server) http.Handler {
 			ra := chi.NewRouter()
 			ra.Use(CheckJWT(s))
+			ra.Use(Idempotent(s))
 
 			ra.Post("/orders", uploadHandler(s))
+			ra.Post("/orders/batch", uploadBatchHandler(s))
 			ra.Get("/orders", listHandler(s))
+			ra.Get("/orders/events", orderEventsHandler(s))
 			ra.Get("/balance", balanceHandler(s))
+			ra.Get("/balance/history", balanceHistoryHandler(s))
+			ra.Post("/balance/holds", createHoldHandler(s))
+			ra.Post("/balance/holds/{id}/capture", captureHoldHandler(s))
+			ra.Post("/balance/holds/{id}/void", voidHoldHandler(s))
 			ra.Post("/balance/withdraw", withdrawHandler(s))
+			ra.Post("/balance/transfer", transferHandler(s))
+			ra.Post("/balance/transfers/{id}/confirm", confirmTransferHandler(s))
 			ra.Get("/withdrawals", withdrawalsHandler(s))
+			ra.Get("/profile", profileHandler(s))
+			ra.Get("/referrals", referralsHandler(s))
 
 			return ra
 		}(s))
 	})
 
+	if s.config.Accrual.WebhookEnabled() {
+		r.Post("/api/accrual/webhook", accrualWebhookHandler(s))
+		r.Post("/api/accrual/webhook/{merchant}", accrualWebhookHandler(s))
+	}
+
+	// Partner systems cancelling orders refund with a refunds scoped API key.
+	r.With(RequireClientCertificate(s), CheckAPIKey(s, scopeRefunds), Idempotent(s)).
+		Post("/api/withdrawals/{order}/refund", refundHandler(s))
+
+	// Client applications subscribe to the events of their merchants with a webhooks scoped API key.
+	r.Route("/api/webhooks", func(r chi.Router) {
+		r.Use(RequireClientCertificate(s))
+		r.Use(CheckAPIKey(s, scopeWebhooks))
+		r.Use(Idempotent(s))
+
+		r.Get("/", webhooksHandler(s))
+		r.Post("/", createWebhookHandler(s))
+		r.Delete("/{id}", deleteWebhookHandler(s))
+		r.Get("/{id}/deliveries", webhookDeliveriesHandler(s))
+	})
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(RequireClientCertificate(s))
+		r.Use(CheckAPIKey(s, scopeAdmin))
+		r.Use(Idempotent(s))
+
+		r.Get("/ping", pingHandler(s))
+		r.Handle("/metrics", expvar.Handler())
+
+		r.Get("/dead-letters", deadLettersHandler(s))
+		r.Post("/dead-letters/{number}/retry", retryDeadLetterHandler(s))
+		r.Post("/dead-letters/{number}/resolve", resolveDeadLetterHandler(s))
+
+		r.Post("/orders/{number}/reversal", reverseAccrualHandler(s))
+		r.Post("/withdrawals/{order}/refund", refundHandler(s))
+
+		r.Get("/campaigns", campaignsHandler(s))
+		r.Post("/campaigns", createCampaignHandler(s))
+		r.Post("/campaigns/dry-run", dryRunCampaignsHandler(s))
+		r.Get("/campaigns/{id}", campaignHandler(s))
+		r.Put("/campaigns/{id}", updateCampaignHandler(s))
+		r.Delete("/campaigns/{id}", deleteCampaignHandler(s))
+
+		r.Get("/merchants", merchantsHandler(s))
+		r.Post("/merchants", createMerchantHandler(s))
+		r.Get("/merchants/{code}", merchantHandler(s))
+		r.Put("/merchants/{code}", updateMerchantHandler(s))
+	})
+
 	r.MethodNotAllowed(badRequestHandler)
 	r.NotFound(badRequestHandler)
 
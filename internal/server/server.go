@@ -1,27 +1,114 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"regexp"
 
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/events"
 	"VladBag2022/gophermart/internal/storage"
+	"VladBag2022/gophermart/internal/webhooks"
 )
 
 type Server struct {
 	repository storage.Repository
-	config     *Config
+	config     *config.Config
+	limiter    *rateLimiter
+	events     *events.Bus
+	resolver   webhooks.Resolver
+	httpServer *http.Server
+
+	withdrawalFormats []*regexp.Regexp
+	trustedProxies    []*net.IPNet
+
+	redirectServer *http.Server
 }
 
-func NewServer(repository storage.Repository, config *Config) Server {
-	return Server{
+func NewServer(repository storage.Repository, config *config.Config) Server {
+	s := Server{
 		repository: repository,
 		config:     config,
+		limiter:    newRateLimiter(config.RateLimit),
+		events:     events.NewBus(config.Events.Buffer),
+		resolver:   net.DefaultResolver,
+	}
+	// Formats are checked by config validation.
+	for _, format := range config.Balance.WithdrawalOrderFormats {
+		s.withdrawalFormats = append(s.withdrawalFormats, regexp.MustCompile(format))
+	}
+	for _, proxy := range config.Server.TrustedProxies {
+		_, network, _ := net.ParseCIDR(proxy)
+		s.trustedProxies = append(s.trustedProxies, network)
+	}
+	s.httpServer = &http.Server{
+		Addr:         config.Server.Address,
+		ReadTimeout:  config.Server.ReadTimeout,
+		WriteTimeout: config.Server.WriteTimeout,
+		IdleTimeout:  config.Server.IdleTimeout,
+		ConnContext:  connContext,
+	}
+	if config.TLS.Enabled() && len(config.TLS.RedirectAddress) > 0 {
+		s.redirectServer = &http.Server{
+			Addr:         config.TLS.RedirectAddress,
+			Handler:      redirectHandler(config.Server.Address),
+			ReadTimeout:  config.Server.ReadTimeout,
+			WriteTimeout: config.Server.WriteTimeout,
+		}
+	}
+	return s
+}
+
+// connContext keeps the connection of requests, so that long-lived responses
+// can lift its write deadline.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, contextConn, conn)
+}
+
+// Events is the bus streams of users subscribe to.
+func (s Server) Events() *events.Bus {
+	return s.events
+}
+
+// ListenAndServer serves until Shutdown, returning why it could not serve otherwise.
+func (s Server) ListenAndServer() error {
+	s.httpServer.Handler = rootRouter(s)
+	if s.config.TLS.Enabled() {
+		return s.listenAndServeTLS()
+	}
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully stops accepting connections and waits for active requests.
+func (s Server) Shutdown(ctx context.Context) error {
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			return err
+		}
 	}
+	return s.httpServer.Shutdown(ctx)
 }
 
-func (s Server) ListenAndServer() {
-	if err := http.ListenAndServe(s.config.Address, rootRouter(s)); err != nil {
-		fmt.Println(err)
-		return
+// SetRateLimit applies new rate limits to subsequent requests.
+func (s Server) SetRateLimit(limit config.RateLimit) {
+	s.limiter.update(limit)
+}
+
+// knownWithdrawalOrder reports whether order matches a configured merchant format.
+// Any order is known when no formats are configured.
+func (s Server) knownWithdrawalOrder(order string) bool {
+	if len(s.withdrawalFormats) == 0 {
+		return true
+	}
+	for _, format := range s.withdrawalFormats {
+		if format.MatchString(order) {
+			return true
+		}
 	}
+	return false
 }
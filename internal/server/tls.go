@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+// certReloader serves the current key pair and reloads it once the files change on disk.
+type certReloader struct {
+	mu        sync.RWMutex
+	certFile  string
+	keyFile   string
+	interval  time.Duration
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert, modTime, due := r.cert, r.modTime, time.Since(r.lastCheck) > r.interval
+	r.mu.RUnlock()
+	if !due {
+		return cert, nil
+	}
+
+	r.mu.Lock()
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+
+	latest, err := r.filesModTime()
+	if err != nil || !latest.After(modTime) {
+		return cert, nil
+	}
+	if err = r.load(); err != nil {
+		// Files may be half-written during rotation, keep serving the old pair.
+		log.Errorf("Unable to reload TLS certificate: %s", err)
+		return cert, nil
+	}
+	log.Info("TLS certificate reloaded")
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func newTLSConfig(cfg config.TLS) (*tls.Config, error) {
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := config.CipherSuiteIDs(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     config.TLSVersions[cfg.MinVersion],
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if len(cfg.ClientCAFile) > 0 {
+		content, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// Client certificates are only demanded on admin and API key routes, see RequireClientCertificate.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// redirectHandler sends plain HTTP clients to the HTTPS listener.
+func redirectHandler(httpsAddress string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if len(httpsPort) > 0 && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// ConfigureTLS loads the key pair and client CAs, so that a broken TLS setup
+// stops startup instead of leaving the server without a listener.
+func (s Server) ConfigureTLS() error {
+	if !s.config.TLS.Enabled() {
+		return nil
+	}
+	tlsConfig, err := newTLSConfig(s.config.TLS)
+	if err != nil {
+		return fmt.Errorf("unable to configure TLS: %w", err)
+	}
+	s.httpServer.TLSConfig = tlsConfig
+	return nil
+}
+
+func (s Server) listenAndServeTLS() error {
+	if s.redirectServer != nil {
+		go func() {
+			rErr := s.redirectServer.ListenAndServe()
+			if rErr != nil && !errors.Is(rErr, http.ErrServerClosed) {
+				log.Error(rErr)
+			}
+		}()
+	}
+
+	err := s.httpServer.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
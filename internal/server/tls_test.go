@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/mocks"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := newCertReloader(certFile, keyFile, time.Nanosecond)
+	require.NoError(t, err)
+
+	cert, err := reloader.getCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "first", leaf.Subject.CommonName)
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+
+	cert, err = reloader.getCertificate(nil)
+	require.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		httpsAddress string
+		host         string
+		location     string
+	}{
+		{
+			name:         "custom port",
+			httpsAddress: "localhost:8443",
+			host:         "example.com:8080",
+			location:     "https://example.com:8443/api/user/orders?a=1",
+		},
+		{
+			name:         "default port",
+			httpsAddress: ":443",
+			host:         "example.com",
+			location:     "https://example.com/api/user/orders?a=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders?a=1", nil)
+			request.Host = tt.host
+			recorder := httptest.NewRecorder()
+
+			redirectHandler(tt.httpsAddress).ServeHTTP(recorder, request)
+
+			assert.Equal(t, http.StatusPermanentRedirect, recorder.Code)
+			assert.Equal(t, tt.location, recorder.Header().Get("Location"))
+		})
+	}
+}
+
+func TestServer_ConfigureTLS(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.TLS.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "key.pem")
+	assert.Error(t, NewServer(new(mocks.Repository), cfg).ConfigureTLS())
+
+	writeTestCertificate(t, cfg.TLS.CertFile, cfg.TLS.KeyFile, "gophermart")
+	assert.NoError(t, NewServer(new(mocks.Repository), cfg).ConfigureTLS())
+
+	cfg.TLS.ClientCAFile = filepath.Join(dir, "missing-ca.pem")
+	assert.Error(t, NewServer(new(mocks.Repository), cfg).ConfigureTLS())
+}
+
+func TestServer_apiKeyRoutesRequireClientCertificate(t *testing.T) {
+	cfg := config.Default()
+	cfg.TLS.ClientCAFile = "ca.pem"
+	cfg.Auth.APIClients = []config.APIClient{
+		{Name: "partner", Key: "partner-key", Scopes: []string{scopeRefunds, scopeWebhooks}},
+	}
+	router := rootRouter(NewServer(new(mocks.Repository), cfg))
+
+	for _, path := range []string{"/api/withdrawals/12345678903/refund", "/api/webhooks"} {
+		request := httptest.NewRequest(http.MethodPost, path, nil)
+		request.Header.Set(apiKeyHeader, "partner-key")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusForbidden, recorder.Code, path)
+	}
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const campaignColumns = "id, name, starts_at, ends_at, first_order, min_accrual, tier, multiplier, bonus, per_user_cap"
+
+// orderFacts is what campaign rules are evaluated against.
+type orderFacts struct {
+	accrual    float64
+	uploadedAt time.Time
+	firstOrder bool
+	tier       string
+}
+
+// scanCampaign reads campaignColumns followed by extra columns into extra.
+func scanCampaign(row pgx.Row, extra ...interface{}) (campaign CampaignInfo, err error) {
+	var (
+		startsAt time.Time
+		endsAt   *time.Time
+	)
+	dest := []interface{}{&campaign.ID, &campaign.Name, &startsAt, &endsAt, &campaign.FirstOrder,
+		&campaign.MinAccrual, &campaign.Tier, &campaign.Multiplier, &campaign.Bonus, &campaign.PerUserCap}
+	if err = row.Scan(append(dest, extra...)...); err != nil {
+		return CampaignInfo{}, err
+	}
+	campaign.StartsAt = startsAt.Format(time.RFC3339)
+	if endsAt != nil {
+		campaign.EndsAt = endsAt.Format(time.RFC3339)
+	}
+	return campaign, nil
+}
+
+// campaignWindow parses the window of a campaign, endsAt is nil when it is open-ended.
+func campaignWindow(campaign CampaignInfo) (startsAt time.Time, endsAt *time.Time, err error) {
+	if startsAt, err = time.Parse(time.RFC3339, campaign.StartsAt); err != nil {
+		return startsAt, nil, fmt.Errorf("bad campaign start: %w", err)
+	}
+	if len(campaign.EndsAt) == 0 {
+		return startsAt.UTC(), nil, nil
+	}
+	end, err := time.Parse(time.RFC3339, campaign.EndsAt)
+	if err != nil {
+		return startsAt, nil, fmt.Errorf("bad campaign end: %w", err)
+	}
+	end = end.UTC()
+	return startsAt.UTC(), &end, nil
+}
+
+// evaluate returns the bonus campaign grants for an order, or why it grants
+// none. granted is what the campaign has already granted the order owner.
+func evaluate(campaign CampaignInfo, facts orderFacts, granted float64) CampaignEvaluation {
+	evaluation := CampaignEvaluation{CampaignID: campaign.ID, Name: campaign.Name}
+	startsAt, endsAt, err := campaignWindow(campaign)
+	switch {
+	case err != nil:
+		evaluation.Reason = err.Error()
+	case facts.uploadedAt.Before(startsAt) || (endsAt != nil && !facts.uploadedAt.Before(*endsAt)):
+		evaluation.Reason = "order uploaded outside the campaign window"
+	case campaign.FirstOrder && !facts.firstOrder:
+		evaluation.Reason = "not the first processed order"
+	case facts.accrual < campaign.MinAccrual:
+		evaluation.Reason = "accrual below the campaign minimum"
+	case len(campaign.Tier) > 0 && campaign.Tier != facts.tier:
+		evaluation.Reason = "tier does not match"
+	}
+	if len(evaluation.Reason) > 0 {
+		return evaluation
+	}
+
+	bonus := campaign.Bonus
+	if campaign.Multiplier > 0 {
+		bonus += facts.accrual * (campaign.Multiplier - 1)
+	}
+	if campaign.PerUserCap > 0 {
+		bonus = math.Min(bonus, math.Max(campaign.PerUserCap-granted, 0))
+		if bonus <= 0 {
+			evaluation.Reason = "per-user cap reached"
+			return evaluation
+		}
+	}
+	if bonus <= 0 {
+		evaluation.Reason = "no bonus for the accrual"
+		return evaluation
+	}
+	evaluation.Eligible = true
+	evaluation.Bonus = bonus
+	return evaluation
+}
+
+// factsOf collects the facts of order for campaign rules.
+func factsOf(
+	ctx context.Context,
+	q querier,
+	userID int,
+	order int64,
+	accrual float64,
+	uploadedAt time.Time,
+) (facts orderFacts, err error) {
+	facts.accrual = accrual
+	facts.uploadedAt = uploadedAt
+	err = q.QueryRow(ctx,
+		"SELECT tier, NOT EXISTS (SELECT 1 FROM orders "+
+			"WHERE user_id = users.id AND status = 'PROCESSED' AND id <> $2) FROM users WHERE id = $1",
+		userID, order).Scan(&facts.tier, &facts.firstOrder)
+	return facts, err
+}
+
+// evaluateCampaigns evaluates every campaign that is not deleted against an order of the user.
+func evaluateCampaigns(
+	ctx context.Context,
+	q querier,
+	userID int,
+	facts orderFacts,
+) (evaluations []CampaignEvaluation, err error) {
+	rows, err := q.Query(ctx,
+		"SELECT "+campaignColumns+", "+
+			"(SELECT COALESCE(SUM(amount), 0) FROM bonuses WHERE campaign_id = campaigns.id AND user_id = $1) "+
+			"FROM campaigns WHERE deleted_at IS NULL ORDER BY id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var granted float64
+		campaign, sErr := scanCampaign(rows, &granted)
+		if sErr != nil {
+			return nil, sErr
+		}
+		evaluations = append(evaluations, evaluate(campaign, facts, granted))
+	}
+	return evaluations, rows.Err()
+}
+
+// creditAccrual credits a processed accrual together with the campaign and
+// referral bonuses it earns.
+func creditAccrual(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID int,
+	order int64,
+	accrual float64,
+	uploadedAt time.Time,
+) error {
+	if accrual > 0 {
+		if err := creditLot(ctx, tx, userID, order, accrual); err != nil {
+			return err
+		}
+	}
+
+	// Locking the user serializes bonuses of concurrently processed orders so that caps hold.
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return err
+	}
+	facts, err := factsOf(ctx, tx, userID, order, accrual, uploadedAt)
+	if err != nil {
+		return err
+	}
+	evaluations, err := evaluateCampaigns(ctx, tx, userID, facts)
+	if err != nil {
+		return err
+	}
+	for _, evaluation := range evaluations {
+		if !evaluation.Eligible {
+			continue
+		}
+		tag, err := tx.Exec(ctx,
+			"INSERT INTO bonuses (campaign_id, order_id, user_id, amount) VALUES ($1, $2, $3, $4) "+
+				"ON CONFLICT (campaign_id, order_id) DO NOTHING",
+			evaluation.CampaignID, order, userID, evaluation.Bonus)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			continue
+		}
+		if err = creditLot(ctx, tx, userID, order, evaluation.Bonus); err != nil {
+			return err
+		}
+	}
+	return rewardReferral(ctx, tx, userID, order)
+}
+
+func (p *PostgresRepository) CreateCampaign(
+	ctx context.Context,
+	campaign CampaignInfo,
+) (CampaignInfo, error) {
+	startsAt, endsAt, err := campaignWindow(campaign)
+	if err != nil {
+		return CampaignInfo{}, err
+	}
+	return scanCampaign(p.pool.QueryRow(ctx,
+		"INSERT INTO campaigns (name, starts_at, ends_at, first_order, min_accrual, tier, multiplier, bonus, "+
+			"per_user_cap) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING "+campaignColumns,
+		campaign.Name, startsAt, endsAt, campaign.FirstOrder, campaign.MinAccrual, campaign.Tier,
+		campaign.Multiplier, campaign.Bonus, campaign.PerUserCap))
+}
+
+func (p *PostgresRepository) Campaigns(
+	ctx context.Context,
+) (campaigns []CampaignInfo, err error) {
+	rows, err := p.pool.Query(ctx,
+		"SELECT "+campaignColumns+" FROM campaigns WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		campaign, sErr := scanCampaign(rows)
+		if sErr != nil {
+			return nil, sErr
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns, rows.Err()
+}
+
+func (p *PostgresRepository) Campaign(
+	ctx context.Context,
+	id int64,
+) (CampaignInfo, error) {
+	campaign, err := scanCampaign(p.pool.QueryRow(ctx,
+		"SELECT "+campaignColumns+" FROM campaigns WHERE id = $1 AND deleted_at IS NULL", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return CampaignInfo{}, ErrCampaignNotFound
+	}
+	return campaign, err
+}
+
+func (p *PostgresRepository) UpdateCampaign(
+	ctx context.Context,
+	campaign CampaignInfo,
+) (CampaignInfo, error) {
+	startsAt, endsAt, err := campaignWindow(campaign)
+	if err != nil {
+		return CampaignInfo{}, err
+	}
+	updated, err := scanCampaign(p.pool.QueryRow(ctx,
+		"UPDATE campaigns SET name = $2, starts_at = $3, ends_at = $4, first_order = $5, min_accrual = $6, "+
+			"tier = $7, multiplier = $8, bonus = $9, per_user_cap = $10 "+
+			"WHERE id = $1 AND deleted_at IS NULL RETURNING "+campaignColumns,
+		campaign.ID, campaign.Name, startsAt, endsAt, campaign.FirstOrder, campaign.MinAccrual, campaign.Tier,
+		campaign.Multiplier, campaign.Bonus, campaign.PerUserCap))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return CampaignInfo{}, ErrCampaignNotFound
+	}
+	return updated, err
+}
+
+func (p *PostgresRepository) DeleteCampaign(
+	ctx context.Context,
+	id int64,
+) error {
+	tag, err := p.pool.Exec(ctx,
+		"UPDATE campaigns SET deleted_at = Now() WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrCampaignNotFound
+	}
+	return nil
+}
+
+func (p *PostgresRepository) DryRunCampaigns(
+	ctx context.Context,
+	order int64,
+	accrual float64,
+) (evaluations []CampaignEvaluation, err error) {
+	var (
+		userID     int
+		current    float64
+		uploadedAt time.Time
+	)
+	err = p.pool.QueryRow(ctx,
+		"SELECT user_id, COALESCE(accrual, 0), uploaded_at FROM orders WHERE id = $1",
+		order).Scan(&userID, &current, &uploadedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if accrual == 0 {
+		accrual = current
+	}
+
+	facts, err := factsOf(ctx, p.pool, userID, order, accrual, uploadedAt)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateCampaigns(ctx, p.pool, userID, facts)
+}
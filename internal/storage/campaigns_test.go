@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluate(t *testing.T) {
+	weekend := CampaignInfo{
+		ID:         1,
+		Name:       "double points",
+		StartsAt:   "2026-10-17T00:00:00Z",
+		EndsAt:     "2026-10-19T00:00:00Z",
+		Multiplier: 2,
+	}
+	saturday := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		campaign CampaignInfo
+		facts    orderFacts
+		granted  float64
+		bonus    float64
+		reason   string
+	}{
+		{
+			name:     "positive test - multiplier",
+			campaign: weekend,
+			facts:    orderFacts{accrual: 500, uploadedAt: saturday},
+			bonus:    500,
+		},
+		{
+			name:     "negative test - outside the window",
+			campaign: weekend,
+			facts:    orderFacts{accrual: 500, uploadedAt: saturday.Add(48 * time.Hour)},
+			reason:   "order uploaded outside the campaign window",
+		},
+		{
+			name: "positive test - first order bonus",
+			campaign: CampaignInfo{
+				Name: "welcome", StartsAt: "2026-01-01T00:00:00Z", FirstOrder: true, Bonus: 100,
+			},
+			facts: orderFacts{uploadedAt: saturday, firstOrder: true},
+			bonus: 100,
+		},
+		{
+			name: "negative test - not the first order",
+			campaign: CampaignInfo{
+				Name: "welcome", StartsAt: "2026-01-01T00:00:00Z", FirstOrder: true, Bonus: 100,
+			},
+			facts:  orderFacts{uploadedAt: saturday},
+			reason: "not the first processed order",
+		},
+		{
+			name: "negative test - minimum accrual and tier",
+			campaign: CampaignInfo{
+				Name: "gold", StartsAt: "2026-01-01T00:00:00Z", MinAccrual: 100, Tier: "gold", Bonus: 50,
+			},
+			facts:  orderFacts{accrual: 200, uploadedAt: saturday, tier: "silver"},
+			reason: "tier does not match",
+		},
+		{
+			name: "positive test - capped",
+			campaign: CampaignInfo{
+				Name: "capped", StartsAt: "2026-01-01T00:00:00Z", Multiplier: 3, PerUserCap: 1000,
+			},
+			facts:   orderFacts{accrual: 400, uploadedAt: saturday},
+			granted: 700,
+			bonus:   300,
+		},
+		{
+			name: "negative test - cap reached",
+			campaign: CampaignInfo{
+				Name: "capped", StartsAt: "2026-01-01T00:00:00Z", Multiplier: 3, PerUserCap: 1000,
+			},
+			facts:   orderFacts{accrual: 400, uploadedAt: saturday},
+			granted: 1000,
+			reason:  "per-user cap reached",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evaluation := evaluate(tt.campaign, tt.facts, tt.granted)
+			assert.Equal(t, len(tt.reason) == 0, evaluation.Eligible)
+			assert.Equal(t, tt.reason, evaluation.Reason)
+			assert.Equal(t, tt.bonus, evaluation.Bonus)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// eventsChannel is the notification channel events reach every instance on.
+const eventsChannel = "gophermart_events"
+
+// Event types.
+const (
+	EventOrder   = "order"
+	EventBalance = "balance"
+)
+
+// Event is a change of an order status or of the balance of a user. Balance
+// events only tell that the balance changed.
+type Event struct {
+	Type     string  `json:"type"`
+	Login    string  `json:"login"`
+	Order    string  `json:"order,omitempty"`
+	Merchant string  `json:"merchant,omitempty"`
+	Status   string  `json:"status,omitempty"`
+	Accrual  float64 `json:"accrual,omitempty"`
+}
+
+// notify publishes event once tx commits, queueing it for the webhooks subscribed
+// to its type that may see it.
+func notify(ctx context.Context, tx pgx.Tx, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "SELECT pg_notify($1, $2)", eventsChannel, string(payload)); err != nil {
+		return err
+	}
+	// Balance events concern no merchant, only subscriptions to every merchant get them.
+	var merchant *string
+	if event.Type == EventOrder {
+		code := event.Merchant
+		if len(code) == 0 {
+			code = DefaultMerchant
+		}
+		merchant = &code
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO webhook_deliveries (subscription_id, event, payload) "+
+			"SELECT id, $1, $2 FROM webhook_subscriptions "+
+			"WHERE $1 = ANY (events) AND (merchants IS NULL OR $3 = ANY (merchants))",
+		event.Type, string(payload), merchant)
+	return err
+}
+
+// notifyOrder publishes the status of order, and a balance change once it is processed.
+func notifyOrder(ctx context.Context, tx pgx.Tx, order int64) error {
+	event := Event{Type: EventOrder}
+	var accrual *float64
+	err := tx.QueryRow(ctx,
+		"SELECT users.login, orders.number, merchants.code, orders.status, orders.accrual FROM orders "+
+			"JOIN users ON users.id = orders.user_id JOIN merchants ON merchants.id = orders.merchant_id "+
+			"WHERE orders.id = $1",
+		order).Scan(&event.Login, &event.Order, &event.Merchant, &event.Status, &accrual)
+	if err != nil {
+		return err
+	}
+	if event.Merchant == DefaultMerchant {
+		event.Merchant = ""
+	}
+	if accrual != nil {
+		event.Accrual = *accrual
+	}
+	if err = notify(ctx, tx, event); err != nil {
+		return err
+	}
+	if event.Status == "PROCESSED" {
+		return notify(ctx, tx, Event{Type: EventBalance, Login: event.Login})
+	}
+	return nil
+}
+
+func (p *PostgresRepository) ListenEvents(
+	ctx context.Context,
+	handle func(Event),
+) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// A listening connection must not go back to the pool as is.
+		if !conn.Conn().IsClosed() {
+			_, _ = conn.Exec(context.Background(), "UNLISTEN *")
+		}
+		conn.Release()
+	}()
+
+	if _, err = conn.Exec(ctx, "LISTEN "+eventsChannel); err != nil {
+		return err
+	}
+	for {
+		notification, wErr := conn.Conn().WaitForNotification(ctx)
+		if wErr != nil {
+			return wErr
+		}
+		var event Event
+		if json.Unmarshal([]byte(notification.Payload), &event) != nil {
+			continue
+		}
+		handle(event)
+	}
+}
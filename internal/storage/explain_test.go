@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/require"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+const (
+	explainUsers         = 20_000
+	explainOrdersPerUser = 25
+)
+
+// newTestRepository migrates a throwaway schema in DATABASE_URI, named after
+// prefix, and skips the test when no database is configured.
+func newTestRepository(t *testing.T, prefix string) *PostgresRepository {
+	uri := os.Getenv("DATABASE_URI")
+	if len(uri) == 0 {
+		t.Skip("DATABASE_URI is not set")
+	}
+	ctx := context.Background()
+
+	schema := fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
+	admin, err := pgxpool.Connect(ctx, uri)
+	require.NoError(t, err)
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close()
+	})
+
+	cfg := config.Default().Database
+	cfg.URI = uri
+	poolConfig, err := newPoolConfig(cfg)
+	require.NoError(t, err)
+	poolConfig.ConnConfig.RuntimeParams["search_path"] = schema + ",public"
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	require.NoError(t, err)
+
+	p := &PostgresRepository{
+		pool:     pool,
+		replicas: newReplicaSet(nil, 0, 0),
+		cancel:   func() {},
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	require.NoError(t, p.migrate(ctx))
+	return p
+}
+
+// newExplainRepository seeds a throwaway schema with a dataset large enough
+// for the planner to prefer indexes where they apply.
+func newExplainRepository(t *testing.T) *PostgresRepository {
+	p := newTestRepository(t, "explain_test")
+
+	seed := []string{
+		fmt.Sprintf("INSERT INTO users (login, password) "+
+			"SELECT 'user-' || n, 'x' FROM generate_series(1, %d) AS n", explainUsers),
+		// Almost every order is final, as in a long-running installation.
+		fmt.Sprintf("INSERT INTO orders (id, number, user_id, uploaded_at, status, accrual) "+
+			"SELECT n, n::text, 1 + n %% %d, Now() - n * interval '1 second', "+
+			"CASE WHEN n %% 1000 = 0 THEN 'PROCESSING' WHEN n %% 10 = 0 THEN 'INVALID' ELSE 'PROCESSED' END, "+
+			"n %% 500 FROM generate_series(1, %d) AS n", explainUsers, explainUsers*explainOrdersPerUser),
+		fmt.Sprintf("INSERT INTO withdrawals (order_number, user_id, amount) "+
+			"SELECT (%d + n)::text, 1 + n %% %d, 10 FROM generate_series(1, %d) AS n",
+			explainUsers*explainOrdersPerUser, explainUsers, explainUsers),
+		"INSERT INTO adjustments (order_id, user_id, amount, reason) " +
+			"SELECT id, user_id, -1, 'return' FROM orders WHERE id % 100 = 0 AND status = 'PROCESSED'",
+		fmt.Sprintf("INSERT INTO holds (user_id, order_id, amount, expires_at) "+
+			"SELECT 1 + n %% %d, (%d + n)::text, 1, Now() + interval '1 hour' FROM generate_series(1, %d) AS n",
+			explainUsers, 2*explainUsers*explainOrdersPerUser, explainUsers),
+		"INSERT INTO refunds (order_id, user_id, amount, reference) " +
+			"SELECT order_number, user_id, 1, 'refund-' || order_number FROM withdrawals",
+		"INSERT INTO campaigns (name, starts_at, bonus) VALUES ('welcome', Now() - interval '1 year', 10)",
+		"INSERT INTO bonuses (campaign_id, order_id, user_id, amount) " +
+			"SELECT 1, id, user_id, 10 FROM orders WHERE id % 50 = 1 AND status = 'PROCESSED'",
+		fmt.Sprintf("INSERT INTO transfers (sender_id, recipient_id, amount, status, completed_at) "+
+			"SELECT n, 1 + n %% %d, 5, 'COMPLETED', Now() FROM generate_series(1, %d) AS n",
+			explainUsers, explainUsers),
+		fmt.Sprintf("INSERT INTO referrals (referrer_id, referee_id, status, referrer_bonus, referee_bonus, "+
+			"order_id, rewarded_at) SELECT 1 + (n + 1) %% %d, n, 'REWARDED', 100, 50, n, Now() "+
+			"FROM generate_series(1, %d, 10) AS n", explainUsers, explainUsers),
+		// Most lots are spent, a few ran out.
+		"INSERT INTO lots (user_id, order_id, amount, remaining, created_at) " +
+			"SELECT user_id, id, accrual, CASE WHEN id % 20 = 0 THEN accrual ELSE 0 END, uploaded_at " +
+			"FROM orders WHERE status = 'PROCESSED' AND accrual > 0",
+		"INSERT INTO expirations (lot_id, user_id, amount) " +
+			"SELECT id, user_id, amount FROM lots WHERE order_id % 1000 = 1",
+		"VACUUM ANALYZE users",
+		"VACUUM ANALYZE orders",
+		"VACUUM ANALYZE adjustments",
+		"VACUUM ANALYZE holds",
+		"VACUUM ANALYZE withdrawals",
+		"VACUUM ANALYZE refunds",
+		"VACUUM ANALYZE bonuses",
+		"VACUUM ANALYZE transfers",
+		"VACUUM ANALYZE referrals",
+		"VACUUM ANALYZE lots",
+		"VACUUM ANALYZE expirations",
+	}
+	for _, statement := range seed {
+		_, err := p.pool.Exec(context.Background(), statement)
+		require.NoError(t, err)
+	}
+	return p
+}
+
+type planNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name"`
+	Plans        []planNode `json:"Plans"`
+}
+
+// referenceTables hold a handful of rows, scanning them beats any index.
+var referenceTables = map[string]bool{"campaigns": true, "merchants": true}
+
+func (n planNode) seqScans() []string {
+	var scans []string
+	if n.NodeType == "Seq Scan" && !referenceTables[n.RelationName] {
+		scans = append(scans, n.RelationName)
+	}
+	for _, child := range n.Plans {
+		scans = append(scans, child.seqScans()...)
+	}
+	return scans
+}
+
+func TestHotQueries_noSeqScan(t *testing.T) {
+	p := newExplainRepository(t)
+
+	tests := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{name: "OrderOwner", query: queryOrderOwner, args: []interface{}{DefaultMerchant, "4242"}},
+		{name: "Orders", query: queryOrders, args: []interface{}{"user-42"}},
+		{name: "AccrualOrders", query: queryAccrualOrders, args: []interface{}{time.Duration(0)}},
+		{name: "Balance", query: queryBalance, args: []interface{}{"user-42"}},
+		{name: "Adjustments", query: queryAdjustments, args: []interface{}{"user-42"}},
+		{name: "BalanceHistory", query: queryBalanceHistory, args: []interface{}{"user-42"}},
+		{name: "Refunds", query: queryRefunds, args: []interface{}{"user-42"}},
+		{name: "Withdrawals", query: queryWithdrawals, args: []interface{}{"user-42"}},
+		{name: "ExpiringLots", query: queryExpiringLots,
+			args: []interface{}{"user-42", 365 * 24 * time.Hour, 30 * 24 * time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content []byte
+			err := p.pool.QueryRow(context.Background(), "EXPLAIN (FORMAT JSON) "+tt.query, tt.args...).
+				Scan(&content)
+			require.NoError(t, err)
+
+			var plans []struct {
+				Plan planNode `json:"Plan"`
+			}
+			require.NoError(t, json.Unmarshal(content, &plans))
+			require.Len(t, plans, 1)
+			require.Empty(t, plans[0].Plan.seqScans(), "plan: %s", content)
+		})
+	}
+}
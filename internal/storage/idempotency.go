@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// IdempotentResponse is what was stored for an Idempotency-Key.
+// Completed is false while the first request is still being handled.
+type IdempotentResponse struct {
+	Fingerprint string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+func (p *PostgresRepository) ReserveIdempotencyKey(
+	ctx context.Context,
+	scope, key, fingerprint string,
+	window, lease time.Duration,
+) (stored *IdempotentResponse, err error) {
+	// A reservation left behind by a crashed instance is given up after lease.
+	_, err = p.pool.Exec(ctx,
+		"DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 "+
+			"AND (created_at <= Now() - $3::interval OR (NOT completed AND created_at <= Now() - $4::interval))",
+		scope, key, window, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := p.pool.Exec(ctx,
+		"INSERT INTO idempotency_keys (scope, key, fingerprint) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (scope, key) DO NOTHING",
+		scope, key, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, nil
+	}
+
+	stored = &IdempotentResponse{}
+	err = p.pool.QueryRow(ctx,
+		"SELECT fingerprint, completed, status_code, content_type, body FROM idempotency_keys "+
+			"WHERE scope = $1 AND key = $2",
+		scope, key).Scan(&stored.Fingerprint, &stored.Completed, &stored.StatusCode, &stored.ContentType, &stored.Body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released between the insert and the select, let the caller retry.
+		return nil, ErrIdempotencyKeyBusy
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (p *PostgresRepository) SaveIdempotentResponse(
+	ctx context.Context,
+	scope, key string,
+	response IdempotentResponse,
+) error {
+	_, err := p.pool.Exec(ctx,
+		"UPDATE idempotency_keys SET completed = TRUE, status_code = $3, content_type = $4, body = $5 "+
+			"WHERE scope = $1 AND key = $2",
+		scope, key, response.StatusCode, response.ContentType, response.Body)
+	return err
+}
+
+func (p *PostgresRepository) ReleaseIdempotencyKey(
+	ctx context.Context,
+	scope, key string,
+) error {
+	_, err := p.pool.Exec(ctx,
+		"DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND NOT completed",
+		scope, key)
+	return err
+}
+
+func (p *PostgresRepository) PurgeIdempotencyKeys(
+	ctx context.Context,
+	window time.Duration,
+) (purged int64, err error) {
+	tag, err := p.pool.Exec(ctx,
+		"DELETE FROM idempotency_keys WHERE created_at <= Now() - $1::interval",
+		window)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
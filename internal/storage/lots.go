@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// queryExpiringLots lists open lots of a user running out within a notice period.
+const queryExpiringLots = "SELECT remaining, created_at + $2::interval FROM lots " +
+	"WHERE user_id = (SELECT id FROM users WHERE login = $1) AND remaining > 0 " +
+	"AND created_at <= Now() - $2::interval + $3::interval ORDER BY created_at, id"
+
+// creditLot records amount credited to the user by order as a new lot. The
+// credit must already count in the balance.
+func creditLot(ctx context.Context, tx pgx.Tx, userID int, order int64, amount float64) error {
+	room, err := lotRoom(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	return insertLot(ctx, tx, userID, order, amount, room, nil)
+}
+
+// lotRoom is how much of new credits the lots of the user may hold: what the
+// balance has beyond its open lots. Credits pay off debt the lots did not
+// cover first, otherwise expiring them would take those points a second time.
+func lotRoom(ctx context.Context, tx pgx.Tx, userID int) (float64, error) {
+	var (
+		login string
+		open  float64
+	)
+	err := tx.QueryRow(ctx,
+		"SELECT login, (SELECT COALESCE(SUM(remaining), 0) FROM lots WHERE user_id = $1 AND remaining > 0) "+
+			"FROM users WHERE id = $1",
+		userID).Scan(&login, &open)
+	if err != nil {
+		return 0, err
+	}
+	balance, err := scanBalance(tx.QueryRow(ctx, queryBalance, login))
+	if err != nil {
+		return 0, err
+	}
+	// Held points are still the user's until captured.
+	return balance.Current + balance.Held - open, nil
+}
+
+// insertLot records a lot of amount, of which no more than room is left to
+// spend. It is created now unless createdAt is set.
+func insertLot(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID int,
+	order int64,
+	amount, room float64,
+	createdAt *time.Time,
+) error {
+	remaining := amount
+	// Lots are stored as REAL, room is compared at that precision.
+	if float32(room) < float32(amount) {
+		remaining = math.Max(room, 0)
+	}
+	_, err := tx.Exec(ctx,
+		"INSERT INTO lots (user_id, order_id, amount, remaining, created_at) "+
+			"VALUES ($1, $2, $3, $4, COALESCE($5::timestamp, Now()))",
+		userID, order, amount, remaining, createdAt)
+	return err
+}
+
+// spentLot is points taken from a lot.
+type spentLot struct {
+	amount    float64
+	createdAt time.Time
+}
+
+// spendLots takes amount from the open lots of the user, oldest first. Lots of
+// order go first when it is set, so that a reversal cancels its own accrual.
+// What the lots do not cover is left as debt of the balance.
+func spendLots(ctx context.Context, tx pgx.Tx, userID int, amount float64, order *int64) (spent []spentLot, err error) {
+	rows, err := tx.Query(ctx,
+		"SELECT id, remaining, created_at FROM lots WHERE user_id = $1 AND remaining > 0 "+
+			"ORDER BY order_id IS NOT DISTINCT FROM $2::bigint DESC, created_at, id FOR UPDATE",
+		userID, order)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() && amount > 0 {
+		var (
+			id        int64
+			remaining float64
+			createdAt time.Time
+		)
+		if err = rows.Scan(&id, &remaining, &createdAt); err != nil {
+			return nil, err
+		}
+		taken := math.Min(remaining, amount)
+		ids = append(ids, id)
+		spent = append(spent, spentLot{amount: taken, createdAt: createdAt})
+		amount -= taken
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		if _, err = tx.Exec(ctx,
+			"UPDATE lots SET remaining = GREATEST(remaining - $2, 0) WHERE id = $1", id, spent[i].amount); err != nil {
+			return nil, err
+		}
+	}
+	return spent, nil
+}
+
+// lotsShort tells whether spent lots fall short of amount. Lots and holds are
+// stored as REAL, so they are compared at that precision.
+func lotsShort(spent []spentLot, amount float64) bool {
+	var covered float32
+	for _, lot := range spent {
+		covered += float32(lot.amount)
+	}
+	return covered < float32(amount)
+}
+
+// creditSpentLots credits amount spent by another user to the user. Spent lots
+// keep their age so that passing points around does not postpone their expiry,
+// what they did not cover is credited as a new lot.
+func creditSpentLots(ctx context.Context, tx pgx.Tx, userID int, spent []spentLot, amount float64) error {
+	room, err := lotRoom(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	uncovered := amount
+	for _, lot := range spent {
+		createdAt := lot.createdAt
+		if err = insertLot(ctx, tx, userID, 0, lot.amount, room, &createdAt); err != nil {
+			return err
+		}
+		room -= lot.amount
+		uncovered -= lot.amount
+	}
+	if !lotsShort(spent, amount) {
+		return nil
+	}
+	return insertLot(ctx, tx, userID, 0, uncovered, room, nil)
+}
+
+func (p *PostgresRepository) ExpirePoints(
+	ctx context.Context,
+	ttl time.Duration,
+) (lots int64, points float64, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	rows, err := tx.Query(ctx,
+		"WITH expired AS ("+
+			"UPDATE lots SET remaining = 0 FROM ("+
+			"SELECT id, remaining FROM lots WHERE remaining > 0 AND created_at <= Now() - $1::interval "+
+			"FOR UPDATE) old "+
+			"WHERE lots.id = old.id RETURNING lots.id, lots.user_id, old.remaining), "+
+			"posted AS (INSERT INTO expirations (lot_id, user_id, amount) "+
+			"SELECT id, user_id, remaining FROM expired RETURNING user_id, amount) "+
+			"SELECT users.login, COUNT(*), SUM(posted.amount) FROM posted "+
+			"JOIN users ON users.id = posted.user_id GROUP BY users.login",
+		ttl)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var logins []string
+	for rows.Next() {
+		var (
+			login      string
+			userLots   int64
+			userPoints float64
+		)
+		if err = rows.Scan(&login, &userLots, &userPoints); err != nil {
+			return 0, 0, err
+		}
+		logins = append(logins, login)
+		lots += userLots
+		points += userPoints
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	rows.Close()
+
+	for _, login := range logins {
+		if err = notify(ctx, tx, Event{Type: EventBalance, Login: login}); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return 0, 0, err
+	}
+	return lots, points, nil
+}
+
+func (p *PostgresRepository) ExpiringPoints(
+	ctx context.Context,
+	login string,
+	ttl, notice time.Duration,
+) (expiring []ExpiringInfo, err error) {
+	err = p.read(ctx, login, func(q querier) error {
+		expiring = nil
+		rows, qErr := q.Query(ctx, queryExpiringLots, login, ttl, notice)
+		if qErr != nil {
+			return qErr
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				info      ExpiringInfo
+				expiresAt time.Time
+			)
+			if qErr = rows.Scan(&info.Amount, &expiresAt); qErr != nil {
+				return qErr
+			}
+			info.ExpiresAt = expiresAt.Format(time.RFC3339)
+			expiring = append(expiring, info)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expiring, nil
+}
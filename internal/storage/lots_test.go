@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+func Test_lotsShort(t *testing.T) {
+	assert.False(t, lotsShort([]spentLot{{amount: 60}, {amount: 40}}, 100))
+	assert.False(t, lotsShort([]spentLot{{amount: float64(float32(0.1))}, {amount: float64(float32(0.2))}}, 0.3))
+	assert.True(t, lotsShort([]spentLot{{amount: 60}}, 100))
+	assert.True(t, lotsShort(nil, 100))
+}
+
+func TestPostgresRepository_expireAfterDebt(t *testing.T) {
+	p := newTestRepository(t, "lots_test")
+	ctx := context.Background()
+	const login = "debtor"
+
+	accrue := func(number string) int64 {
+		require.NoError(t, p.UploadOrder(ctx, login, DefaultMerchant, number))
+		var order int64
+		require.NoError(t, p.pool.QueryRow(ctx, "SELECT id FROM orders WHERE number = $1", number).Scan(&order))
+		require.NoError(t, p.UpdateOrder(ctx, order, "PROCESSED", 100))
+		return order
+	}
+	balance := func() float64 {
+		info, err := p.Balance(ctx, login)
+		require.NoError(t, err)
+		return info.Current
+	}
+
+	require.NoError(t, p.Register(ctx, login, "secret", "", "127.0.0.1", config.Default().Referrals))
+	order := accrue("12345678903")
+	require.NoError(t, p.Withdraw(ctx, login, "2377225624", 100))
+	_, err := p.ReverseAccrual(ctx, order, 100, "return", true)
+	require.NoError(t, err)
+	assert.InDelta(t, -100, balance(), 0.001)
+
+	// The accrual pays off the debt, its lot has nothing left to expire.
+	accrue("79927398713")
+	assert.InDelta(t, 0, balance(), 0.001)
+
+	_, err = p.pool.Exec(ctx, "UPDATE lots SET created_at = Now() - interval '2 days'")
+	require.NoError(t, err)
+	_, points, err := p.ExpirePoints(ctx, 24*time.Hour)
+	require.NoError(t, err)
+	assert.InDelta(t, 0, points, 0.001)
+	assert.InDelta(t, 0, balance(), 0.001)
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+const merchantColumns = "code, name, number_pattern, check_digit, accrual_address, created_at"
+
+func scanMerchant(row pgx.Row) (merchant MerchantInfo, err error) {
+	var createdAt time.Time
+	err = row.Scan(&merchant.Code, &merchant.Name, &merchant.NumberPattern, &merchant.CheckDigit,
+		&merchant.AccrualAddress, &createdAt)
+	if err != nil {
+		return MerchantInfo{}, err
+	}
+	merchant.CreatedAt = createdAt.Format(time.RFC3339)
+	return merchant, nil
+}
+
+func (p *PostgresRepository) OrderID(
+	ctx context.Context,
+	merchant, number string,
+) (id int64, err error) {
+	err = p.pool.QueryRow(ctx,
+		"SELECT id FROM orders WHERE merchant_id = (SELECT id FROM merchants WHERE code = $1) AND number = $2",
+		merchant, number).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrOrderNotFound
+	}
+	return id, err
+}
+
+func (p *PostgresRepository) CreateMerchant(
+	ctx context.Context,
+	merchant MerchantInfo,
+) (MerchantInfo, error) {
+	created, err := scanMerchant(p.pool.QueryRow(ctx,
+		"INSERT INTO merchants (code, name, number_pattern, check_digit, accrual_address) "+
+			"VALUES ($1, $2, $3, $4, $5) RETURNING "+merchantColumns,
+		merchant.Code, merchant.Name, merchant.NumberPattern, merchant.CheckDigit, merchant.AccrualAddress))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return MerchantInfo{}, ErrMerchantExists
+	}
+	return created, err
+}
+
+func (p *PostgresRepository) Merchants(
+	ctx context.Context,
+) (merchants []MerchantInfo, err error) {
+	rows, err := p.pool.Query(ctx, "SELECT "+merchantColumns+" FROM merchants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		merchant, sErr := scanMerchant(rows)
+		if sErr != nil {
+			return nil, sErr
+		}
+		merchants = append(merchants, merchant)
+	}
+	return merchants, rows.Err()
+}
+
+func (p *PostgresRepository) Merchant(
+	ctx context.Context,
+	code string,
+) (MerchantInfo, error) {
+	merchant, err := scanMerchant(p.pool.QueryRow(ctx,
+		"SELECT "+merchantColumns+" FROM merchants WHERE code = $1", code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return MerchantInfo{}, ErrMerchantNotFound
+	}
+	return merchant, err
+}
+
+func (p *PostgresRepository) UpdateMerchant(
+	ctx context.Context,
+	merchant MerchantInfo,
+) (MerchantInfo, error) {
+	updated, err := scanMerchant(p.pool.QueryRow(ctx,
+		"UPDATE merchants SET name = $2, number_pattern = $3, check_digit = $4, accrual_address = $5 "+
+			"WHERE code = $1 RETURNING "+merchantColumns,
+		merchant.Code, merchant.Name, merchant.NumberPattern, merchant.CheckDigit, merchant.AccrualAddress))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return MerchantInfo{}, ErrMerchantNotFound
+	}
+	return updated, err
+}
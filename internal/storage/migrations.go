@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// migration is a schema change applied once, in version order, inside a transaction.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// migrations must only ever be appended to.
+var migrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			"CREATE EXTENSION IF NOT EXISTS pgcrypto",
+			"CREATE TABLE IF NOT EXISTS users (" +
+				"id SERIAL PRIMARY KEY, " +
+				"login TEXT NOT NULL UNIQUE, " +
+				"password TEXT NOT NULL)",
+			"CREATE TABLE IF NOT EXISTS orders (" +
+				"id BIGINT PRIMARY KEY, " +
+				"user_id INTEGER NOT NULL, " +
+				"uploaded_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"status TEXT NOT NULL DEFAULT 'NEW', " +
+				"accrual REAL, " +
+				"withdrawal REAL, " +
+				"FOREIGN KEY (user_id) REFERENCES users (id))",
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			// Serves per-user listings and balance sums as index-only scans.
+			"CREATE INDEX IF NOT EXISTS orders_user_uploaded_idx " +
+				"ON orders (user_id, uploaded_at) INCLUDE (status, accrual, withdrawal)",
+			// Only orders still awaiting accrual, a small fraction of the table.
+			"CREATE INDEX IF NOT EXISTS orders_pending_accrual_idx " +
+				"ON orders (uploaded_at) " +
+				"WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND withdrawal IS NULL",
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT Now()",
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS last_error TEXT",
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS dead_lettered_at TIMESTAMP",
+			// Restarts when a dead-lettered order is retried, unlike uploaded_at.
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS pending_since TIMESTAMP",
+			"UPDATE orders SET pending_since = uploaded_at",
+			"ALTER TABLE orders ALTER COLUMN pending_since SET DEFAULT Now()",
+			"ALTER TABLE orders ALTER COLUMN pending_since SET NOT NULL",
+			"DROP INDEX IF EXISTS orders_pending_accrual_idx",
+			"CREATE INDEX orders_pending_accrual_idx " +
+				"ON orders (uploaded_at) " +
+				"WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND withdrawal IS NULL " +
+				"AND dead_lettered_at IS NULL",
+			"CREATE INDEX IF NOT EXISTS orders_dead_letter_idx " +
+				"ON orders (dead_lettered_at) WHERE dead_lettered_at IS NOT NULL",
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			// Signed corrections of processed accruals, negative for reversals.
+			"CREATE TABLE IF NOT EXISTS adjustments (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"order_id BIGINT NOT NULL REFERENCES orders (id), " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"amount REAL NOT NULL, " +
+				"reason TEXT NOT NULL DEFAULT '', " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"CREATE INDEX IF NOT EXISTS adjustments_user_created_idx " +
+				"ON adjustments (user_id, created_at) INCLUDE (order_id, amount)",
+			"CREATE INDEX IF NOT EXISTS adjustments_order_idx ON adjustments (order_id)",
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			// Points reserved for a withdrawal; capturing a hold creates the withdrawal.
+			"CREATE TABLE IF NOT EXISTS holds (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"order_id BIGINT NOT NULL, " +
+				"amount REAL NOT NULL, " +
+				"status TEXT NOT NULL DEFAULT 'ACTIVE', " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"expires_at TIMESTAMP NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS holds_active_user_idx " +
+				"ON holds (user_id) INCLUDE (amount, expires_at) WHERE status = 'ACTIVE'",
+			"CREATE INDEX IF NOT EXISTS holds_active_expires_idx ON holds (expires_at) WHERE status = 'ACTIVE'",
+			"CREATE UNIQUE INDEX IF NOT EXISTS holds_active_order_idx ON holds (order_id) WHERE status = 'ACTIVE'",
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			// Returned withdrawal points. The caller supplied reference makes refunds idempotent.
+			"CREATE TABLE IF NOT EXISTS refunds (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"order_id BIGINT NOT NULL REFERENCES orders (id), " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"amount REAL NOT NULL, " +
+				"reference TEXT NOT NULL UNIQUE, " +
+				"reason TEXT NOT NULL DEFAULT '', " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"CREATE INDEX IF NOT EXISTS refunds_user_created_idx " +
+				"ON refunds (user_id, created_at) INCLUDE (order_id, amount)",
+			"CREATE INDEX IF NOT EXISTS refunds_order_idx ON refunds (order_id)",
+		},
+	},
+	{
+		version: 8,
+		statements: []string{
+			// Responses of mutating requests, replayed for retries with the same Idempotency-Key.
+			"CREATE TABLE IF NOT EXISTS idempotency_keys (" +
+				"scope TEXT NOT NULL, " +
+				"key TEXT NOT NULL, " +
+				"fingerprint TEXT NOT NULL, " +
+				"completed BOOLEAN NOT NULL DEFAULT FALSE, " +
+				"status_code INTEGER NOT NULL DEFAULT 0, " +
+				"content_type TEXT NOT NULL DEFAULT '', " +
+				"body BYTEA, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"PRIMARY KEY (scope, key))",
+			"CREATE INDEX IF NOT EXISTS idempotency_keys_created_idx ON idempotency_keys (created_at)",
+		},
+	},
+	{
+		version: 9,
+		statements: []string{
+			// Withdrawals move out of orders: their numbers are unique among withdrawals
+			// only and may coincide with an uploaded order.
+			"CREATE TABLE IF NOT EXISTS withdrawals (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"order_number BIGINT NOT NULL UNIQUE, " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"amount REAL NOT NULL, " +
+				"processed_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"INSERT INTO withdrawals (order_number, user_id, amount, processed_at) " +
+				"SELECT id, user_id, withdrawal, uploaded_at FROM orders WHERE withdrawal IS NOT NULL",
+			"ALTER TABLE refunds DROP CONSTRAINT IF EXISTS refunds_order_id_fkey",
+			"ALTER TABLE refunds ADD CONSTRAINT refunds_order_id_fkey " +
+				"FOREIGN KEY (order_id) REFERENCES withdrawals (order_number)",
+			"DELETE FROM orders WHERE withdrawal IS NOT NULL",
+			// Drops the indexes of migrations 2 and 4 that depend on the column.
+			"ALTER TABLE orders DROP COLUMN withdrawal",
+			"CREATE INDEX IF NOT EXISTS orders_user_uploaded_idx " +
+				"ON orders (user_id, uploaded_at) INCLUDE (status, accrual)",
+			"CREATE INDEX IF NOT EXISTS orders_pending_accrual_idx " +
+				"ON orders (uploaded_at) " +
+				"WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND dead_lettered_at IS NULL",
+			"CREATE INDEX IF NOT EXISTS withdrawals_user_processed_idx " +
+				"ON withdrawals (user_id, processed_at) INCLUDE (order_number, amount)",
+		},
+	},
+	{
+		version: 10,
+		statements: []string{
+			// Credited points, spent oldest first. order_id is the accrual order, or 0
+			// for points not credited by an order, such as refunds and referrer bonuses.
+			"CREATE TABLE IF NOT EXISTS lots (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"order_id BIGINT NOT NULL, " +
+				"amount REAL NOT NULL, " +
+				"remaining REAL NOT NULL, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"CREATE INDEX IF NOT EXISTS lots_open_user_idx " +
+				"ON lots (user_id, created_at) INCLUDE (remaining) WHERE remaining > 0",
+			"CREATE INDEX IF NOT EXISTS lots_open_created_idx ON lots (created_at) WHERE remaining > 0",
+			"CREATE INDEX IF NOT EXISTS lots_order_idx ON lots (order_id)",
+			// Points of lots that ran out before being spent.
+			"CREATE TABLE IF NOT EXISTS expirations (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"lot_id BIGINT NOT NULL REFERENCES lots (id), " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"amount REAL NOT NULL, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"CREATE INDEX IF NOT EXISTS expirations_user_created_idx " +
+				"ON expirations (user_id, created_at) INCLUDE (lot_id, amount)",
+			// Existing accruals become lots, with what was spent so far taken from the oldest.
+			"INSERT INTO lots (user_id, order_id, amount, remaining, created_at) " +
+				"SELECT user_id, id, amount, LEAST(amount, GREATEST(0, credited - spent)), updated_at FROM (" +
+				"SELECT user_id, id, amount, updated_at, " +
+				"SUM(amount) OVER (PARTITION BY user_id ORDER BY updated_at, id) AS credited, " +
+				"(SELECT COALESCE(SUM(amount), 0) FROM withdrawals WHERE user_id = o.user_id) - " +
+				"(SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE user_id = o.user_id) AS spent " +
+				"FROM (SELECT user_id, id, updated_at, accrual + " +
+				"(SELECT COALESCE(SUM(amount), 0) FROM adjustments WHERE order_id = orders.id) AS amount " +
+				"FROM orders WHERE status = 'PROCESSED' AND accrual > 0) o) l " +
+				"WHERE amount > 0",
+		},
+	},
+	{
+		version: 11,
+		statements: []string{
+			// The tier of a user is recalculated periodically, its multiplier applies
+			// to accruals processed until the next recalculation.
+			"ALTER TABLE users ADD COLUMN IF NOT EXISTS tier TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE users ADD COLUMN IF NOT EXISTS multiplier DOUBLE PRECISION NOT NULL DEFAULT 1",
+			"ALTER TABLE users ADD COLUMN IF NOT EXISTS tier_changed_at TIMESTAMP",
+			// The accrual as reported by the accrual system, before the multiplier.
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS base_accrual REAL",
+			"UPDATE orders SET base_accrual = accrual",
+			"CREATE TABLE IF NOT EXISTS tier_changes (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"from_tier TEXT NOT NULL, " +
+				"to_tier TEXT NOT NULL, " +
+				"basis_amount DOUBLE PRECISION NOT NULL, " +
+				"multiplier DOUBLE PRECISION NOT NULL, " +
+				"changed_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"CREATE INDEX IF NOT EXISTS tier_changes_user_changed_idx ON tier_changes (user_id, changed_at)",
+		},
+	},
+	{
+		version: 12,
+		statements: []string{
+			// Promotions granting bonus points on processed orders. Deleted campaigns
+			// are kept for the bonuses they granted.
+			"CREATE TABLE IF NOT EXISTS campaigns (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"name TEXT NOT NULL, " +
+				"starts_at TIMESTAMP NOT NULL, " +
+				"ends_at TIMESTAMP, " +
+				"first_order BOOLEAN NOT NULL DEFAULT FALSE, " +
+				"min_accrual REAL NOT NULL DEFAULT 0, " +
+				"tier TEXT NOT NULL DEFAULT '', " +
+				"multiplier DOUBLE PRECISION NOT NULL DEFAULT 0, " +
+				"bonus REAL NOT NULL DEFAULT 0, " +
+				"per_user_cap REAL NOT NULL DEFAULT 0, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"deleted_at TIMESTAMP)",
+			"CREATE TABLE IF NOT EXISTS bonuses (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"campaign_id BIGINT NOT NULL REFERENCES campaigns (id), " +
+				"order_id BIGINT NOT NULL REFERENCES orders (id), " +
+				"user_id INTEGER NOT NULL REFERENCES users (id), " +
+				"amount REAL NOT NULL, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"UNIQUE (campaign_id, order_id))",
+			"CREATE INDEX IF NOT EXISTS bonuses_user_created_idx " +
+				"ON bonuses (user_id, created_at) INCLUDE (campaign_id, order_id, amount)",
+			"CREATE INDEX IF NOT EXISTS bonuses_campaign_user_idx ON bonuses (campaign_id, user_id) INCLUDE (amount)",
+		},
+	},
+	{
+		version: 13,
+		statements: []string{
+			// Existing users are as old as their first order, new ones as their registration.
+			"ALTER TABLE users ADD COLUMN IF NOT EXISTS registered_at TIMESTAMP",
+			"UPDATE users SET registered_at = COALESCE(" +
+				"(SELECT MIN(uploaded_at) FROM orders WHERE user_id = users.id), Now())",
+			"ALTER TABLE users ALTER COLUMN registered_at SET DEFAULT Now()",
+			"ALTER TABLE users ALTER COLUMN registered_at SET NOT NULL",
+			// Points sent between users. Large transfers wait for the sender to confirm them.
+			"CREATE TABLE IF NOT EXISTS transfers (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"sender_id INTEGER NOT NULL REFERENCES users (id), " +
+				"recipient_id INTEGER NOT NULL REFERENCES users (id), " +
+				"amount REAL NOT NULL, " +
+				"status TEXT NOT NULL, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"expires_at TIMESTAMP, " +
+				"completed_at TIMESTAMP)",
+			"CREATE INDEX IF NOT EXISTS transfers_sender_completed_idx " +
+				"ON transfers (sender_id, completed_at) INCLUDE (recipient_id, amount) WHERE status = 'COMPLETED'",
+			"CREATE INDEX IF NOT EXISTS transfers_recipient_completed_idx " +
+				"ON transfers (recipient_id, completed_at) INCLUDE (sender_id, amount) WHERE status = 'COMPLETED'",
+		},
+	},
+	{
+		version: 14,
+		statements: []string{
+			// Every user gets a code to refer others with.
+			"ALTER TABLE users ADD COLUMN IF NOT EXISTS referral_code TEXT",
+			"UPDATE users SET referral_code = encode(gen_random_bytes(6), 'hex') WHERE referral_code IS NULL",
+			"ALTER TABLE users ALTER COLUMN referral_code SET DEFAULT encode(gen_random_bytes(6), 'hex')",
+			"ALTER TABLE users ALTER COLUMN referral_code SET NOT NULL",
+			"CREATE UNIQUE INDEX IF NOT EXISTS users_referral_code_idx ON users (referral_code)",
+			"ALTER TABLE users ADD COLUMN IF NOT EXISTS registration_ip TEXT NOT NULL DEFAULT ''",
+			// Bonuses are fixed at sign-up and granted with the first processed order of the referee.
+			"CREATE TABLE IF NOT EXISTS referrals (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"referrer_id INTEGER NOT NULL REFERENCES users (id), " +
+				"referee_id INTEGER NOT NULL UNIQUE REFERENCES users (id), " +
+				"status TEXT NOT NULL, " +
+				"reason TEXT NOT NULL DEFAULT '', " +
+				"referrer_bonus REAL NOT NULL, " +
+				"referee_bonus REAL NOT NULL, " +
+				"order_id BIGINT, " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"rewarded_at TIMESTAMP)",
+			"CREATE INDEX IF NOT EXISTS referrals_referrer_idx ON referrals (referrer_id, created_at)",
+		},
+	},
+	{
+		version: 15,
+		statements: []string{
+			// Partner stores number their orders independently. Orders uploaded without
+			// a merchant belong to the built-in default one.
+			"CREATE TABLE IF NOT EXISTS merchants (" +
+				"id SERIAL PRIMARY KEY, " +
+				"code TEXT NOT NULL UNIQUE, " +
+				"name TEXT NOT NULL, " +
+				"number_pattern TEXT NOT NULL DEFAULT '', " +
+				"check_digit TEXT NOT NULL DEFAULT 'luhn', " +
+				"accrual_address TEXT NOT NULL DEFAULT '', " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"INSERT INTO merchants (id, code, name) VALUES (0, 'default', 'Default') ON CONFLICT DO NOTHING",
+			// Orders are keyed by merchant and number, the id is a surrogate from now on.
+			// Existing orders keep their number as the id, so references to them hold.
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS merchant_id INTEGER NOT NULL DEFAULT 0 " +
+				"REFERENCES merchants (id)",
+			"ALTER TABLE orders ADD COLUMN IF NOT EXISTS number BIGINT",
+			"UPDATE orders SET number = id",
+			"ALTER TABLE orders ALTER COLUMN number SET NOT NULL",
+			"CREATE UNIQUE INDEX IF NOT EXISTS orders_merchant_number_idx " +
+				"ON orders (merchant_id, number) INCLUDE (user_id)",
+			"CREATE SEQUENCE IF NOT EXISTS orders_id_seq OWNED BY orders.id",
+			"SELECT setval('orders_id_seq', COALESCE((SELECT MAX(id) FROM orders), 0) + 1, false)",
+			"ALTER TABLE orders ALTER COLUMN id SET DEFAULT nextval('orders_id_seq')",
+			"DROP INDEX IF EXISTS orders_user_uploaded_idx",
+			"CREATE INDEX orders_user_uploaded_idx " +
+				"ON orders (user_id, uploaded_at) INCLUDE (merchant_id, number, status, accrual)",
+		},
+	},
+	{
+		version: 16,
+		statements: []string{
+			// Order numbers are digit strings of any length, leading zeros included.
+			// Existing numbers keep their digits, indexes are rebuilt by the type change.
+			"ALTER TABLE orders ALTER COLUMN number TYPE TEXT USING number::text",
+			"ALTER TABLE refunds DROP CONSTRAINT IF EXISTS refunds_order_id_fkey",
+			"ALTER TABLE withdrawals ALTER COLUMN order_number TYPE TEXT USING order_number::text",
+			"ALTER TABLE refunds ALTER COLUMN order_id TYPE TEXT USING order_id::text",
+			"ALTER TABLE refunds ADD CONSTRAINT refunds_order_id_fkey " +
+				"FOREIGN KEY (order_id) REFERENCES withdrawals (order_number)",
+			"ALTER TABLE holds ALTER COLUMN order_id TYPE TEXT USING order_id::text",
+		},
+	},
+	{
+		version: 17,
+		statements: []string{
+			// API clients subscribe URLs to event types, deliveries are signed with the secret.
+			"CREATE TABLE IF NOT EXISTS webhook_subscriptions (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"client TEXT NOT NULL, " +
+				"url TEXT NOT NULL, " +
+				"events TEXT[] NOT NULL, " +
+				"secret TEXT NOT NULL DEFAULT encode(gen_random_bytes(32), 'hex'), " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now())",
+			"CREATE INDEX IF NOT EXISTS webhook_subscriptions_client_idx ON webhook_subscriptions (client)",
+			// The outbox: a delivery is written with the change it reports and kept as its log.
+			"CREATE TABLE IF NOT EXISTS webhook_deliveries (" +
+				"id BIGSERIAL PRIMARY KEY, " +
+				"subscription_id BIGINT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE, " +
+				"event TEXT NOT NULL, " +
+				"payload TEXT NOT NULL, " +
+				"status TEXT NOT NULL DEFAULT 'PENDING', " +
+				"attempts INTEGER NOT NULL DEFAULT 0, " +
+				"last_status_code INTEGER, " +
+				"last_error TEXT NOT NULL DEFAULT '', " +
+				"next_attempt_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"created_at TIMESTAMP NOT NULL DEFAULT Now(), " +
+				"delivered_at TIMESTAMP)",
+			"CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx " +
+				"ON webhook_deliveries (next_attempt_at) WHERE status = 'PENDING'",
+			"CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id)",
+		},
+	},
+	{
+		version: 18,
+		statements: []string{
+			// Subscriptions see the orders of their merchants, NULL is every merchant and user.
+			// Existing ones were granted none, they see nothing until re-created.
+			"ALTER TABLE webhook_subscriptions ADD COLUMN IF NOT EXISTS merchants TEXT[] DEFAULT '{}'",
+		},
+	},
+}
+
+// migrationLockID serializes migrations of several instances starting at once.
+const migrationLockID = 7_432_118
+
+func (p *PostgresRepository) migrate(ctx context.Context) error {
+	_, err := p.pool.Exec(ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations ("+
+			"version INTEGER PRIMARY KEY, "+
+			"applied_at TIMESTAMP NOT NULL DEFAULT Now())")
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err = p.applyMigration(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PostgresRepository) applyMigration(ctx context.Context, m migration) error {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	for _, statement := range m.statements {
+		if _, err = tx.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", m.version); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -2,75 +2,188 @@ package storage
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"math"
 	"strconv"
+	"time"
 
-	"github.com/georgysavva/scany/sqlscan"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"VladBag2022/gophermart/internal/config"
 )
 
-type PostgresRepository struct {
-	database *sql.DB
-}
+// Hot path queries, covered by the indexes of migrations 9, 10, 12, 13, 14 and 15. Kept together so that
+// the plan tests check exactly what the repository runs.
+const (
+	queryOrderOwner = "SELECT users.login FROM orders JOIN users ON users.id = orders.user_id " +
+		"WHERE orders.merchant_id = (SELECT id FROM merchants WHERE code = $1) AND orders.number = $2"
+	queryOrders = "SELECT orders.id, orders.number, merchants.code, orders.status, orders.accrual, " +
+		"orders.uploaded_at FROM orders JOIN merchants ON merchants.id = orders.merchant_id " +
+		"WHERE orders.user_id = (SELECT id FROM users WHERE login = $1) ORDER BY orders.uploaded_at"
+	queryAccrualOrders = "SELECT orders.id, orders.number, merchants.accrual_address FROM orders " +
+		"JOIN merchants ON merchants.id = orders.merchant_id " +
+		"WHERE orders.status IN ('NEW', 'REGISTERED', 'PROCESSING') " +
+		"AND orders.dead_lettered_at IS NULL AND orders.updated_at <= Now() - $1::interval " +
+		"ORDER BY orders.uploaded_at"
+	queryBalance = "WITH u AS (SELECT id FROM users WHERE login = $1) " +
+		"SELECT COALESCE(SUM(accrual), 0) + " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM adjustments WHERE user_id = (SELECT id FROM u)) + " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM bonuses WHERE user_id = (SELECT id FROM u)) + " +
+		"(SELECT COALESCE(SUM(referrer_bonus), 0) FROM referrals " +
+		"WHERE referrer_id = (SELECT id FROM u) AND status = 'REWARDED') + " +
+		"(SELECT COALESCE(SUM(referee_bonus), 0) FROM referrals " +
+		"WHERE referee_id = (SELECT id FROM u) AND status = 'REWARDED') + " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM transfers " +
+		"WHERE recipient_id = (SELECT id FROM u) AND status = 'COMPLETED') - " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM transfers " +
+		"WHERE sender_id = (SELECT id FROM u) AND status = 'COMPLETED') - " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM expirations WHERE user_id = (SELECT id FROM u)), " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM withdrawals WHERE user_id = (SELECT id FROM u)) - " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE user_id = (SELECT id FROM u)), " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM holds " +
+		"WHERE user_id = (SELECT id FROM u) AND status = 'ACTIVE' AND expires_at > Now()) " +
+		"FROM orders WHERE user_id = (SELECT id FROM u)"
+	queryAdjustments = "SELECT order_id, amount, reason, created_at FROM adjustments " +
+		"WHERE user_id = (SELECT id FROM users WHERE login = $1) ORDER BY created_at"
+	queryBalanceHistory = "WITH u AS (SELECT id FROM users WHERE login = $1) " +
+		"SELECT '" + EntryAccrual + "', number, accrual, '', updated_at FROM orders " +
+		"WHERE user_id = (SELECT id FROM u) AND status = 'PROCESSED' AND accrual > 0 " +
+		"UNION ALL SELECT '" + EntryAdjustment + "', (SELECT number FROM orders WHERE id = adjustments.order_id), " +
+		"amount, reason, created_at FROM adjustments " +
+		"WHERE user_id = (SELECT id FROM u) " +
+		"UNION ALL SELECT '" + EntryBonus + "', (SELECT number FROM orders WHERE id = bonuses.order_id), " +
+		"bonuses.amount, campaigns.name, bonuses.created_at " +
+		"FROM bonuses JOIN campaigns ON campaigns.id = bonuses.campaign_id " +
+		"WHERE bonuses.user_id = (SELECT id FROM u) " +
+		"UNION ALL SELECT '" + EntryReferral + "', NULL, referrals.referrer_bonus, users.login, referrals.rewarded_at " +
+		"FROM referrals JOIN users ON users.id = referrals.referee_id " +
+		"WHERE referrals.referrer_id = (SELECT id FROM u) AND referrals.status = 'REWARDED' " +
+		"AND referrals.referrer_bonus > 0 " +
+		"UNION ALL SELECT '" + EntryReferral + "', (SELECT number FROM orders WHERE id = referrals.order_id), " +
+		"referrals.referee_bonus, users.login, " +
+		"referrals.rewarded_at FROM referrals JOIN users ON users.id = referrals.referrer_id " +
+		"WHERE referrals.referee_id = (SELECT id FROM u) AND referrals.status = 'REWARDED' " +
+		"AND referrals.referee_bonus > 0 " +
+		"UNION ALL SELECT '" + EntryWithdrawal + "', order_number, -amount, '', processed_at FROM withdrawals " +
+		"WHERE user_id = (SELECT id FROM u) " +
+		"UNION ALL SELECT '" + EntryRefund + "', order_id, amount, reason, created_at FROM refunds " +
+		"WHERE user_id = (SELECT id FROM u) " +
+		"UNION ALL SELECT '" + EntryTransferOut + "', NULL, -transfers.amount, users.login, transfers.completed_at " +
+		"FROM transfers JOIN users ON users.id = transfers.recipient_id " +
+		"WHERE transfers.sender_id = (SELECT id FROM u) AND transfers.status = 'COMPLETED' " +
+		"UNION ALL SELECT '" + EntryTransferIn + "', NULL, transfers.amount, users.login, transfers.completed_at " +
+		"FROM transfers JOIN users ON users.id = transfers.sender_id " +
+		"WHERE transfers.recipient_id = (SELECT id FROM u) AND transfers.status = 'COMPLETED' " +
+		"UNION ALL SELECT '" + EntryExpiry + "', (SELECT number FROM orders WHERE id = lots.order_id), " +
+		"-expirations.amount, '', expirations.created_at " +
+		"FROM expirations JOIN lots ON lots.id = expirations.lot_id " +
+		"WHERE expirations.user_id = (SELECT id FROM u) " +
+		"ORDER BY 5"
+	queryRefunds = "SELECT order_id, amount, reference, reason, created_at FROM refunds " +
+		"WHERE user_id = (SELECT id FROM users WHERE login = $1) ORDER BY created_at"
+	queryWithdrawals = "SELECT order_number, amount, processed_at FROM withdrawals " +
+		"WHERE user_id = (SELECT id FROM users WHERE login = $1) ORDER BY processed_at"
+)
 
-type PostgresOrderInfo struct {
-	Number     int64           `json:"number"`
-	Status     string          `json:"status"`
-	Accrual    sql.NullFloat64 `json:"accrual"`
-	UploadedAt string          `json:"uploaded_at"`
-}
+// uniqueViolation is the SQLSTATE of a unique constraint violation.
+const uniqueViolation = "23505"
 
-type PostgresWithdrawalInfo struct {
-	Order       string          `json:"order"`
-	Sum         sql.NullFloat64 `json:"sum"`
-	ProcessedAt string          `json:"processed_at"`
+type PostgresRepository struct {
+	pool     *pgxpool.Pool
+	replicas *replicaSet
+	cancel   context.CancelFunc
 }
 
 func NewPostgresRepository(
 	ctx context.Context,
-	databaseDSN string,
+	config config.Database,
 ) (*PostgresRepository, error) {
-	db, err := sql.Open("pgx", databaseDSN)
+	poolConfig, err := newPoolConfig(config)
 	if err != nil {
 		return nil, err
 	}
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var replicas []*replica
+	for _, uri := range config.Replicas {
+		replicaConfig := config
+		replicaConfig.URI = uri
+		replicaPoolConfig, rErr := newPoolConfig(replicaConfig)
+		if rErr != nil {
+			pool.Close()
+			return nil, rErr
+		}
+		// A replica being down must not prevent startup, the monitor brings it in later.
+		replicaPoolConfig.LazyConnect = true
+		replicaPool, rErr := pgxpool.ConnectConfig(ctx, replicaPoolConfig)
+		if rErr != nil {
+			pool.Close()
+			return nil, rErr
+		}
+		replicas = append(replicas, &replica{pool: replicaPool})
+	}
+
+	monitorContext, cancel := context.WithCancel(context.Background())
 	p := &PostgresRepository{
-		database: db,
+		pool:     pool,
+		replicas: newReplicaSet(replicas, config.PrimaryPinWindow, config.ReplicaMaxLag),
+		cancel:   cancel,
+	}
+	if len(replicas) > 0 {
+		p.replicas.checkHealth(ctx, config.ReplicaHealthInterval)
+		go p.replicas.monitor(monitorContext, config.ReplicaHealthInterval)
 	}
-	err = p.createSchema(ctx)
+	err = p.migrate(ctx)
 	return p, err
 }
 
+func newPoolConfig(config config.Database) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(config.URI)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = config.MaxConns
+	poolConfig.MinConns = config.MinConns
+	poolConfig.MaxConnLifetime = config.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = config.MaxConnIdleTime
+	poolConfig.HealthCheckPeriod = config.HealthCheckPeriod
+
+	if config.StatementTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] =
+			strconv.FormatInt(config.StatementTimeout.Milliseconds(), 10)
+	}
+
+	if config.PreparedStatements {
+		capacity := config.StatementCacheSize
+		poolConfig.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, stmtcache.ModePrepare, capacity)
+		}
+	} else {
+		poolConfig.ConnConfig.BuildStatementCache = nil
+		poolConfig.ConnConfig.PreferSimpleProtocol = true
+	}
+	return poolConfig, nil
+}
+
 func (p *PostgresRepository) Ping(ctx context.Context) error {
-	return p.database.PingContext(ctx)
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return conn.Conn().Ping(ctx)
 }
 
 func (p *PostgresRepository) Close() error {
-	return p.database.Close()
-}
-
-func (p *PostgresRepository) createSchema(ctx context.Context) error {
-	tables := []string{
-		"CREATE EXTENSION IF NOT EXISTS pgcrypto",
-		"CREATE TABLE IF NOT EXISTS users (" +
-			"id SERIAL PRIMARY KEY, " +
-			"login TEXT NOT NULL UNIQUE, " +
-			"password TEXT NOT NULL)",
-		"CREATE TABLE IF NOT EXISTS orders (" +
-			"id BIGINT PRIMARY KEY, " +
-			"user_id INTEGER NOT NULL, " +
-			"uploaded_at TIMESTAMP NOT NULL DEFAULT Now(), " +
-			"status TEXT NOT NULL DEFAULT 'NEW', " +
-			"accrual REAL, " +
-			"withdrawal REAL, " +
-			"FOREIGN KEY (user_id) REFERENCES users (id))",
-	}
-	for _, table := range tables {
-		_, err := p.database.ExecContext(ctx, table)
-		if err != nil {
-			return err
-		}
-	}
+	p.cancel()
+	p.replicas.close()
+	p.pool.Close()
 	return nil
 }
 
@@ -79,7 +192,7 @@ func (p *PostgresRepository) IsLoginAvailable(
 	login string,
 ) (available bool, err error) {
 	var count int
-	row := p.database.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE login = $1", login)
+	row := p.pool.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE login = $1", login)
 	err = row.Scan(&count)
 	if err != nil {
 		return false, err
@@ -89,12 +202,29 @@ func (p *PostgresRepository) IsLoginAvailable(
 
 func (p *PostgresRepository) Register(
 	ctx context.Context,
-	login, password string,
+	login, password, referralCode, ip string,
+	rewards config.Referrals,
 ) error {
-	_, err := p.database.ExecContext(ctx,
-		"INSERT INTO users (login, password) VALUES ($1, crypt($2, gen_salt('bf')))",
-		login, password)
-	return err
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var userID int
+	err = tx.QueryRow(ctx,
+		"INSERT INTO users (login, password, registration_ip) VALUES ($1, crypt($2, gen_salt('bf')), $3) "+
+			"RETURNING id",
+		login, password, ip).Scan(&userID)
+	if err != nil {
+		return err
+	}
+	if len(referralCode) > 0 {
+		if err = refer(ctx, tx, userID, referralCode, ip, rewards); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
 }
 
 func (p *PostgresRepository) Login(
@@ -102,7 +232,7 @@ func (p *PostgresRepository) Login(
 	login, password string,
 ) (success bool, err error) {
 	var count int
-	row := p.database.QueryRowContext(ctx,
+	row := p.pool.QueryRow(ctx,
 		"SELECT COUNT(*) FROM users WHERE login = $1 AND password = crypt($2, password)",
 		login, password)
 	err = row.Scan(&count)
@@ -114,13 +244,12 @@ func (p *PostgresRepository) Login(
 
 func (p *PostgresRepository) OrderOwner(
 	ctx context.Context,
-	order int64,
+	merchant string,
+	number string,
 ) (login string, err error) {
-	row := p.database.QueryRowContext(ctx,
-		"SELECT login FROM users JOIN orders ON users.id = orders.user_id AND orders.id = $1",
-		order)
+	row := p.pool.QueryRow(ctx, queryOrderOwner, merchant, number)
 	err = row.Scan(&login)
-	if err == sql.ErrNoRows {
+	if errors.Is(err, pgx.ErrNoRows) {
 		return "", nil
 	}
 	if err != nil {
@@ -131,49 +260,178 @@ func (p *PostgresRepository) OrderOwner(
 
 func (p *PostgresRepository) UploadOrder(
 	ctx context.Context,
-	login string,
-	order int64,
+	login, merchant, number string,
 ) error {
-	_, err := p.database.ExecContext(ctx,
-		"INSERT INTO orders (id, user_id) SELECT $1, id FROM users WHERE login = $2",
-		order, login)
+	_, err := p.pool.Exec(ctx,
+		"INSERT INTO orders (merchant_id, number, user_id) "+
+			"SELECT (SELECT id FROM merchants WHERE code = $1), $2, id FROM users WHERE login = $3",
+		merchant, number, login)
+	p.replicas.pin(login)
 	return err
 }
 
+func (p *PostgresRepository) UploadOrders(
+	ctx context.Context,
+	login, merchant string,
+	numbers []string,
+) (results []OrderUploadResult, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var userID, merchantID int
+	err = tx.QueryRow(ctx,
+		"SELECT users.id, merchants.id FROM users, merchants WHERE users.login = $1 AND merchants.code = $2",
+		login, merchant).Scan(&userID, &merchantID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMerchantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]OrderUploadResult, 0, len(numbers))
+	for _, number := range numbers {
+		result := OrderUploadResult{Number: number, Status: UploadAccepted}
+		tag, eErr := tx.Exec(ctx,
+			"INSERT INTO orders (merchant_id, number, user_id) VALUES ($1, $2, $3) "+
+				"ON CONFLICT (merchant_id, number) DO NOTHING",
+			merchantID, number, userID)
+		if eErr != nil {
+			return nil, eErr
+		}
+		if tag.RowsAffected() == 0 {
+			var ownerID int
+			eErr = tx.QueryRow(ctx,
+				"SELECT user_id FROM orders WHERE merchant_id = $1 AND number = $2",
+				merchantID, number).Scan(&ownerID)
+			if eErr != nil {
+				return nil, eErr
+			}
+			result.Status = UploadAlreadyUploaded
+			if ownerID != userID {
+				result.Status = UploadConflict
+			}
+		}
+		results = append(results, result)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	p.replicas.pin(login)
+	return results, nil
+}
+
 func (p *PostgresRepository) Orders(
 	ctx context.Context,
 	login string,
 ) (orders []OrderInfo, err error) {
-	var pOrders []PostgresOrderInfo
-	err = sqlscan.Select(ctx, p.database, &pOrders,
-		"SELECT orders.id AS number, orders.status, orders.accrual, orders.uploaded_at FROM orders "+
-			"JOIN users ON orders.user_id = users.id AND users.login = $1", login)
+	err = p.read(ctx, login, func(q querier) error {
+		orders = nil
+		rows, qErr := q.Query(ctx, queryOrders, login)
+		if qErr != nil {
+			return qErr
+		}
+		defer rows.Close()
+
+		index := make(map[int64]int)
+		for rows.Next() {
+			var (
+				id         int64
+				number     string
+				merchant   string
+				status     string
+				accrual    *float64
+				uploadedAt time.Time
+			)
+			if qErr = rows.Scan(&id, &number, &merchant, &status, &accrual, &uploadedAt); qErr != nil {
+				return qErr
+			}
+
+			order := OrderInfo{
+				Number:     number,
+				Status:     status,
+				UploadedAt: uploadedAt.Format(time.RFC3339),
+			}
+			if merchant != DefaultMerchant {
+				order.Merchant = merchant
+			}
+			if accrual != nil {
+				order.Accrual = *accrual
+			}
+			index[id] = len(orders)
+			orders = append(orders, order)
+		}
+		if qErr = rows.Err(); qErr != nil {
+			return qErr
+		}
+		rows.Close()
+
+		return attachAdjustments(ctx, q, login, orders, index)
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, pOrder := range pOrders {
-		accrual := 0.0
-		if pOrder.Accrual.Valid {
-			accrual = pOrder.Accrual.Float64
-		}
+	return orders, nil
+}
 
-		orders = append(orders, OrderInfo{
-			Accrual:    accrual,
-			Number:     strconv.FormatInt(pOrder.Number, 10),
-			Status:     pOrder.Status,
-			UploadedAt: pOrder.UploadedAt,
+// attachAdjustments adds adjustments to orders, index maps order ids to their position.
+func attachAdjustments(ctx context.Context, q querier, login string, orders []OrderInfo, index map[int64]int) error {
+	rows, err := q.Query(ctx, queryAdjustments, login)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			order     int64
+			amount    float64
+			reason    string
+			createdAt time.Time
+		)
+		if err = rows.Scan(&order, &amount, &reason, &createdAt); err != nil {
+			return err
+		}
+		i, ok := index[order]
+		if !ok {
+			continue
+		}
+		orders[i].Adjustments = append(orders[i].Adjustments, AdjustmentInfo{
+			Order:     orders[i].Number,
+			Amount:    amount,
+			Reason:    reason,
+			CreatedAt: createdAt.Format(time.RFC3339),
 		})
 	}
-	return orders, nil
+	return rows.Err()
 }
 
 func (p *PostgresRepository) AccrualOrders(
 	ctx context.Context,
-) (orders []int64, err error) {
-	err = sqlscan.Select(ctx, p.database, &orders,
-		"SELECT id AS number FROM orders "+
-			"WHERE status != 'INVALID' AND status != 'PROCESSED'")
-	return
+	minAge time.Duration,
+) (orders []AccrualOrder, err error) {
+	rows, err := p.pool.Query(ctx, queryAccrualOrders, minAge)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var order AccrualOrder
+		if err = rows.Scan(&order.ID, &order.Number, &order.AccrualAddress); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// statusRank orders statuses as the accrual system moves through them, final ones last.
+func statusRank(status string) string {
+	return "COALESCE(array_position(ARRAY['NEW', 'REGISTERED', 'PROCESSING'], " + status + "), 4)"
 }
 
 func (p *PostgresRepository) UpdateOrder(
@@ -182,46 +440,382 @@ func (p *PostgresRepository) UpdateOrder(
 	status string,
 	accrual float64,
 ) error {
-	_, err := p.database.ExecContext(ctx,
-		"UPDATE orders SET status = $1, accrual = $2 WHERE id = $3",
-		status, accrual, order)
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	// Final statuses are never overwritten and statuses never go back, e.g. from
+	// PROCESSING to REGISTERED, so late or replayed updates are harmless.
+	// A final status arriving for a dead-lettered order resolves it.
+	var (
+		userID     int
+		previous   string
+		uploadedAt time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"UPDATE orders SET status = $1, base_accrual = $2, accrual = $2 * "+queryMultiplier+", "+
+			"updated_at = Now(), attempts = 0, "+
+			"dead_lettered_at = CASE WHEN $1 IN ('INVALID', 'PROCESSED') THEN NULL ELSE orders.dead_lettered_at END "+
+			"FROM (SELECT id, status FROM orders WHERE id = $3 FOR UPDATE) old "+
+			"WHERE orders.id = old.id AND old.status NOT IN ('INVALID', 'PROCESSED') "+
+			"AND "+statusRank("$1::text")+" >= "+statusRank("old.status")+" "+
+			"RETURNING orders.user_id, orders.accrual, orders.uploaded_at, old.status",
+		status, accrual, order).Scan(&userID, &accrual, &uploadedAt, &previous)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status == "PROCESSED" {
+		if err = creditAccrual(ctx, tx, userID, order, accrual, uploadedAt); err != nil {
+			return err
+		}
+	}
+	// Polling repeats statuses, only changes are published.
+	if status != previous {
+		if err = notifyOrder(ctx, tx, order); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresRepository) AccrualFailed(
+	ctx context.Context,
+	orders []int64,
+	reason string,
+) error {
+	_, err := p.pool.Exec(ctx,
+		"UPDATE orders SET attempts = attempts + 1, last_error = $2 "+
+			"WHERE id = ANY($1) AND dead_lettered_at IS NULL",
+		orders, reason)
 	return err
 }
 
+func (p *PostgresRepository) DeadLetterOrders(
+	ctx context.Context,
+	maxAge time.Duration,
+	maxAttempts int,
+) (marked, total int64, err error) {
+	// The outer count does not see rows updated by the CTE, hence the sum.
+	err = p.pool.QueryRow(ctx,
+		"WITH marked AS ("+
+			"UPDATE orders SET dead_lettered_at = Now(), "+
+			"last_error = COALESCE(last_error, 'no final status within ' || $1::interval) "+
+			"WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') "+
+			"AND dead_lettered_at IS NULL "+
+			"AND (($1::interval > interval '0' AND pending_since <= Now() - $1::interval) "+
+			"OR ($2::integer > 0 AND attempts >= $2::integer)) "+
+			"RETURNING 1) "+
+			"SELECT (SELECT COUNT(*) FROM marked), "+
+			"(SELECT COUNT(*) FROM marked) + (SELECT COUNT(*) FROM orders WHERE dead_lettered_at IS NOT NULL)",
+		maxAge, maxAttempts).Scan(&marked, &total)
+	return marked, total, err
+}
+
+func (p *PostgresRepository) DeadLetters(
+	ctx context.Context,
+) (orders []DeadLetterInfo, err error) {
+	rows, err := p.pool.Query(ctx,
+		"SELECT orders.number, merchants.code, users.login, orders.status, orders.attempts, "+
+			"orders.last_error, orders.uploaded_at, orders.dead_lettered_at FROM orders "+
+			"JOIN users ON users.id = orders.user_id JOIN merchants ON merchants.id = orders.merchant_id "+
+			"WHERE orders.dead_lettered_at IS NOT NULL ORDER BY orders.dead_lettered_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			merchant       string
+			order          DeadLetterInfo
+			lastError      *string
+			uploadedAt     time.Time
+			deadLetteredAt time.Time
+		)
+		err = rows.Scan(&order.Number, &merchant, &order.Login, &order.Status, &order.Attempts, &lastError,
+			&uploadedAt, &deadLetteredAt)
+		if err != nil {
+			return nil, err
+		}
+		if merchant != DefaultMerchant {
+			order.Merchant = merchant
+		}
+		if lastError != nil {
+			order.LastError = *lastError
+		}
+		order.UploadedAt = uploadedAt.Format(time.RFC3339)
+		order.DeadLetteredAt = deadLetteredAt.Format(time.RFC3339)
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func (p *PostgresRepository) RetryDeadLetter(
+	ctx context.Context,
+	order int64,
+) error {
+	tag, err := p.pool.Exec(ctx,
+		"UPDATE orders SET dead_lettered_at = NULL, attempts = 0, last_error = NULL, pending_since = Now() "+
+			"WHERE id = $1 AND dead_lettered_at IS NOT NULL",
+		order)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotDeadLettered
+	}
+	return nil
+}
+
+func (p *PostgresRepository) ResolveDeadLetter(
+	ctx context.Context,
+	order int64,
+	status string,
+	accrual float64,
+) error {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var (
+		userID     int
+		uploadedAt time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"UPDATE orders SET status = $2, base_accrual = $3, accrual = $3 * "+queryMultiplier+", "+
+			"updated_at = Now(), dead_lettered_at = NULL, attempts = 0 "+
+			"WHERE id = $1 AND dead_lettered_at IS NOT NULL RETURNING user_id, accrual, uploaded_at",
+		order, status, accrual).Scan(&userID, &accrual, &uploadedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotDeadLettered
+	}
+	if err != nil {
+		return err
+	}
+	if status == "PROCESSED" {
+		if err = creditAccrual(ctx, tx, userID, order, accrual, uploadedAt); err != nil {
+			return err
+		}
+	}
+	if err = notifyOrder(ctx, tx, order); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
 func (p *PostgresRepository) Balance(
 	ctx context.Context,
 	login string,
 ) (balance BalanceInfo, err error) {
-	row := p.database.QueryRowContext(ctx,
-		"SELECT SUM(accrual), SUM(withdrawal) FROM orders JOIN users ON users.id = orders.user_id AND users.login = $1",
-		login)
-	var current, withdrawn sql.NullFloat64
-	err = row.Scan(&current, &withdrawn)
-	if err != nil {
-		balance.Current = 0.0
-		balance.Withdrawn = 0.0
-	} else {
-		if !current.Valid {
-			current.Float64 = 0.0
+	err = p.read(ctx, login, func(q querier) error {
+		balance, err = scanBalance(q.QueryRow(ctx, queryBalance, login))
+		return err
+	})
+	if err != nil {
+		return BalanceInfo{}, err
+	}
+	return balance, nil
+}
+
+// scanBalance reads a queryBalance row. Held points are not spendable.
+func scanBalance(row pgx.Row) (balance BalanceInfo, err error) {
+	var accrued, withdrawn, held float64
+	if err = row.Scan(&accrued, &withdrawn, &held); err != nil {
+		return BalanceInfo{}, err
+	}
+	balance.Withdrawn = withdrawn
+	balance.Held = held
+	balance.Current = accrued - withdrawn - held
+	return balance, nil
+}
+
+func (p *PostgresRepository) BalanceHistory(
+	ctx context.Context,
+	login string,
+) (entries []BalanceEntry, err error) {
+	err = p.read(ctx, login, func(q querier) error {
+		entries = nil
+		rows, qErr := q.Query(ctx, queryBalanceHistory, login)
+		if qErr != nil {
+			return qErr
 		}
-		if !withdrawn.Valid {
-			withdrawn.Float64 = 0.0
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				entry     BalanceEntry
+				order     *string
+				createdAt time.Time
+			)
+			if qErr = rows.Scan(&entry.Type, &order, &entry.Amount, &entry.Reason, &createdAt); qErr != nil {
+				return qErr
+			}
+			if order != nil {
+				entry.Order = *order
+			}
+			entry.CreatedAt = createdAt.Format(time.RFC3339)
+			entries = append(entries, entry)
 		}
-		balance.Withdrawn = withdrawn.Float64
-		balance.Current = current.Float64 - withdrawn.Float64
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
-	return balance, err
+	return entries, nil
+}
+
+func (p *PostgresRepository) ReverseAccrual(
+	ctx context.Context,
+	order int64,
+	amount float64,
+	reason string,
+	allowDebt bool,
+) (adjustment AdjustmentInfo, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return adjustment, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var (
+		userID    int
+		login     string
+		number    string
+		status    string
+		remaining float64
+	)
+	// Locking the order serializes concurrent reversals of it.
+	err = tx.QueryRow(ctx,
+		"SELECT orders.user_id, users.login, orders.number, orders.status, COALESCE(orders.accrual, 0) + "+
+			"(SELECT COALESCE(SUM(amount), 0) FROM adjustments WHERE order_id = orders.id) "+
+			"FROM orders JOIN users ON users.id = orders.user_id "+
+			"WHERE orders.id = $1 FOR UPDATE OF orders",
+		order).Scan(&userID, &login, &number, &status, &remaining)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return adjustment, ErrOrderNotFound
+	}
+	if err != nil {
+		return adjustment, err
+	}
+	if status != "PROCESSED" {
+		return adjustment, ErrNotProcessed
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		return adjustment, ErrReversalExceedsAccrual
+	}
+
+	if !allowDebt {
+		balance, bErr := scanBalance(tx.QueryRow(ctx, queryBalance, login))
+		if bErr != nil {
+			return adjustment, bErr
+		}
+		if amount > balance.Current {
+			amount = math.Max(balance.Current, 0)
+		}
+		if amount == 0 {
+			return adjustment, ErrNothingToReverse
+		}
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRow(ctx,
+		"INSERT INTO adjustments (order_id, user_id, amount, reason) VALUES ($1, $2, $3, $4) RETURNING created_at",
+		order, userID, -amount, reason).Scan(&createdAt)
+	if err != nil {
+		return adjustment, err
+	}
+	if _, err = spendLots(ctx, tx, userID, amount, &order); err != nil {
+		return adjustment, err
+	}
+	if err = notify(ctx, tx, Event{Type: EventBalance, Login: login}); err != nil {
+		return adjustment, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return adjustment, err
+	}
+	p.replicas.pin(login)
+
+	return AdjustmentInfo{
+		Order:     number,
+		Amount:    -amount,
+		Reason:    reason,
+		CreatedAt: createdAt.Format(time.RFC3339),
+	}, nil
 }
 
 func (p *PostgresRepository) Withdraw(
 	ctx context.Context,
 	login string,
-	order int64,
+	order string,
 	sum float64,
 ) error {
-	_, err := p.database.ExecContext(ctx,
-		"INSERT INTO orders (id, user_id, withdrawal) SELECT $1, id, $2 FROM users WHERE login = $3",
-		order, sum, login)
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	// Locking the user serializes withdrawals with holds and transfers, so that
+	// together they never exceed the balance.
+	var userID int
+	if err = tx.QueryRow(ctx, "SELECT id FROM users WHERE login = $1 FOR UPDATE", login).Scan(&userID); err != nil {
+		return err
+	}
+
+	var held bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM holds WHERE order_id = $1 AND status = 'ACTIVE' AND expires_at > Now())",
+		order).Scan(&held)
+	if err != nil {
+		return err
+	}
+	if held {
+		return ErrWithdrawalExists
+	}
+
+	balance, err := scanBalance(tx.QueryRow(ctx, queryBalance, login))
+	if err != nil {
+		return err
+	}
+	if sum > balance.Current {
+		return ErrInsufficientFunds
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO withdrawals (order_number, user_id, amount) VALUES ($1, $2, $3)",
+		order, userID, sum)
+	if err != nil {
+		return withdrawalError(err)
+	}
+	if _, err = spendLots(ctx, tx, userID, sum, nil); err != nil {
+		return err
+	}
+	if err = notify(ctx, tx, Event{Type: EventBalance, Login: login}); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	p.replicas.pin(login)
+	return nil
+}
+
+// withdrawalError reports a taken withdrawal order number as ErrWithdrawalExists.
+func withdrawalError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrWithdrawalExists
+	}
 	return err
 }
 
@@ -229,21 +823,321 @@ func (p *PostgresRepository) Withdrawals(
 	ctx context.Context,
 	login string,
 ) (withdrawals []WithdrawalInfo, err error) {
-	var pWithdrawals []PostgresWithdrawalInfo
-	err = sqlscan.Select(ctx, p.database, &pWithdrawals,
-		"SELECT orders.id AS order, orders.withdrawal AS sum, orders.uploaded_at AS processed_at FROM orders "+
-			"JOIN users ON orders.user_id = users.id AND users.login = $1", login)
-	if err != nil {
-		return nil, err
-	}
-	for _, pWithdrawal := range pWithdrawals {
-		if pWithdrawal.Sum.Valid {
+	err = p.read(ctx, login, func(q querier) error {
+		withdrawals = nil
+		rows, qErr := q.Query(ctx, queryWithdrawals, login)
+		if qErr != nil {
+			return qErr
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				order       string
+				sum         float64
+				processedAt time.Time
+			)
+			if qErr = rows.Scan(&order, &sum, &processedAt); qErr != nil {
+				return qErr
+			}
 			withdrawals = append(withdrawals, WithdrawalInfo{
-				Sum:         pWithdrawal.Sum.Float64,
-				Order:       pWithdrawal.Order,
-				ProcessedAt: pWithdrawal.ProcessedAt,
+				Order:       order,
+				Sum:         sum,
+				ProcessedAt: processedAt.Format(time.RFC3339),
 			})
 		}
+		if qErr = rows.Err(); qErr != nil {
+			return qErr
+		}
+		rows.Close()
+
+		return attachRefunds(ctx, q, login, withdrawals)
+	})
+	if err != nil {
+		return nil, err
 	}
 	return withdrawals, nil
 }
+
+func attachRefunds(ctx context.Context, q querier, login string, withdrawals []WithdrawalInfo) error {
+	rows, err := q.Query(ctx, queryRefunds, login)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[string]int, len(withdrawals))
+	for i, withdrawal := range withdrawals {
+		index[withdrawal.Order] = i
+	}
+	for rows.Next() {
+		var (
+			refund    RefundInfo
+			createdAt time.Time
+		)
+		if err = rows.Scan(&refund.Order, &refund.Amount, &refund.Reference, &refund.Reason, &createdAt); err != nil {
+			return err
+		}
+		refund.CreatedAt = createdAt.Format(time.RFC3339)
+		i, ok := index[refund.Order]
+		if !ok {
+			continue
+		}
+		withdrawals[i].Refunded += refund.Amount
+		withdrawals[i].Refunds = append(withdrawals[i].Refunds, refund)
+	}
+	return rows.Err()
+}
+
+func (p *PostgresRepository) RefundWithdrawal(
+	ctx context.Context,
+	order string,
+	amount float64,
+	reference string,
+	reason string,
+) (refund RefundInfo, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return refund, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var (
+		userID    int
+		login     string
+		remaining float64
+	)
+	// Locking the withdrawal serializes refunds of it, including retries with the same reference.
+	err = tx.QueryRow(ctx,
+		"SELECT withdrawals.user_id, users.login, withdrawals.amount - "+
+			"(SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = withdrawals.order_number) "+
+			"FROM withdrawals JOIN users ON users.id = withdrawals.user_id "+
+			"WHERE withdrawals.order_number = $1 FOR UPDATE OF withdrawals",
+		order).Scan(&userID, &login, &remaining)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return refund, ErrOrderNotFound
+	}
+	if err != nil {
+		return refund, err
+	}
+
+	var (
+		previousOrder string
+		createdAt     time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT order_id, amount, reason, created_at FROM refunds WHERE reference = $1",
+		reference).Scan(&previousOrder, &refund.Amount, &refund.Reason, &createdAt)
+	if err == nil {
+		// A retry of a completed refund returns it unchanged.
+		if previousOrder != order || (amount != 0 && amount != refund.Amount) {
+			return RefundInfo{}, ErrRefundConflict
+		}
+		refund.Order = order
+		refund.Reference = reference
+		refund.CreatedAt = createdAt.Format(time.RFC3339)
+		return refund, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return refund, err
+	}
+
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		return refund, ErrRefundExceedsWithdrawal
+	}
+
+	err = tx.QueryRow(ctx,
+		"INSERT INTO refunds (order_id, user_id, amount, reference, reason) VALUES ($1, $2, $3, $4, $5) "+
+			"RETURNING created_at",
+		order, userID, amount, reference, reason).Scan(&createdAt)
+	if err != nil {
+		return refund, err
+	}
+	// Refunded points are credited anew and expire as if accrued now. Their lot
+	// is not tied to an order, as withdrawal numbers are not orders.
+	if err = creditLot(ctx, tx, userID, 0, amount); err != nil {
+		return refund, err
+	}
+	if err = notify(ctx, tx, Event{Type: EventBalance, Login: login}); err != nil {
+		return refund, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return refund, err
+	}
+	p.replicas.pin(login)
+
+	return RefundInfo{
+		Order:     order,
+		Amount:    amount,
+		Reference: reference,
+		Reason:    reason,
+		CreatedAt: createdAt.Format(time.RFC3339),
+	}, nil
+}
+
+func (p *PostgresRepository) CreateHold(
+	ctx context.Context,
+	login string,
+	order string,
+	sum float64,
+	ttl time.Duration,
+) (hold HoldInfo, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return hold, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	// Locking the user serializes holds so that they never exceed the balance together.
+	var userID int
+	if err = tx.QueryRow(ctx, "SELECT id FROM users WHERE login = $1 FOR UPDATE", login).Scan(&userID); err != nil {
+		return hold, err
+	}
+
+	var exists bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM withdrawals WHERE order_number = $1) "+
+			"OR EXISTS (SELECT 1 FROM holds WHERE order_id = $1 AND status = 'ACTIVE' AND expires_at > Now())",
+		order).Scan(&exists)
+	if err != nil {
+		return hold, err
+	}
+	if exists {
+		return hold, ErrWithdrawalExists
+	}
+
+	balance, err := scanBalance(tx.QueryRow(ctx, queryBalance, login))
+	if err != nil {
+		return hold, err
+	}
+	if sum > balance.Current {
+		return hold, ErrInsufficientFunds
+	}
+
+	// An expired hold not swept yet would block the unique index on active orders.
+	_, err = tx.Exec(ctx,
+		"UPDATE holds SET status = 'EXPIRED' WHERE order_id = $1 AND status = 'ACTIVE' AND expires_at <= Now()",
+		order)
+	if err != nil {
+		return hold, err
+	}
+
+	var createdAt, expiresAt time.Time
+	err = tx.QueryRow(ctx,
+		"INSERT INTO holds (user_id, order_id, amount, expires_at) VALUES ($1, $2, $3, Now() + $4::interval) "+
+			"RETURNING id, created_at, expires_at",
+		userID, order, sum, ttl).Scan(&hold.ID, &createdAt, &expiresAt)
+	if err != nil {
+		return hold, err
+	}
+	if err = notify(ctx, tx, Event{Type: EventBalance, Login: login}); err != nil {
+		return hold, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return hold, err
+	}
+	p.replicas.pin(login)
+
+	hold.Order = order
+	hold.Sum = sum
+	hold.Status = HoldActive
+	hold.CreatedAt = createdAt.Format(time.RFC3339)
+	hold.ExpiresAt = expiresAt.Format(time.RFC3339)
+	return hold, nil
+}
+
+func (p *PostgresRepository) CaptureHold(
+	ctx context.Context,
+	login string,
+	id int64,
+) (HoldInfo, error) {
+	return p.settleHold(ctx, login, id, HoldCaptured)
+}
+
+func (p *PostgresRepository) VoidHold(
+	ctx context.Context,
+	login string,
+	id int64,
+) (HoldInfo, error) {
+	return p.settleHold(ctx, login, id, HoldVoided)
+}
+
+// settleHold moves an active hold of the user to status, withdrawing its sum on capture.
+func (p *PostgresRepository) settleHold(
+	ctx context.Context,
+	login string,
+	id int64,
+	status string,
+) (hold HoldInfo, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return hold, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var (
+		userID               int
+		expired              bool
+		createdAt, expiresAt time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT holds.user_id, holds.order_id, holds.amount, holds.status, holds.expires_at <= Now(), "+
+			"holds.created_at, holds.expires_at FROM holds JOIN users ON users.id = holds.user_id "+
+			"WHERE holds.id = $1 AND users.login = $2 FOR UPDATE OF holds",
+		id, login).Scan(&userID, &hold.Order, &hold.Sum, &hold.Status, &expired, &createdAt, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return hold, ErrHoldNotFound
+	}
+	if err != nil {
+		return hold, err
+	}
+	hold.ID = id
+	hold.CreatedAt = createdAt.Format(time.RFC3339)
+	hold.ExpiresAt = expiresAt.Format(time.RFC3339)
+	if hold.Status != HoldActive || expired {
+		return hold, ErrHoldNotActive
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE holds SET status = $1 WHERE id = $2", status, id); err != nil {
+		return hold, err
+	}
+	if status == HoldCaptured {
+		_, err = tx.Exec(ctx,
+			"INSERT INTO withdrawals (order_number, user_id, amount) VALUES ($1, $2, $3)",
+			hold.Order, userID, hold.Sum)
+		if err != nil {
+			return hold, withdrawalError(err)
+		}
+		// Holds do not reserve lots, so the ones they count on may have expired meanwhile.
+		spent, sErr := spendLots(ctx, tx, userID, hold.Sum, nil)
+		if sErr != nil {
+			return hold, sErr
+		}
+		if lotsShort(spent, hold.Sum) {
+			return hold, ErrHoldShortfall
+		}
+	}
+	// A voided hold frees its sum, a captured one moves it from held to withdrawn.
+	if err = notify(ctx, tx, Event{Type: EventBalance, Login: login}); err != nil {
+		return hold, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return hold, err
+	}
+	p.replicas.pin(login)
+
+	hold.Status = status
+	return hold, nil
+}
+
+func (p *PostgresRepository) ExpireHolds(ctx context.Context) (expired int64, err error) {
+	tag, err := p.pool.Exec(ctx,
+		"UPDATE holds SET status = 'EXPIRED' WHERE status = 'ACTIVE' AND expires_at <= Now()")
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
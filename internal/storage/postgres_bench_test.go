@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/georgysavva/scany/sqlscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v4/stdlib"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+// sqlRepository is the database/sql + sqlscan implementation the pgx-native
+// repository replaced, kept here as the benchmark baseline.
+type sqlRepository struct {
+	database *sql.DB
+}
+
+type sqlOrderInfo struct {
+	Number     string
+	Status     string
+	Accrual    sql.NullFloat64
+	UploadedAt string
+}
+
+func (p *sqlRepository) Orders(ctx context.Context, login string) (orders []OrderInfo, err error) {
+	var pOrders []sqlOrderInfo
+	err = sqlscan.Select(ctx, p.database, &pOrders,
+		"SELECT orders.number, orders.status, orders.accrual, orders.uploaded_at FROM orders "+
+			"JOIN users ON orders.user_id = users.id AND users.login = $1", login)
+	if err != nil {
+		return nil, err
+	}
+	for _, pOrder := range pOrders {
+		orders = append(orders, OrderInfo{
+			Accrual:    pOrder.Accrual.Float64,
+			Number:     pOrder.Number,
+			Status:     pOrder.Status,
+			UploadedAt: pOrder.UploadedAt,
+		})
+	}
+	return orders, nil
+}
+
+func (p *sqlRepository) AccrualOrders(ctx context.Context, _ time.Duration) (orders []AccrualOrder, err error) {
+	err = sqlscan.Select(ctx, p.database, &orders,
+		"SELECT orders.id, orders.number, merchants.accrual_address FROM orders "+
+			"JOIN merchants ON merchants.id = orders.merchant_id "+
+			"WHERE status != 'INVALID' AND status != 'PROCESSED'")
+	return
+}
+
+// Balance runs the query of the pgx repository, so that only the drivers are compared.
+func (p *sqlRepository) Balance(ctx context.Context, login string) (balance BalanceInfo, err error) {
+	var accrued, withdrawn, held float64
+	if err = p.database.QueryRowContext(ctx, queryBalance, login).Scan(&accrued, &withdrawn, &held); err != nil {
+		return balance, err
+	}
+	balance.Withdrawn = withdrawn
+	balance.Held = held
+	balance.Current = accrued - withdrawn - held
+	return balance, nil
+}
+
+type benchRepository interface {
+	Orders(ctx context.Context, login string) ([]OrderInfo, error)
+	AccrualOrders(ctx context.Context, minAge time.Duration) ([]AccrualOrder, error)
+	Balance(ctx context.Context, login string) (BalanceInfo, error)
+}
+
+const (
+	benchUsers         = 100
+	benchOrdersPerUser = 50
+)
+
+// newBenchRepositories connects both implementations to a throwaway schema in
+// DATABASE_URI and seeds benchUsers users with benchOrdersPerUser orders each.
+func newBenchRepositories(b *testing.B) map[string]benchRepository {
+	uri := os.Getenv("DATABASE_URI")
+	if len(uri) == 0 {
+		b.Skip("DATABASE_URI is not set")
+	}
+	ctx := context.Background()
+
+	schema := fmt.Sprintf("bench_%d", time.Now().UnixNano())
+	admin, err := pgxpool.Connect(ctx, uri)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err = admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_, _ = admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close()
+	})
+
+	cfg := config.Default().Database
+	cfg.URI = uri
+	poolConfig, err := newPoolConfig(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	poolConfig.ConnConfig.RuntimeParams["search_path"] = schema + ",public"
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pgxRepository := &PostgresRepository{
+		pool:     pool,
+		replicas: newReplicaSet(nil, 0, 0),
+		cancel:   func() {},
+	}
+	b.Cleanup(func() { _ = pgxRepository.Close() })
+	if err = pgxRepository.migrate(ctx); err != nil {
+		b.Fatal(err)
+	}
+
+	db := stdlib.OpenDB(*poolConfig.ConnConfig)
+	db.SetMaxOpenConns(int(cfg.MaxConns))
+	b.Cleanup(func() { _ = db.Close() })
+
+	seed := []string{
+		fmt.Sprintf("INSERT INTO users (login, password) "+
+			"SELECT 'bench-' || n, 'x' FROM generate_series(0, %d) AS n", benchUsers-1),
+		fmt.Sprintf("INSERT INTO orders (number, user_id, status, accrual) "+
+			"SELECT (1000000000 + n)::text, (SELECT id FROM users WHERE login = 'bench-' || n / %d), "+
+			"(ARRAY['NEW', 'PROCESSING', 'PROCESSED', 'INVALID'])[1 + n %% 4], n %% %d "+
+			"FROM generate_series(0, %d) AS n", benchOrdersPerUser, benchOrdersPerUser,
+			benchUsers*benchOrdersPerUser-1),
+	}
+	for _, statement := range seed {
+		if _, err = pool.Exec(ctx, statement); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return map[string]benchRepository{
+		"pgxpool":      pgxRepository,
+		"database_sql": &sqlRepository{database: db},
+	}
+}
+
+func runParallelBench(b *testing.B, f func(ctx context.Context, login string) error) {
+	var counter int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := context.Background()
+		for pb.Next() {
+			login := fmt.Sprintf("bench-%d", atomic.AddInt64(&counter, 1)%benchUsers)
+			if err := f(ctx, login); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkRepository_Orders(b *testing.B) {
+	for name, repository := range newBenchRepositories(b) {
+		repository := repository
+		b.Run(name, func(b *testing.B) {
+			runParallelBench(b, func(ctx context.Context, login string) error {
+				_, err := repository.Orders(ctx, login)
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkRepository_Balance(b *testing.B) {
+	for name, repository := range newBenchRepositories(b) {
+		repository := repository
+		b.Run(name, func(b *testing.B) {
+			runParallelBench(b, func(ctx context.Context, login string) error {
+				_, err := repository.Balance(ctx, login)
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkRepository_AccrualOrders(b *testing.B) {
+	for name, repository := range newBenchRepositories(b) {
+		repository := repository
+		b.Run(name, func(b *testing.B) {
+			runParallelBench(b, func(ctx context.Context, _ string) error {
+				_, err := repository.AccrualOrders(ctx, 0)
+				return err
+			})
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+// refer records the referral of a new user by the owner of code. Referrals
+// that look like the referrer signing themselves up are kept but rejected.
+func refer(ctx context.Context, tx pgx.Tx, refereeID int, code, ip string, rewards config.Referrals) error {
+	var (
+		referrerID int
+		referrerIP string
+	)
+	err := tx.QueryRow(ctx,
+		"SELECT id, registration_ip FROM users WHERE referral_code = lower($1) AND id <> $2",
+		code, refereeID).Scan(&referrerID, &referrerIP)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrReferralCodeNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	status, reason := ReferralPending, ""
+	if len(ip) > 0 {
+		var sharedIP bool
+		err = tx.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM referrals JOIN users ON users.id = referrals.referee_id "+
+				"WHERE referrals.referrer_id = $1 AND users.registration_ip = $2)",
+			referrerID, ip).Scan(&sharedIP)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ip == referrerIP:
+			status, reason = ReferralRejected, "signed up from the IP address of the referrer"
+		case sharedIP:
+			status, reason = ReferralRejected, "another referee signed up from the same IP address"
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO referrals (referrer_id, referee_id, status, reason, referrer_bonus, referee_bonus) "+
+			"VALUES ($1, $2, $3, $4, $5, $6)",
+		referrerID, refereeID, status, reason, rewards.ReferrerBonus, rewards.RefereeBonus)
+	return err
+}
+
+// rewardReferral grants the bonuses of the pending referral of the user, if
+// any, for their first processed order. The balance change of the user is
+// published with the order, the one of the referrer here.
+func rewardReferral(ctx context.Context, tx pgx.Tx, userID int, order int64) error {
+	var (
+		referrerID                  int
+		referrer                    string
+		referrerBonus, refereeBonus float64
+	)
+	err := tx.QueryRow(ctx,
+		"UPDATE referrals SET status = 'REWARDED', order_id = $2, rewarded_at = Now() "+
+			"WHERE referee_id = $1 AND status = 'PENDING' RETURNING referrer_id, "+
+			"(SELECT login FROM users WHERE id = referrer_id), referrer_bonus, referee_bonus",
+		userID, order).Scan(&referrerID, &referrer, &referrerBonus, &refereeBonus)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if refereeBonus > 0 {
+		if err = creditLot(ctx, tx, userID, order, refereeBonus); err != nil {
+			return err
+		}
+	}
+	if referrerBonus > 0 {
+		// The order is not the referrer's, so their lot is not tied to it.
+		if err = creditLot(ctx, tx, referrerID, 0, referrerBonus); err != nil {
+			return err
+		}
+		return notify(ctx, tx, Event{Type: EventBalance, Login: referrer})
+	}
+	return nil
+}
+
+func (p *PostgresRepository) Referrals(
+	ctx context.Context,
+	login string,
+) (referrals ReferralsInfo, err error) {
+	err = p.read(ctx, login, func(q querier) error {
+		var userID int
+		qErr := q.QueryRow(ctx, "SELECT id, referral_code FROM users WHERE login = $1", login).
+			Scan(&userID, &referrals.Code)
+		if qErr != nil {
+			return qErr
+		}
+
+		rows, qErr := q.Query(ctx,
+			"SELECT users.login, referrals.status, referrals.reason, referrals.referrer_bonus, "+
+				"referrals.created_at, referrals.rewarded_at FROM referrals "+
+				"JOIN users ON users.id = referrals.referee_id "+
+				"WHERE referrals.referrer_id = $1 ORDER BY referrals.created_at",
+			userID)
+		if qErr != nil {
+			return qErr
+		}
+		defer rows.Close()
+
+		referrals.Referees = nil
+		for rows.Next() {
+			var (
+				referee    ReferralInfo
+				createdAt  time.Time
+				rewardedAt *time.Time
+			)
+			qErr = rows.Scan(&referee.Login, &referee.Status, &referee.Reason, &referee.Bonus,
+				&createdAt, &rewardedAt)
+			if qErr != nil {
+				return qErr
+			}
+			referee.CreatedAt = createdAt.Format(time.RFC3339)
+			if rewardedAt != nil {
+				referee.RewardedAt = rewardedAt.Format(time.RFC3339)
+			}
+			referrals.Referees = append(referrals.Referees, referee)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return ReferralsInfo{}, err
+	}
+	return referrals, nil
+}
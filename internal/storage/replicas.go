@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+)
+
+type primaryContextKey struct{}
+
+// WithPrimary marks the context so that reads made with it are served by the primary.
+// Use it when a decision must not be based on replication-lagged data.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func primaryRequested(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
+// querier is the read subset shared by the primary and replica pools.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+type replica struct {
+	pool    *pgxpool.Pool
+	healthy int32
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *replica) setHealthy(healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&r.healthy, value) != value {
+		log.Warnf("Replica %s healthy: %t", r.pool.Config().ConnConfig.Host, healthy)
+	}
+}
+
+// replicaSet routes read-only queries to healthy replicas and keeps users that
+// have just written pinned to the primary so they read their own writes. Pins
+// are kept per process: another instance may serve a read from a replica that
+// has not replayed the write yet.
+type replicaSet struct {
+	replicas  []*replica
+	next      uint32
+	pinWindow time.Duration
+	maxLag    time.Duration
+
+	mu   sync.Mutex
+	pins map[string]time.Time
+}
+
+func newReplicaSet(replicas []*replica, pinWindow, maxLag time.Duration) *replicaSet {
+	return &replicaSet{
+		replicas:  replicas,
+		pinWindow: pinWindow,
+		maxLag:    maxLag,
+		pins:      make(map[string]time.Time),
+	}
+}
+
+func (s *replicaSet) pin(login string) {
+	if len(s.replicas) == 0 || s.pinWindow == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pins[login] = time.Now().Add(s.pinWindow)
+}
+
+func (s *replicaSet) pinned(login string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.pins[login]
+	if ok && time.Now().After(until) {
+		delete(s.pins, login)
+		return false
+	}
+	return ok
+}
+
+func (s *replicaSet) prunePins() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for login, until := range s.pins {
+		if now.After(until) {
+			delete(s.pins, login)
+		}
+	}
+}
+
+// pick returns a healthy replica in round-robin order or nil when none is available.
+func (s *replicaSet) pick() *replica {
+	n := len(s.replicas)
+	start := atomic.AddUint32(&s.next, 1)
+	for i := 0; i < n; i++ {
+		r := s.replicas[(int(start)+i)%n]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// queryReplicaLag tells whether the server is a standby and how far its replay
+// is behind. A standby that replayed all it received is not lagging, however
+// old its last replayed transaction.
+const queryReplicaLag = "SELECT pg_is_in_recovery(), " +
+	"CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 " +
+	"ELSE COALESCE(EXTRACT(EPOCH FROM Now() - pg_last_xact_replay_timestamp()), 0) END"
+
+func (s *replicaSet) checkHealth(ctx context.Context, timeout time.Duration) {
+	for _, r := range s.replicas {
+		checkContext, cancel := context.WithTimeout(ctx, timeout)
+		var (
+			inRecovery bool
+			lagSeconds float64
+		)
+		err := r.pool.QueryRow(checkContext, queryReplicaLag).Scan(&inRecovery, &lagSeconds)
+		cancel()
+		if err == nil {
+			err = s.replicaUsable(inRecovery, time.Duration(lagSeconds*float64(time.Second)))
+		}
+		if err != nil {
+			log.Debugf("Replica health check failed: %s", err)
+		}
+		r.setHealthy(err == nil)
+	}
+}
+
+// replicaUsable rejects a promoted replica, which no longer follows the
+// primary, and one lagging more than allowed.
+func (s *replicaSet) replicaUsable(inRecovery bool, lag time.Duration) error {
+	if !inRecovery {
+		return errors.New("replica is not in recovery")
+	}
+	if s.maxLag > 0 && lag > s.maxLag {
+		return fmt.Errorf("replica lags %s behind", lag.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func (s *replicaSet) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkHealth(ctx, interval)
+			s.prunePins()
+		}
+	}
+}
+
+func (s *replicaSet) close() {
+	for _, r := range s.replicas {
+		r.pool.Close()
+	}
+}
+
+// isConnectionError tells replica failures that justify failover from query errors.
+func isConnectionError(err error) bool {
+	if errors.Is(err, pgx.ErrNoRows) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	return !errors.As(err, &pgErr)
+}
+
+// read runs a read-only query on a replica when allowed and falls back to the
+// primary if no replica is healthy or the replica fails.
+func (p *PostgresRepository) read(ctx context.Context, login string, query func(q querier) error) error {
+	if primaryRequested(ctx) || p.replicas.pinned(login) {
+		return query(p.pool)
+	}
+	r := p.replicas.pick()
+	if r == nil {
+		return query(p.pool)
+	}
+	err := query(r.pool)
+	if err == nil || !isConnectionError(err) {
+		return err
+	}
+	r.setHealthy(false)
+	return query(p.pool)
+}
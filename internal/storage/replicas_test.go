@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaSet_pin(t *testing.T) {
+	set := newReplicaSet([]*replica{{healthy: 1}}, 50*time.Millisecond, 0)
+
+	assert.False(t, set.pinned("a"))
+	set.pin("a")
+	assert.True(t, set.pinned("a"))
+	assert.False(t, set.pinned("b"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, set.pinned("a"))
+}
+
+func TestReplicaSet_pinWithoutReplicas(t *testing.T) {
+	set := newReplicaSet(nil, time.Minute, 0)
+	set.pin("a")
+	assert.False(t, set.pinned("a"))
+}
+
+func TestReplicaSet_pick(t *testing.T) {
+	healthy := &replica{healthy: 1}
+	set := newReplicaSet([]*replica{{}, healthy, {}}, time.Minute, 0)
+	for i := 0; i < 5; i++ {
+		assert.Same(t, healthy, set.pick())
+	}
+
+	set = newReplicaSet([]*replica{{}, {}}, time.Minute, 0)
+	assert.Nil(t, set.pick())
+}
+
+func TestReplicaSet_replicaUsable(t *testing.T) {
+	set := newReplicaSet(nil, time.Minute, 10*time.Second)
+	assert.NoError(t, set.replicaUsable(true, 2*time.Second))
+	assert.Error(t, set.replicaUsable(true, time.Minute))
+	assert.Error(t, set.replicaUsable(false, 0))
+
+	set = newReplicaSet(nil, time.Minute, 0)
+	assert.NoError(t, set.replicaUsable(true, time.Hour))
+}
+
+func TestWithPrimary(t *testing.T) {
+	ctx := context.Background()
+	assert.False(t, primaryRequested(ctx))
+	assert.True(t, primaryRequested(WithPrimary(ctx)))
+}
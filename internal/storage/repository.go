@@ -2,24 +2,329 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"time"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+var (
+	ErrNotDeadLettered         = errors.New("order is not dead-lettered")
+	ErrOrderNotFound           = errors.New("order not found")
+	ErrNotProcessed            = errors.New("order accrual is not final")
+	ErrReversalExceedsAccrual  = errors.New("reversal exceeds the remaining accrual")
+	ErrNothingToReverse        = errors.New("balance leaves nothing to reverse")
+	ErrInsufficientFunds       = errors.New("insufficient funds")
+	ErrWithdrawalExists        = errors.New("withdrawal order number is already used")
+	ErrHoldNotFound            = errors.New("hold not found")
+	ErrHoldNotActive           = errors.New("hold is not active")
+	ErrHoldShortfall           = errors.New("held points expired before capture")
+	ErrRefundExceedsWithdrawal = errors.New("refund exceeds the remaining withdrawal")
+	ErrRefundConflict          = errors.New("refund id was already used for another refund")
+	ErrIdempotencyKeyBusy      = errors.New("idempotency key is being released")
+	ErrCampaignNotFound        = errors.New("campaign not found")
+	ErrRecipientNotFound       = errors.New("recipient not found")
+	ErrSelfTransfer            = errors.New("cannot transfer points to yourself")
+	ErrAccountTooNew           = errors.New("account is too new to send points")
+	ErrTransferLimitExceeded   = errors.New("daily transfer limit exceeded")
+	ErrTransferNotFound        = errors.New("transfer not found")
+	ErrTransferNotPending      = errors.New("transfer is not awaiting confirmation")
+	ErrReferralCodeNotFound    = errors.New("referral code not found")
+	ErrMerchantNotFound        = errors.New("merchant not found")
+	ErrMerchantExists          = errors.New("merchant code is already used")
+	ErrWebhookNotFound         = errors.New("webhook subscription not found")
+)
+
+// Balance history entry types.
+const (
+	EntryAccrual    = "accrual"
+	EntryAdjustment = "adjustment"
+	EntryBonus      = "bonus"
+	EntryWithdrawal = "withdrawal"
+	EntryRefund     = "refund"
+	EntryExpiry     = "expiry"
+	// Referral bonuses have the login of the other side as the reason.
+	EntryReferral = "referral"
+	// Transfers have no order, the reason is the login of the other side.
+	EntryTransferOut = "transfer_out"
+	EntryTransferIn  = "transfer_in"
 )
 
 type OrderInfo struct {
-	Number     string  `json:"number"`
-	Status     string  `json:"status"`
-	Accrual    float64 `json:"accrual,omitempty"`
-	UploadedAt string  `json:"uploaded_at"`
+	Number      string           `json:"number"`
+	Merchant    string           `json:"merchant,omitempty"`
+	Status      string           `json:"status"`
+	Accrual     float64          `json:"accrual,omitempty"`
+	UploadedAt  string           `json:"uploaded_at"`
+	Adjustments []AdjustmentInfo `json:"adjustments,omitempty"`
+}
+
+// Outcomes of uploading an order number in a batch.
+const (
+	UploadAccepted        = "ACCEPTED"
+	UploadAlreadyUploaded = "ALREADY_UPLOADED"
+	UploadConflict        = "UPLOADED_BY_ANOTHER_USER"
+	UploadInvalid         = "INVALID_NUMBER"
+)
+
+// OrderUploadResult is the outcome of one order number of a batch upload.
+type OrderUploadResult struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdjustmentInfo is a correction of a processed accrual, negative for reversals.
+type AdjustmentInfo struct {
+	Order     string  `json:"order"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// BalanceEntry is a signed change of the balance.
+type BalanceEntry struct {
+	Type      string  `json:"type"`
+	Order     string  `json:"order,omitempty"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason,omitempty"`
+	CreatedAt string  `json:"created_at"`
 }
 
 type BalanceInfo struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current      float64        `json:"current"`
+	Withdrawn    float64        `json:"withdrawn"`
+	Held         float64        `json:"held"`
+	ExpiringSoon []ExpiringInfo `json:"expiring_soon,omitempty"`
+}
+
+// ExpiringInfo is points of a lot that run out unless spent first.
+type ExpiringInfo struct {
+	Amount    float64 `json:"amount"`
+	ExpiresAt string  `json:"expires_at"`
+}
+
+// Hold statuses.
+const (
+	HoldActive   = "ACTIVE"
+	HoldCaptured = "CAPTURED"
+	HoldVoided   = "VOIDED"
+	HoldExpired  = "EXPIRED"
+)
+
+// HoldInfo is a reservation of points for a withdrawal.
+type HoldInfo struct {
+	ID        int64   `json:"id"`
+	Order     string  `json:"order"`
+	Sum       float64 `json:"sum"`
+	Status    string  `json:"status"`
+	CreatedAt string  `json:"created_at"`
+	ExpiresAt string  `json:"expires_at"`
 }
 
 type WithdrawalInfo struct {
-	Order       string  `json:"order"`
-	Sum         float64 `json:"sum"`
-	ProcessedAt string  `json:"processed_at"`
+	Order       string       `json:"order"`
+	Sum         float64      `json:"sum"`
+	ProcessedAt string       `json:"processed_at"`
+	Refunded    float64      `json:"refunded,omitempty"`
+	Refunds     []RefundInfo `json:"refunds,omitempty"`
+}
+
+// RefundInfo is points of a withdrawal returned to the user.
+type RefundInfo struct {
+	Order     string  `json:"order"`
+	Amount    float64 `json:"amount"`
+	Reference string  `json:"refund_id"`
+	Reason    string  `json:"reason,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// ProfileInfo is the account of a user with their loyalty tier.
+type ProfileInfo struct {
+	Login       string           `json:"login"`
+	Tier        string           `json:"tier,omitempty"`
+	TierSince   string           `json:"tier_since,omitempty"`
+	Multiplier  float64          `json:"multiplier"`
+	TierChanges []TierChangeInfo `json:"tier_changes,omitempty"`
+}
+
+// TierChangeInfo is a tier recalculation that moved the user to another tier.
+type TierChangeInfo struct {
+	From        string  `json:"from,omitempty"`
+	To          string  `json:"to,omitempty"`
+	BasisAmount float64 `json:"basis_amount"`
+	Multiplier  float64 `json:"multiplier"`
+	ChangedAt   string  `json:"changed_at"`
+}
+
+// Transfer statuses.
+const (
+	TransferPending   = "PENDING"
+	TransferCompleted = "COMPLETED"
+	TransferExpired   = "EXPIRED"
+)
+
+// TransferInfo is points sent by one user to another.
+type TransferInfo struct {
+	ID          int64   `json:"id"`
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Amount      float64 `json:"amount"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"created_at"`
+	ExpiresAt   string  `json:"expires_at,omitempty"`
+	CompletedAt string  `json:"completed_at,omitempty"`
+}
+
+// DefaultMerchant owns the orders uploaded without a merchant. It is built in
+// and checks order numbers with the Luhn algorithm.
+const DefaultMerchant = "default"
+
+// Check digit schemes of order numbers, named as in the luhn package.
+const (
+	CheckDigitLuhn     = "luhn"
+	CheckDigitVerhoeff = "verhoeff"
+	CheckDigitDamm     = "damm"
+	CheckDigitMod97    = "mod97"
+	CheckDigitNone     = "none"
+)
+
+// MerchantInfo is a partner store numbering its orders independently of others.
+type MerchantInfo struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// NumberPattern is a regular expression whole order numbers have to match, if set.
+	NumberPattern string `json:"number_pattern,omitempty"`
+	CheckDigit    string `json:"check_digit"`
+	// AccrualAddress is the accrual system of the merchant, the default one when empty.
+	AccrualAddress string `json:"accrual_address,omitempty"`
+	CreatedAt      string `json:"created_at,omitempty"`
+}
+
+// WebhookInfo is a URL an API client has events of the given types pushed to.
+// It gets the order events of Merchants only, without any it gets the events
+// of every merchant and user. The secret signing deliveries is only told on
+// creation.
+type WebhookInfo struct {
+	ID        int64    `json:"id"`
+	Client    string   `json:"-"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Merchants []string `json:"merchants,omitempty"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at,omitempty"`
+}
+
+// Webhook delivery statuses.
+const (
+	WebhookPending   = "PENDING"
+	WebhookDelivered = "DELIVERED"
+	WebhookFailed    = "FAILED"
+)
+
+// WebhookDeliveryInfo is an event pushed to a subscription and the outcome
+// of its last attempt.
+type WebhookDeliveryInfo struct {
+	ID            int64  `json:"id"`
+	Event         string `json:"event"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	StatusCode    int    `json:"status_code,omitempty"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	NextAttemptAt string `json:"next_attempt_at,omitempty"`
+	DeliveredAt   string `json:"delivered_at,omitempty"`
+}
+
+// WebhookDelivery is a pending delivery claimed for sending.
+type WebhookDelivery struct {
+	ID       int64
+	URL      string
+	Secret   string
+	Event    string
+	Payload  []byte
+	Attempts int
+	// CreatedAt is when the reported change happened.
+	CreatedAt time.Time
+}
+
+// WebhookAttempt is the outcome of sending a delivery. A pending delivery is
+// tried again after RetryIn.
+type WebhookAttempt struct {
+	Status     string
+	StatusCode int
+	Error      string
+	RetryIn    time.Duration
+}
+
+// Referral statuses.
+const (
+	ReferralPending  = "PENDING"
+	ReferralRewarded = "REWARDED"
+	ReferralRejected = "REJECTED"
+)
+
+// ReferralsInfo is the referral code of a user and the users who signed up with it.
+type ReferralsInfo struct {
+	Code     string         `json:"code"`
+	Referees []ReferralInfo `json:"referees"`
+}
+
+// ReferralInfo is a user who signed up with a referral code. Bonus is what
+// the referrer gets once the referee has their first order processed.
+type ReferralInfo struct {
+	Login      string  `json:"login"`
+	Status     string  `json:"status"`
+	Reason     string  `json:"reason,omitempty"`
+	Bonus      float64 `json:"bonus"`
+	CreatedAt  string  `json:"created_at"`
+	RewardedAt string  `json:"rewarded_at,omitempty"`
+}
+
+// CampaignInfo is a promotion granting bonus points on processed orders. An
+// order qualifies when uploaded within the campaign window and matching every
+// rule set. It earns Bonus plus the accrual times Multiplier less one, up to
+// PerUserCap points per user over the campaign. Times are RFC 3339.
+type CampaignInfo struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	StartsAt   string  `json:"starts_at"`
+	EndsAt     string  `json:"ends_at,omitempty"`
+	FirstOrder bool    `json:"first_order,omitempty"`
+	MinAccrual float64 `json:"min_accrual,omitempty"`
+	Tier       string  `json:"tier,omitempty"`
+	Multiplier float64 `json:"multiplier,omitempty"`
+	Bonus      float64 `json:"bonus,omitempty"`
+	PerUserCap float64 `json:"per_user_cap,omitempty"`
+}
+
+// CampaignEvaluation is the bonus a campaign grants or would grant an order.
+type CampaignEvaluation struct {
+	CampaignID int64   `json:"campaign_id"`
+	Name       string  `json:"name"`
+	Eligible   bool    `json:"eligible"`
+	Reason     string  `json:"reason,omitempty"`
+	Bonus      float64 `json:"bonus"`
+}
+
+// AccrualOrder is an order awaiting its accrual status.
+type AccrualOrder struct {
+	ID     int64
+	Number string
+	// AccrualAddress is the accrual system of the merchant, the default one when empty.
+	AccrualAddress string
+}
+
+// DeadLetterInfo is an order that stopped being polled for its accrual status.
+type DeadLetterInfo struct {
+	Number         string `json:"number"`
+	Merchant       string `json:"merchant,omitempty"`
+	Login          string `json:"login"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	LastError      string `json:"last_error,omitempty"`
+	UploadedAt     string `json:"uploaded_at"`
+	DeadLetteredAt string `json:"dead_lettered_at"`
 }
 
 type Repository interface {
@@ -28,9 +333,13 @@ type Repository interface {
 		login string,
 	) (available bool, err error)
 
+	// Register signs up a user from ip. With a referral code it returns
+	// ErrReferralCodeNotFound unless the code belongs to a user, who is then
+	// promised rewards.ReferrerBonus and the new user rewards.RefereeBonus.
 	Register(
 		ctx context.Context,
-		login, password string,
+		login, password, referralCode, ip string,
+		rewards config.Referrals,
 	) error
 
 	Login(
@@ -38,26 +347,47 @@ type Repository interface {
 		login, password string,
 	) (success bool, err error)
 
+	// OrderOwner returns an empty login when the merchant has no such order.
 	OrderOwner(
 		ctx context.Context,
-		order int64,
+		merchant, number string,
 	) (login string, err error)
 
 	UploadOrder(
 		ctx context.Context,
-		login string,
-		order int64,
+		login, merchant, number string,
 	) error
 
+	// UploadOrders uploads numbers of merchant for the user in one transaction,
+	// reporting the outcome of each in order. Repeated numbers are already
+	// uploaded after their first occurrence.
+	UploadOrders(
+		ctx context.Context,
+		login, merchant string,
+		numbers []string,
+	) (results []OrderUploadResult, err error)
+
+	// OrderID returns the id of the order number of merchant the other methods
+	// take, or ErrOrderNotFound.
+	OrderID(
+		ctx context.Context,
+		merchant, number string,
+	) (id int64, err error)
+
 	Orders(
 		ctx context.Context,
 		login string,
 	) (orders []OrderInfo, err error)
 
+	// AccrualOrders lists orders awaiting a final accrual status
+	// that were not updated for at least minAge.
 	AccrualOrders(
 		ctx context.Context,
-	) (orders []int64, err error)
+		minAge time.Duration,
+	) (orders []AccrualOrder, err error)
 
+	// UpdateOrder multiplies a processed accrual by the multiplier of the tier
+	// of the order owner.
 	UpdateOrder(
 		ctx context.Context,
 		order int64,
@@ -65,15 +395,69 @@ type Repository interface {
 		accrual float64,
 	) error
 
+	// AccrualFailed records a failed status lookup of orders.
+	AccrualFailed(
+		ctx context.Context,
+		orders []int64,
+		reason string,
+	) error
+
+	// DeadLetterOrders stops polling orders pending for longer than maxAge or
+	// with at least maxAttempts failed lookups; zero disables a limit. It returns
+	// the number of orders dead-lettered now and in total.
+	DeadLetterOrders(
+		ctx context.Context,
+		maxAge time.Duration,
+		maxAttempts int,
+	) (marked, total int64, err error)
+
+	DeadLetters(
+		ctx context.Context,
+	) (orders []DeadLetterInfo, err error)
+
+	// RetryDeadLetter returns a dead-lettered order to polling.
+	RetryDeadLetter(
+		ctx context.Context,
+		order int64,
+	) error
+
+	// ResolveDeadLetter sets the status and accrual of a dead-lettered order manually.
+	ResolveDeadLetter(
+		ctx context.Context,
+		order int64,
+		status string,
+		accrual float64,
+	) error
+
 	Balance(
 		ctx context.Context,
 		login string,
 	) (balance BalanceInfo, err error)
 
-	Withdraw(
+	// BalanceHistory lists accruals, adjustments, campaign and referral bonuses,
+	// withdrawals, refunds, transfers and expired points oldest first.
+	BalanceHistory(
 		ctx context.Context,
 		login string,
+	) (entries []BalanceEntry, err error)
+
+	// ReverseAccrual claws back amount of a processed accrual, all that remains
+	// of it when amount is zero. Unless allowDebt is set, no more than the
+	// current balance is reversed.
+	ReverseAccrual(
+		ctx context.Context,
 		order int64,
+		amount float64,
+		reason string,
+		allowDebt bool,
+	) (adjustment AdjustmentInfo, err error)
+
+	// Withdraw returns ErrWithdrawalExists when order was already used for a
+	// withdrawal or an active hold.
+	Withdraw(
+		ctx context.Context,
+		login string,
+		order string,
 		sum float64,
 	) error
 
@@ -82,5 +466,226 @@ type Repository interface {
 		login string,
 	) (withdrawals []WithdrawalInfo, err error)
 
+	// RefundWithdrawal returns amount of a withdrawal to the user, all that
+	// remains of it when amount is zero. Repeating a refund with the same
+	// reference returns the original refund instead of refunding twice.
+	RefundWithdrawal(
+		ctx context.Context,
+		order string,
+		amount float64,
+		reference string,
+		reason string,
+	) (refund RefundInfo, err error)
+
+	// CreateHold reserves sum of the spendable balance for a withdrawal against
+	// order until ttl passes.
+	CreateHold(
+		ctx context.Context,
+		login string,
+		order string,
+		sum float64,
+		ttl time.Duration,
+	) (hold HoldInfo, err error)
+
+	// CaptureHold turns an active hold into a withdrawal.
+	CaptureHold(
+		ctx context.Context,
+		login string,
+		id int64,
+	) (hold HoldInfo, err error)
+
+	// VoidHold releases an active hold.
+	VoidHold(
+		ctx context.Context,
+		login string,
+		id int64,
+	) (hold HoldInfo, err error)
+
+	// Transfer sends amount of the spendable balance of from to the user to.
+	// Transfers of at least limits.ConfirmationThreshold wait for ConfirmTransfer.
+	Transfer(
+		ctx context.Context,
+		from, to string,
+		amount float64,
+		limits config.Transfers,
+	) (transfer TransferInfo, err error)
+
+	// ConfirmTransfer completes a pending transfer of the user.
+	ConfirmTransfer(
+		ctx context.Context,
+		login string,
+		id int64,
+		limits config.Transfers,
+	) (transfer TransferInfo, err error)
+
+	CreateWebhook(
+		ctx context.Context,
+		webhook WebhookInfo,
+	) (created WebhookInfo, err error)
+
+	Webhooks(
+		ctx context.Context,
+		client string,
+	) (webhooks []WebhookInfo, err error)
+
+	// DeleteWebhook drops a subscription of client with its deliveries.
+	DeleteWebhook(
+		ctx context.Context,
+		client string,
+		id int64,
+	) error
+
+	// WebhookDeliveries returns the latest deliveries of a subscription of client, newest first.
+	WebhookDeliveries(
+		ctx context.Context,
+		client string,
+		id int64,
+	) (deliveries []WebhookDeliveryInfo, err error)
+
+	// ClaimWebhookDeliveries returns up to limit pending deliveries that are due,
+	// hiding them from other claims for lease.
+	ClaimWebhookDeliveries(
+		ctx context.Context,
+		limit int,
+		lease time.Duration,
+	) (deliveries []WebhookDelivery, err error)
+
+	RecordWebhookAttempt(
+		ctx context.Context,
+		id int64,
+		attempt WebhookAttempt,
+	) error
+
+	// ListenEvents passes events of every instance to handle until ctx is done
+	// or the connection fails. It holds a connection of the pool meanwhile.
+	ListenEvents(
+		ctx context.Context,
+		handle func(Event),
+	) error
+
+	// ExpireHolds releases holds past their expiry and returns their number.
+	ExpireHolds(ctx context.Context) (expired int64, err error)
+
+	// ExpirePoints posts expiry entries for the unspent points of lots credited
+	// more than ttl ago and returns the number of lots and points expired.
+	ExpirePoints(
+		ctx context.Context,
+		ttl time.Duration,
+	) (lots int64, points float64, err error)
+
+	// ExpiringPoints lists unspent lots of the user that expire within notice.
+	ExpiringPoints(
+		ctx context.Context,
+		login string,
+		ttl, notice time.Duration,
+	) (expiring []ExpiringInfo, err error)
+
+	CreateCampaign(
+		ctx context.Context,
+		campaign CampaignInfo,
+	) (created CampaignInfo, err error)
+
+	Campaigns(
+		ctx context.Context,
+	) (campaigns []CampaignInfo, err error)
+
+	Campaign(
+		ctx context.Context,
+		id int64,
+	) (campaign CampaignInfo, err error)
+
+	// UpdateCampaign changes the rules of a campaign. Bonuses already granted stay.
+	UpdateCampaign(
+		ctx context.Context,
+		campaign CampaignInfo,
+	) (updated CampaignInfo, err error)
+
+	// DeleteCampaign stops a campaign, keeping the bonuses it granted.
+	DeleteCampaign(
+		ctx context.Context,
+		id int64,
+	) error
+
+	// DryRunCampaigns evaluates every campaign against order as if it was
+	// processed with accrual, its current accrual when accrual is zero,
+	// without granting anything.
+	DryRunCampaigns(
+		ctx context.Context,
+		order int64,
+		accrual float64,
+	) (evaluations []CampaignEvaluation, err error)
+
+	Profile(
+		ctx context.Context,
+		login string,
+	) (profile ProfileInfo, err error)
+
+	Referrals(
+		ctx context.Context,
+		login string,
+	) (referrals ReferralsInfo, err error)
+
+	// CreateMerchant returns ErrMerchantExists when the code is taken.
+	CreateMerchant(
+		ctx context.Context,
+		merchant MerchantInfo,
+	) (created MerchantInfo, err error)
+
+	Merchants(
+		ctx context.Context,
+	) (merchants []MerchantInfo, err error)
+
+	Merchant(
+		ctx context.Context,
+		code string,
+	) (merchant MerchantInfo, err error)
+
+	// UpdateMerchant changes the rules and the accrual system of a merchant.
+	// Orders already uploaded are not validated again.
+	UpdateMerchant(
+		ctx context.Context,
+		merchant MerchantInfo,
+	) (updated MerchantInfo, err error)
+
+	// RecalculateTiers moves every user to the highest of tiers whose threshold
+	// their basis amount over window reaches, recording changes of tier. It
+	// returns the number of users whose tier changed.
+	RecalculateTiers(
+		ctx context.Context,
+		tiers []config.Tier,
+		basis string,
+		window time.Duration,
+	) (changed int64, err error)
+
+	// ReserveIdempotencyKey claims key within scope for a request with the
+	// given fingerprint. It returns nil when the key was free, or what is stored
+	// for it otherwise. Keys older than window are free again, as are keys
+	// whose request has not completed within lease.
+	ReserveIdempotencyKey(
+		ctx context.Context,
+		scope, key, fingerprint string,
+		window, lease time.Duration,
+	) (stored *IdempotentResponse, err error)
+
+	SaveIdempotentResponse(
+		ctx context.Context,
+		scope, key string,
+		response IdempotentResponse,
+	) error
+
+	// ReleaseIdempotencyKey frees a reserved key whose request did not complete.
+	ReleaseIdempotencyKey(
+		ctx context.Context,
+		scope, key string,
+	) error
+
+	// PurgeIdempotencyKeys deletes keys older than window.
+	PurgeIdempotencyKeys(
+		ctx context.Context,
+		window time.Duration,
+	) (purged int64, err error)
+
+	Ping(ctx context.Context) error
+
 	Close() error
 }
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+// queryMultiplier is the accrual multiplier of the tier of the order owner.
+const queryMultiplier = "(SELECT multiplier FROM users WHERE id = orders.user_id)"
+
+// Rolling amounts deciding the tier of users.id, summed over the last $4.
+var tierBasisAmounts = map[string]string{
+	config.TierBasisAccrual: "(SELECT COALESCE(SUM(accrual), 0) FROM orders " +
+		"WHERE user_id = users.id AND status = 'PROCESSED' AND updated_at > Now() - $4::interval)",
+	config.TierBasisSpend: "(SELECT COALESCE(SUM(amount), 0) FROM withdrawals " +
+		"WHERE user_id = users.id AND processed_at > Now() - $4::interval) - " +
+		"(SELECT COALESCE(SUM(amount), 0) FROM refunds " +
+		"WHERE user_id = users.id AND created_at > Now() - $4::interval)",
+}
+
+func (p *PostgresRepository) Profile(
+	ctx context.Context,
+	login string,
+) (profile ProfileInfo, err error) {
+	err = p.read(ctx, login, func(q querier) error {
+		var (
+			userID        int
+			tierChangedAt *time.Time
+		)
+		qErr := q.QueryRow(ctx,
+			"SELECT id, login, tier, multiplier, tier_changed_at FROM users WHERE login = $1",
+			login).Scan(&userID, &profile.Login, &profile.Tier, &profile.Multiplier, &tierChangedAt)
+		if qErr != nil {
+			return qErr
+		}
+		if tierChangedAt != nil {
+			profile.TierSince = tierChangedAt.Format(time.RFC3339)
+		}
+
+		rows, qErr := q.Query(ctx,
+			"SELECT from_tier, to_tier, basis_amount, multiplier, changed_at FROM tier_changes "+
+				"WHERE user_id = $1 ORDER BY changed_at",
+			userID)
+		if qErr != nil {
+			return qErr
+		}
+		defer rows.Close()
+
+		profile.TierChanges = nil
+		for rows.Next() {
+			var (
+				change    TierChangeInfo
+				changedAt time.Time
+			)
+			if qErr = rows.Scan(&change.From, &change.To, &change.BasisAmount, &change.Multiplier, &changedAt); qErr != nil {
+				return qErr
+			}
+			change.ChangedAt = changedAt.Format(time.RFC3339)
+			profile.TierChanges = append(profile.TierChanges, change)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return ProfileInfo{}, err
+	}
+	return profile, nil
+}
+
+func (p *PostgresRepository) RecalculateTiers(
+	ctx context.Context,
+	tiers []config.Tier,
+	basis string,
+	window time.Duration,
+) (changed int64, err error) {
+	amount, ok := tierBasisAmounts[basis]
+	if !ok {
+		return 0, fmt.Errorf("unknown tier basis %q", basis)
+	}
+	names := make([]string, len(tiers))
+	thresholds := make([]float64, len(tiers))
+	multipliers := make([]float64, len(tiers))
+	for i, tier := range tiers {
+		names[i] = tier.Name
+		thresholds[i] = tier.Threshold
+		multipliers[i] = tier.Multiplier
+	}
+
+	// Users below every threshold have no tier and keep their accruals as is.
+	err = p.pool.QueryRow(ctx,
+		"WITH tiers AS (SELECT * FROM unnest($1::text[], $2::float8[], $3::float8[]) "+
+			"AS t (name, threshold, multiplier)), "+
+			"target AS (SELECT users.id, users.tier AS from_tier, a.amount, "+
+			"COALESCE(t.name, '') AS tier, COALESCE(t.multiplier, 1) AS multiplier FROM users "+
+			"CROSS JOIN LATERAL (SELECT "+amount+" AS amount) a "+
+			"LEFT JOIN LATERAL (SELECT name, multiplier FROM tiers WHERE threshold <= a.amount "+
+			"ORDER BY threshold DESC LIMIT 1) t ON TRUE), "+
+			"updated AS (UPDATE users SET tier = target.tier, multiplier = target.multiplier, "+
+			"tier_changed_at = CASE WHEN users.tier <> target.tier THEN Now() ELSE users.tier_changed_at END "+
+			"FROM target WHERE users.id = target.id "+
+			"AND (users.tier <> target.tier OR users.multiplier <> target.multiplier) "+
+			"RETURNING target.*), "+
+			"logged AS (INSERT INTO tier_changes (user_id, from_tier, to_tier, basis_amount, multiplier) "+
+			"SELECT id, from_tier, tier, amount, multiplier FROM updated WHERE from_tier <> tier RETURNING 1) "+
+			"SELECT COUNT(*) FROM logged",
+		names, thresholds, multipliers, window).Scan(&changed)
+	return changed, err
+}
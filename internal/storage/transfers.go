@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"VladBag2022/gophermart/internal/config"
+)
+
+func (p *PostgresRepository) Transfer(
+	ctx context.Context,
+	from, to string,
+	amount float64,
+	limits config.Transfers,
+) (transfer TransferInfo, err error) {
+	if from == to {
+		return transfer, ErrSelfTransfer
+	}
+
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return transfer, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	// Locking the sender serializes their transfers so that limits and the balance hold.
+	var (
+		senderID  int
+		oldEnough bool
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT id, registered_at <= Now() - $2::interval FROM users WHERE login = $1 FOR UPDATE",
+		from, limits.MinAccountAge).Scan(&senderID, &oldEnough)
+	if err != nil {
+		return transfer, err
+	}
+	if !oldEnough {
+		return transfer, ErrAccountTooNew
+	}
+
+	var recipientID int
+	err = tx.QueryRow(ctx, "SELECT id FROM users WHERE login = $1", to).Scan(&recipientID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return transfer, ErrRecipientNotFound
+	}
+	if err != nil {
+		return transfer, err
+	}
+
+	if err = checkTransfer(ctx, tx, senderID, from, amount, limits); err != nil {
+		return transfer, err
+	}
+
+	transfer.Status = TransferCompleted
+	if limits.ConfirmationThreshold > 0 && amount >= limits.ConfirmationThreshold {
+		transfer.Status = TransferPending
+	}
+	var (
+		createdAt              time.Time
+		expiresAt, completedAt *time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"INSERT INTO transfers (sender_id, recipient_id, amount, status, expires_at, completed_at) "+
+			"VALUES ($1, $2, $3, $4, "+
+			"CASE WHEN $4 = 'PENDING' THEN Now() + $5::interval END, "+
+			"CASE WHEN $4 = 'COMPLETED' THEN Now() END) "+
+			"RETURNING id, created_at, expires_at, completed_at",
+		senderID, recipientID, amount, transfer.Status, limits.ConfirmationTTL).
+		Scan(&transfer.ID, &createdAt, &expiresAt, &completedAt)
+	if err != nil {
+		return transfer, err
+	}
+	if transfer.Status == TransferCompleted {
+		if err = moveLots(ctx, tx, senderID, recipientID, amount); err != nil {
+			return transfer, err
+		}
+		if err = notifyTransfer(ctx, tx, from, to); err != nil {
+			return transfer, err
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return transfer, err
+	}
+	p.replicas.pin(from)
+	p.replicas.pin(to)
+
+	transfer.From = from
+	transfer.To = to
+	transfer.Amount = amount
+	formatTransferTimes(&transfer, createdAt, expiresAt, completedAt)
+	return transfer, nil
+}
+
+func (p *PostgresRepository) ConfirmTransfer(
+	ctx context.Context,
+	login string,
+	id int64,
+	limits config.Transfers,
+) (transfer TransferInfo, err error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return transfer, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	var senderID int
+	if err = tx.QueryRow(ctx, "SELECT id FROM users WHERE login = $1 FOR UPDATE", login).Scan(&senderID); err != nil {
+		return transfer, err
+	}
+
+	var (
+		recipientID int
+		expired     bool
+		createdAt   time.Time
+		expiresAt   *time.Time
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT transfers.recipient_id, users.login, transfers.amount, transfers.status, "+
+			"COALESCE(transfers.expires_at <= Now(), FALSE), transfers.created_at, transfers.expires_at "+
+			"FROM transfers JOIN users ON users.id = transfers.recipient_id "+
+			"WHERE transfers.id = $1 AND transfers.sender_id = $2 FOR UPDATE OF transfers",
+		id, senderID).Scan(&recipientID, &transfer.To, &transfer.Amount, &transfer.Status, &expired,
+		&createdAt, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return transfer, ErrTransferNotFound
+	}
+	if err != nil {
+		return transfer, err
+	}
+	transfer.ID = id
+	transfer.From = login
+	if transfer.Status != TransferPending {
+		formatTransferTimes(&transfer, createdAt, expiresAt, nil)
+		return transfer, ErrTransferNotPending
+	}
+	if expired {
+		if _, err = tx.Exec(ctx, "UPDATE transfers SET status = 'EXPIRED' WHERE id = $1", id); err != nil {
+			return transfer, err
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return transfer, err
+		}
+		transfer.Status = TransferExpired
+		formatTransferTimes(&transfer, createdAt, expiresAt, nil)
+		return transfer, ErrTransferNotPending
+	}
+
+	if err = checkTransfer(ctx, tx, senderID, login, transfer.Amount, limits); err != nil {
+		return transfer, err
+	}
+	var completedAt time.Time
+	err = tx.QueryRow(ctx,
+		"UPDATE transfers SET status = 'COMPLETED', completed_at = Now() WHERE id = $1 RETURNING completed_at",
+		id).Scan(&completedAt)
+	if err != nil {
+		return transfer, err
+	}
+	if err = moveLots(ctx, tx, senderID, recipientID, transfer.Amount); err != nil {
+		return transfer, err
+	}
+	if err = notifyTransfer(ctx, tx, login, transfer.To); err != nil {
+		return transfer, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return transfer, err
+	}
+	p.replicas.pin(login)
+	p.replicas.pin(transfer.To)
+
+	transfer.Status = TransferCompleted
+	formatTransferTimes(&transfer, createdAt, expiresAt, &completedAt)
+	return transfer, nil
+}
+
+// checkTransfer checks that the sender can afford amount within their daily limit.
+func checkTransfer(
+	ctx context.Context,
+	tx pgx.Tx,
+	senderID int,
+	login string,
+	amount float64,
+	limits config.Transfers,
+) error {
+	if limits.DailyLimit > 0 {
+		var sent float64
+		err := tx.QueryRow(ctx,
+			"SELECT COALESCE(SUM(amount), 0) FROM transfers "+
+				"WHERE sender_id = $1 AND status = 'COMPLETED' AND completed_at > Now() - interval '1 day'",
+			senderID).Scan(&sent)
+		if err != nil {
+			return err
+		}
+		if sent+amount > limits.DailyLimit {
+			return ErrTransferLimitExceeded
+		}
+	}
+
+	balance, err := scanBalance(tx.QueryRow(ctx, queryBalance, login))
+	if err != nil {
+		return err
+	}
+	if amount > balance.Current {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// moveLots spends amount from the lots of the sender and credits all of it to the recipient.
+func moveLots(ctx context.Context, tx pgx.Tx, senderID, recipientID int, amount float64) error {
+	spent, err := spendLots(ctx, tx, senderID, amount, nil)
+	if err != nil {
+		return err
+	}
+	return creditSpentLots(ctx, tx, recipientID, spent, amount)
+}
+
+// notifyTransfer publishes the balance changes of both sides of a completed transfer.
+func notifyTransfer(ctx context.Context, tx pgx.Tx, from, to string) error {
+	if err := notify(ctx, tx, Event{Type: EventBalance, Login: from}); err != nil {
+		return err
+	}
+	return notify(ctx, tx, Event{Type: EventBalance, Login: to})
+}
+
+func formatTransferTimes(transfer *TransferInfo, createdAt time.Time, expiresAt, completedAt *time.Time) {
+	transfer.CreatedAt = createdAt.Format(time.RFC3339)
+	if expiresAt != nil {
+		transfer.ExpiresAt = expiresAt.Format(time.RFC3339)
+	}
+	if completedAt != nil {
+		transfer.CompletedAt = completedAt.Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// webhookDeliveriesLimit caps the deliveries listed for a subscription.
+const webhookDeliveriesLimit = 100
+
+func (p *PostgresRepository) CreateWebhook(
+	ctx context.Context,
+	webhook WebhookInfo,
+) (WebhookInfo, error) {
+	var createdAt time.Time
+	err := p.pool.QueryRow(ctx,
+		"INSERT INTO webhook_subscriptions (client, url, events, merchants) VALUES ($1, $2, $3, $4) "+
+			"RETURNING id, secret, created_at",
+		webhook.Client, webhook.URL, webhook.Events, webhook.Merchants).Scan(&webhook.ID, &webhook.Secret, &createdAt)
+	if err != nil {
+		return WebhookInfo{}, err
+	}
+	webhook.CreatedAt = createdAt.Format(time.RFC3339)
+	return webhook, nil
+}
+
+func (p *PostgresRepository) Webhooks(
+	ctx context.Context,
+	client string,
+) (webhooks []WebhookInfo, err error) {
+	rows, err := p.pool.Query(ctx,
+		"SELECT id, url, events, merchants, created_at FROM webhook_subscriptions WHERE client = $1 ORDER BY id",
+		client)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		webhook := WebhookInfo{Client: client}
+		var createdAt time.Time
+		if err = rows.Scan(&webhook.ID, &webhook.URL, &webhook.Events, &webhook.Merchants, &createdAt); err != nil {
+			return nil, err
+		}
+		webhook.CreatedAt = createdAt.Format(time.RFC3339)
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (p *PostgresRepository) DeleteWebhook(
+	ctx context.Context,
+	client string,
+	id int64,
+) error {
+	tag, err := p.pool.Exec(ctx, "DELETE FROM webhook_subscriptions WHERE id = $1 AND client = $2", id, client)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (p *PostgresRepository) WebhookDeliveries(
+	ctx context.Context,
+	client string,
+	id int64,
+) (deliveries []WebhookDeliveryInfo, err error) {
+	var exists bool
+	err = p.pool.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1 AND client = $2)",
+		id, client).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	rows, err := p.pool.Query(ctx,
+		"SELECT id, event, status, attempts, COALESCE(last_status_code, 0), last_error, "+
+			"created_at, next_attempt_at, delivered_at FROM webhook_deliveries "+
+			"WHERE subscription_id = $1 ORDER BY id DESC LIMIT $2",
+		id, webhookDeliveriesLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			delivery                 WebhookDeliveryInfo
+			createdAt, nextAttemptAt time.Time
+			deliveredAt              *time.Time
+		)
+		err = rows.Scan(&delivery.ID, &delivery.Event, &delivery.Status, &delivery.Attempts,
+			&delivery.StatusCode, &delivery.Error, &createdAt, &nextAttemptAt, &deliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.CreatedAt = createdAt.Format(time.RFC3339)
+		if delivery.Status == WebhookPending {
+			delivery.NextAttemptAt = nextAttemptAt.Format(time.RFC3339)
+		}
+		if deliveredAt != nil {
+			delivery.DeliveredAt = deliveredAt.Format(time.RFC3339)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (p *PostgresRepository) ClaimWebhookDeliveries(
+	ctx context.Context,
+	limit int,
+	lease time.Duration,
+) (deliveries []WebhookDelivery, err error) {
+	// Skipping locked rows lets several instances claim side by side, the lease
+	// keeps a delivery from being sent twice while its attempt is in flight.
+	rows, err := p.pool.Query(ctx,
+		"UPDATE webhook_deliveries SET next_attempt_at = Now() + $2::interval "+
+			"FROM webhook_subscriptions "+
+			"WHERE webhook_deliveries.id IN (SELECT id FROM webhook_deliveries "+
+			"WHERE status = 'PENDING' AND next_attempt_at <= Now() "+
+			"ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED) "+
+			"AND webhook_subscriptions.id = webhook_deliveries.subscription_id "+
+			"RETURNING webhook_deliveries.id, webhook_subscriptions.url, webhook_subscriptions.secret, "+
+			"webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.attempts, "+
+			"webhook_deliveries.created_at",
+		limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			delivery WebhookDelivery
+			payload  string
+		)
+		err = rows.Scan(&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.Event, &payload,
+			&delivery.Attempts, &delivery.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = []byte(payload)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (p *PostgresRepository) RecordWebhookAttempt(
+	ctx context.Context,
+	id int64,
+	attempt WebhookAttempt,
+) error {
+	_, err := p.pool.Exec(ctx,
+		"UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, "+
+			"last_status_code = NULLIF($3, 0), last_error = $4, next_attempt_at = Now() + $5::interval, "+
+			"delivered_at = CASE WHEN $2 = 'DELIVERED' THEN Now() END "+
+			"WHERE id = $1",
+		id, attempt.Status, attempt.StatusCode, attempt.Error, attempt.RetryIn)
+	return err
+}
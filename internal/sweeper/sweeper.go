@@ -0,0 +1,79 @@
+// Package sweeper periodically cleans up state that ran out.
+package sweeper
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/metrics"
+	"VladBag2022/gophermart/internal/storage"
+)
+
+// Sweeper expires withdrawal holds that were neither captured nor voided in time,
+// expires points left unspent for longer than their TTL and forgets idempotency
+// keys past their window. Expired holds stop reducing the balance right away,
+// sweeping only records it, whereas points stay spendable until swept.
+type Sweeper struct {
+	repository        storage.Repository
+	interval          time.Duration
+	idempotencyWindow time.Duration
+	pointsTTL         time.Duration
+}
+
+func NewSweeper(repository storage.Repository, config *config.Config) Sweeper {
+	return Sweeper{
+		repository:        repository,
+		interval:          config.Balance.SweepInterval,
+		idempotencyWindow: config.Server.IdempotencyWindow,
+		pointsTTL:         config.Balance.PointsTTL,
+	}
+}
+
+func (s Sweeper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.sweep(ctx); err != nil {
+				log.Errorf("Sweep failed: %s", err)
+			}
+		}
+	}
+}
+
+func (s Sweeper) sweep(ctx context.Context) error {
+	expired, err := s.repository.ExpireHolds(ctx)
+	if err != nil {
+		return err
+	}
+	if expired > 0 {
+		log.Infof("Expired %d withdrawal holds", expired)
+	}
+	metrics.HoldsExpired.Add(expired)
+
+	if s.pointsTTL > 0 {
+		lots, points, err := s.repository.ExpirePoints(ctx, s.pointsTTL)
+		if err != nil {
+			return err
+		}
+		if lots > 0 {
+			log.Infof("Expired %.2f points of %d lots", points, lots)
+		}
+		metrics.PointsExpired.Add(points)
+	}
+
+	purged, err := s.repository.PurgeIdempotencyKeys(ctx, s.idempotencyWindow)
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		log.Debugf("Purged %d idempotency keys", purged)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package sweeper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/metrics"
+	"VladBag2022/gophermart/mocks"
+)
+
+func TestSweeper_sweep(t *testing.T) {
+	repository := new(mocks.Repository)
+	repository.On("ExpireHolds", mock.Anything).Return(int64(3), nil).Once()
+	repository.On("ExpireHolds", mock.Anything).Return(int64(0), errors.New("connection refused")).Once()
+	repository.On("PurgeIdempotencyKeys", mock.Anything, config.Default().Server.IdempotencyWindow).
+		Return(int64(1), nil).Once()
+	s := NewSweeper(repository, config.Default())
+
+	before := metrics.HoldsExpired.Value()
+	assert.NoError(t, s.sweep(context.Background()))
+	assert.Equal(t, before+3, metrics.HoldsExpired.Value())
+
+	assert.Error(t, s.sweep(context.Background()))
+	repository.AssertExpectations(t)
+}
+
+func TestSweeper_sweepPoints(t *testing.T) {
+	cfg := config.Default()
+	repository := new(mocks.Repository)
+	repository.On("ExpireHolds", mock.Anything).Return(int64(0), nil)
+	repository.On("PurgeIdempotencyKeys", mock.Anything, cfg.Server.IdempotencyWindow).Return(int64(0), nil)
+	assert.NoError(t, NewSweeper(repository, cfg).sweep(context.Background()))
+	repository.AssertNotCalled(t, "ExpirePoints", mock.Anything, mock.Anything)
+
+	cfg.Balance.PointsTTL = 365 * 24 * time.Hour
+	repository.On("ExpirePoints", mock.Anything, cfg.Balance.PointsTTL).Return(int64(2), 150.5, nil).Once()
+	before := metrics.PointsExpired.Value()
+	assert.NoError(t, NewSweeper(repository, cfg).sweep(context.Background()))
+	assert.Equal(t, before+150.5, metrics.PointsExpired.Value())
+	repository.AssertExpectations(t)
+}
@@ -0,0 +1,61 @@
+// Package tiers periodically moves users between loyalty tiers.
+package tiers
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/metrics"
+	"VladBag2022/gophermart/internal/storage"
+)
+
+// Recalculator assigns users the tier their rolling basis amount reaches. It
+// runs once on start, so that changed tier settings apply right away, and then
+// every interval.
+type Recalculator struct {
+	repository storage.Repository
+	interval   time.Duration
+	tiers      []config.Tier
+	basis      string
+	window     time.Duration
+}
+
+func NewRecalculator(repository storage.Repository, config *config.Config) Recalculator {
+	return Recalculator{
+		repository: repository,
+		interval:   config.Loyalty.RecalculateInterval,
+		tiers:      config.Loyalty.Tiers,
+		basis:      config.Loyalty.Basis,
+		window:     config.Loyalty.Window,
+	}
+}
+
+func (r Recalculator) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.recalculate(ctx); err != nil {
+			log.Errorf("Tier recalculation failed: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r Recalculator) recalculate(ctx context.Context) error {
+	changed, err := r.repository.RecalculateTiers(ctx, r.tiers, r.basis, r.window)
+	if err != nil {
+		return err
+	}
+	if changed > 0 {
+		log.Infof("Moved %d users to another tier", changed)
+	}
+	metrics.TierChanges.Add(changed)
+	return nil
+}
@@ -0,0 +1,36 @@
+package tiers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/metrics"
+	"VladBag2022/gophermart/mocks"
+)
+
+func TestRecalculator_recalculate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Loyalty.Tiers = []config.Tier{
+		{Name: "bronze", Threshold: 0, Multiplier: 1},
+		{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+		{Name: "gold", Threshold: 5000, Multiplier: 1.25},
+	}
+	repository := new(mocks.Repository)
+	repository.On("RecalculateTiers", mock.Anything, cfg.Loyalty.Tiers, config.TierBasisAccrual, cfg.Loyalty.Window).
+		Return(int64(4), nil).Once()
+	repository.On("RecalculateTiers", mock.Anything, cfg.Loyalty.Tiers, config.TierBasisAccrual, cfg.Loyalty.Window).
+		Return(int64(0), errors.New("connection refused")).Once()
+	r := NewRecalculator(repository, cfg)
+
+	before := metrics.TierChanges.Value()
+	assert.NoError(t, r.recalculate(context.Background()))
+	assert.Equal(t, before+4, metrics.TierChanges.Value())
+
+	assert.Error(t, r.recalculate(context.Background()))
+	repository.AssertExpectations(t)
+}
@@ -0,0 +1,57 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Resolver looks up the addresses of a host, as net.DefaultResolver does.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var errForbiddenAddress = errors.New("webhooks may not target private, loopback or link-local addresses")
+
+// forbidden tells whether ip is an address of the instance or of its network,
+// which API clients must not make deliveries reach.
+func forbidden(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// CheckHost checks that every address host resolves to may receive deliveries.
+// Deliveries check the address they dial again, as DNS answers may change.
+func CheckHost(ctx context.Context, resolver Resolver, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if forbidden(ip) {
+			return errForbiddenAddress
+		}
+		return nil
+	}
+	addresses, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s: %w", host, err)
+	}
+	for _, address := range addresses {
+		if forbidden(address.IP) {
+			return errForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// dialControl refuses connections to forbidden addresses once they are resolved.
+func dialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || forbidden(ip) {
+		return errForbiddenAddress
+	}
+	return nil
+}
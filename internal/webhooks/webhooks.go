@@ -0,0 +1,184 @@
+// Package webhooks pushes order and balance events to the URLs API clients subscribed.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"VladBag2022/gophermart/internal/accrual"
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/metrics"
+	"VladBag2022/gophermart/internal/storage"
+)
+
+// Headers of a delivery. It is signed like accrual status pushes: the hex
+// encoded HMAC-SHA256 of "<timestamp>.<body>" keyed with the subscription
+// secret. Retries keep the delivery id, so receivers can drop repeats.
+const (
+	DeliveryHeader  = "X-Gophermart-Delivery"
+	EventHeader     = "X-Gophermart-Event"
+	SignatureHeader = "X-Gophermart-Signature"
+	TimestampHeader = "X-Gophermart-Timestamp"
+)
+
+// Payload is the body of a delivery. Data is the event as streamed to users.
+type Payload struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt string          `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Deliverer sends pending deliveries, retrying failed ones with exponential
+// backoff until they run out of attempts.
+type Deliverer struct {
+	repository storage.Repository
+	client     *http.Client
+	config     config.Webhooks
+}
+
+func NewDeliverer(repository storage.Repository, config *config.Config) Deliverer {
+	// Deliveries go straight to their receivers, never to forbidden addresses,
+	// and redirects are not followed, they fail the attempt.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: config.Webhooks.Timeout, Control: dialControl}).DialContext
+	return Deliverer{
+		repository: repository,
+		client: &http.Client{
+			Timeout:   config.Webhooks.Timeout,
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		config: config.Webhooks,
+	}
+}
+
+func (d Deliverer) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := d.deliver(ctx); err != nil {
+				log.Errorf("Webhook delivery failed: %s", err)
+			}
+		}
+	}
+}
+
+func (d Deliverer) deliver(ctx context.Context) error {
+	// The lease outlasts the attempts of a batch, which are sent side by side.
+	deliveries, err := d.repository.ClaimWebhookDeliveries(ctx, d.config.BatchSize, 2*d.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(deliveries))
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery storage.WebhookDelivery) {
+			defer wg.Done()
+			attempt := d.attempt(ctx, delivery)
+			switch attempt.Status {
+			case storage.WebhookDelivered:
+				metrics.WebhooksDelivered.Add(1)
+			case storage.WebhookFailed:
+				metrics.WebhooksFailed.Add(1)
+				log.Warnf("Webhook delivery %d to %s failed for good: %s", delivery.ID, delivery.URL, attempt.Error)
+			}
+			errs <- d.repository.RecordWebhookAttempt(ctx, delivery.ID, attempt)
+		}(delivery)
+	}
+	wg.Wait()
+	close(errs)
+
+	for rErr := range errs {
+		if rErr != nil {
+			return rErr
+		}
+	}
+	return nil
+}
+
+// attempt sends delivery once and tells what becomes of it.
+func (d Deliverer) attempt(ctx context.Context, delivery storage.WebhookDelivery) storage.WebhookAttempt {
+	attempt := storage.WebhookAttempt{Status: storage.WebhookDelivered}
+	attempt.StatusCode, attempt.Error = d.send(ctx, delivery)
+	if len(attempt.Error) == 0 {
+		return attempt
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= d.config.MaxAttempts {
+		attempt.Status = storage.WebhookFailed
+		return attempt
+	}
+	attempt.Status = storage.WebhookPending
+	attempt.RetryIn = d.backoff(attempts)
+	return attempt
+}
+
+// send posts delivery, returning the response status and why it failed, if it did.
+func (d Deliverer) send(ctx context.Context, delivery storage.WebhookDelivery) (int, string) {
+	body, err := json.Marshal(Payload{
+		ID:        delivery.ID,
+		Event:     delivery.Event,
+		CreatedAt: delivery.CreatedAt.Format(time.RFC3339),
+		Data:      delivery.Payload,
+	})
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	if request.URL.Scheme != "https" {
+		return 0, "url must be an HTTPS URL"
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(EventHeader, delivery.Event)
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, accrual.Sign([]byte(delivery.Secret), timestamp, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Sprintf("unexpected status %d", response.StatusCode)
+	}
+	return response.StatusCode, ""
+}
+
+// backoff is the pause after the given number of failed attempts.
+func (d Deliverer) backoff(attempts int) time.Duration {
+	pause := d.config.BackoffBase
+	for i := 1; i < attempts && pause < d.config.BackoffMax; i++ {
+		pause *= 2
+	}
+	if pause > d.config.BackoffMax {
+		return d.config.BackoffMax
+	}
+	return pause
+}
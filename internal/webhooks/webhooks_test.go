@@ -0,0 +1,176 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"VladBag2022/gophermart/internal/accrual"
+	"VladBag2022/gophermart/internal/config"
+	"VladBag2022/gophermart/internal/storage"
+	"VladBag2022/gophermart/mocks"
+)
+
+func TestDeliverer_deliver(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		attempts   int
+		want       storage.WebhookAttempt
+	}{
+		{
+			name:       "positive test - delivered",
+			statusCode: http.StatusNoContent,
+			want:       storage.WebhookAttempt{Status: storage.WebhookDelivered, StatusCode: http.StatusNoContent},
+		},
+		{
+			name:       "negative test - retried with backoff",
+			statusCode: http.StatusServiceUnavailable,
+			attempts:   2,
+			want: storage.WebhookAttempt{
+				Status:     storage.WebhookPending,
+				StatusCode: http.StatusServiceUnavailable,
+				Error:      "unexpected status 503",
+				RetryIn:    40 * time.Second,
+			},
+		},
+		{
+			name:       "negative test - out of attempts",
+			statusCode: http.StatusInternalServerError,
+			attempts:   9,
+			want: storage.WebhookAttempt{
+				Status:     storage.WebhookFailed,
+				StatusCode: http.StatusInternalServerError,
+				Error:      "unexpected status 500",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := `{"type":"order","login":"a","order":"12345678903","status":"PROCESSED","accrual":500}`
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.NoError(t, accrual.Verify([]byte("secret"), r.Header.Get(SignatureHeader),
+					r.Header.Get(TimestampHeader), body, time.Minute, time.Now()))
+				assert.Equal(t, "7", r.Header.Get(DeliveryHeader))
+				assert.Equal(t, storage.EventOrder, r.Header.Get(EventHeader))
+
+				var payload Payload
+				require.NoError(t, json.Unmarshal(body, &payload))
+				assert.Equal(t, int64(7), payload.ID)
+				assert.Equal(t, "2026-10-19T10:00:00Z", payload.CreatedAt)
+				assert.JSONEq(t, event, string(payload.Data))
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer ts.Close()
+
+			cfg := config.Default()
+			repository := new(mocks.Repository)
+			repository.On("ClaimWebhookDeliveries", mock.Anything, cfg.Webhooks.BatchSize, 2*cfg.Webhooks.Timeout).
+				Return([]storage.WebhookDelivery{{
+					ID:        7,
+					URL:       ts.URL,
+					Secret:    "secret",
+					Event:     storage.EventOrder,
+					Payload:   []byte(event),
+					Attempts:  tt.attempts,
+					CreatedAt: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC),
+				}}, nil)
+			repository.On("RecordWebhookAttempt", mock.Anything, int64(7), tt.want).Return(nil).Once()
+
+			d := NewDeliverer(repository, cfg)
+			// The test server listens on loopback, which deliveries may not reach.
+			d.client = ts.Client()
+			assert.NoError(t, d.deliver(context.Background()))
+			repository.AssertExpectations(t)
+		})
+	}
+}
+
+func TestDeliverer_forbiddenTargets(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("delivery reached a loopback address")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name  string
+		url   string
+		error string
+	}{
+		{
+			name:  "negative test - loopback address",
+			url:   ts.URL,
+			error: errForbiddenAddress.Error(),
+		},
+		{
+			name:  "negative test - plain http",
+			url:   "http://mobile.example/hooks",
+			error: "url must be an HTTPS URL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			repository := new(mocks.Repository)
+			repository.On("ClaimWebhookDeliveries", mock.Anything, cfg.Webhooks.BatchSize, 2*cfg.Webhooks.Timeout).
+				Return([]storage.WebhookDelivery{{ID: 7, URL: tt.url, Secret: "secret", Event: storage.EventOrder}}, nil)
+			repository.On("RecordWebhookAttempt", mock.Anything, int64(7),
+				mock.MatchedBy(func(attempt storage.WebhookAttempt) bool {
+					return attempt.Status == storage.WebhookPending && strings.Contains(attempt.Error, tt.error)
+				})).Return(nil).Once()
+
+			assert.NoError(t, NewDeliverer(repository, cfg).deliver(context.Background()))
+			repository.AssertExpectations(t)
+		})
+	}
+}
+
+// testResolver resolves hosts without DNS.
+type testResolver map[string][]net.IPAddr
+
+func (r testResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addresses, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addresses, nil
+}
+
+func TestCheckHost(t *testing.T) {
+	resolver := testResolver{
+		"mobile.example":   {{IP: net.ParseIP("203.0.113.10")}, {IP: net.ParseIP("2001:db8::10")}},
+		"intranet.example": {{IP: net.ParseIP("192.168.1.20")}},
+		"metadata.example": {{IP: net.ParseIP("169.254.169.254")}},
+	}
+	assert.NoError(t, CheckHost(context.Background(), resolver, "mobile.example"))
+	assert.NoError(t, CheckHost(context.Background(), resolver, "203.0.113.10"))
+	assert.Equal(t, errForbiddenAddress, CheckHost(context.Background(), resolver, "intranet.example"))
+	assert.Equal(t, errForbiddenAddress, CheckHost(context.Background(), resolver, "metadata.example"))
+	assert.Equal(t, errForbiddenAddress, CheckHost(context.Background(), resolver, "127.0.0.1"))
+	assert.Equal(t, errForbiddenAddress, CheckHost(context.Background(), resolver, "::1"))
+	assert.Equal(t, errForbiddenAddress, CheckHost(context.Background(), resolver, "0.0.0.0"))
+	assert.Error(t, CheckHost(context.Background(), resolver, "unknown.example"))
+}
+
+func TestDeliverer_backoff(t *testing.T) {
+	d := NewDeliverer(new(mocks.Repository), config.Default())
+	assert.Equal(t, 10*time.Second, d.backoff(1))
+	assert.Equal(t, 20*time.Second, d.backoff(2))
+	assert.Equal(t, 320*time.Second, d.backoff(6))
+	assert.Equal(t, 2560*time.Second, d.backoff(9))
+	assert.Equal(t, time.Hour, d.backoff(10))
+	assert.Equal(t, time.Hour, d.backoff(1000))
+}
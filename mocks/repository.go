@@ -3,10 +3,14 @@
 package mocks
 
 import (
-	storage "VladBag2022/gophermart/internal/storage"
+	config "VladBag2022/gophermart/internal/config"
 	context "context"
 
 	mock "github.com/stretchr/testify/mock"
+
+	storage "VladBag2022/gophermart/internal/storage"
+
+	time "time"
 )
 
 // Repository is an autogenerated mock type for the Repository type
@@ -14,22 +18,36 @@ type Repository struct {
 	mock.Mock
 }
 
-// AccrualOrders provides a mock function with given fields: ctx
-func (_m *Repository) AccrualOrders(ctx context.Context) ([]int64, error) {
-	ret := _m.Called(ctx)
+// AccrualFailed provides a mock function with given fields: ctx, orders, reason
+func (_m *Repository) AccrualFailed(ctx context.Context, orders []int64, reason string) error {
+	ret := _m.Called(ctx, orders, reason)
 
-	var r0 []int64
-	if rf, ok := ret.Get(0).(func(context.Context) []int64); ok {
-		r0 = rf(ctx)
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []int64, string) error); ok {
+		r0 = rf(ctx, orders, reason)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AccrualOrders provides a mock function with given fields: ctx, minAge
+func (_m *Repository) AccrualOrders(ctx context.Context, minAge time.Duration) ([]storage.AccrualOrder, error) {
+	ret := _m.Called(ctx, minAge)
+
+	var r0 []storage.AccrualOrder
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration) []storage.AccrualOrder); ok {
+		r0 = rf(ctx, minAge)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]int64)
+			r0 = ret.Get(0).([]storage.AccrualOrder)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
-		r1 = rf(ctx)
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration) error); ok {
+		r1 = rf(ctx, minAge)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -58,6 +76,117 @@ func (_m *Repository) Balance(ctx context.Context, login string) (storage.Balanc
 	return r0, r1
 }
 
+// BalanceHistory provides a mock function with given fields: ctx, login
+func (_m *Repository) BalanceHistory(ctx context.Context, login string) ([]storage.BalanceEntry, error) {
+	ret := _m.Called(ctx, login)
+
+	var r0 []storage.BalanceEntry
+	if rf, ok := ret.Get(0).(func(context.Context, string) []storage.BalanceEntry); ok {
+		r0 = rf(ctx, login)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.BalanceEntry)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, login)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Campaign provides a mock function with given fields: ctx, id
+func (_m *Repository) Campaign(ctx context.Context, id int64) (storage.CampaignInfo, error) {
+	ret := _m.Called(ctx, id)
+
+	var r0 storage.CampaignInfo
+	if rf, ok := ret.Get(0).(func(context.Context, int64) storage.CampaignInfo); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Get(0).(storage.CampaignInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Campaigns provides a mock function with given fields: ctx
+func (_m *Repository) Campaigns(ctx context.Context) ([]storage.CampaignInfo, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []storage.CampaignInfo
+	if rf, ok := ret.Get(0).(func(context.Context) []storage.CampaignInfo); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.CampaignInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CaptureHold provides a mock function with given fields: ctx, login, id
+func (_m *Repository) CaptureHold(ctx context.Context, login string, id int64) (storage.HoldInfo, error) {
+	ret := _m.Called(ctx, login, id)
+
+	var r0 storage.HoldInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) storage.HoldInfo); ok {
+		r0 = rf(ctx, login, id)
+	} else {
+		r0 = ret.Get(0).(storage.HoldInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, login, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ClaimWebhookDeliveries provides a mock function with given fields: ctx, limit, lease
+func (_m *Repository) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]storage.WebhookDelivery, error) {
+	ret := _m.Called(ctx, limit, lease)
+
+	var r0 []storage.WebhookDelivery
+	if rf, ok := ret.Get(0).(func(context.Context, int, time.Duration) []storage.WebhookDelivery); ok {
+		r0 = rf(ctx, limit, lease)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.WebhookDelivery)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int, time.Duration) error); ok {
+		r1 = rf(ctx, limit, lease)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Close provides a mock function with given fields:
 func (_m *Repository) Close() error {
 	ret := _m.Called()
@@ -72,20 +201,20 @@ func (_m *Repository) Close() error {
 	return r0
 }
 
-// IsLoginAvailable provides a mock function with given fields: ctx, login
-func (_m *Repository) IsLoginAvailable(ctx context.Context, login string) (bool, error) {
-	ret := _m.Called(ctx, login)
+// ConfirmTransfer provides a mock function with given fields: ctx, login, id, limits
+func (_m *Repository) ConfirmTransfer(ctx context.Context, login string, id int64, limits config.Transfers) (storage.TransferInfo, error) {
+	ret := _m.Called(ctx, login, id, limits)
 
-	var r0 bool
-	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
-		r0 = rf(ctx, login)
+	var r0 storage.TransferInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64, config.Transfers) storage.TransferInfo); ok {
+		r0 = rf(ctx, login, id, limits)
 	} else {
-		r0 = ret.Get(0).(bool)
+		r0 = ret.Get(0).(storage.TransferInfo)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
-		r1 = rf(ctx, login)
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64, config.Transfers) error); ok {
+		r1 = rf(ctx, login, id, limits)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -93,20 +222,20 @@ func (_m *Repository) IsLoginAvailable(ctx context.Context, login string) (bool,
 	return r0, r1
 }
 
-// Login provides a mock function with given fields: ctx, login, password
-func (_m *Repository) Login(ctx context.Context, login string, password string) (bool, error) {
-	ret := _m.Called(ctx, login, password)
+// CreateCampaign provides a mock function with given fields: ctx, campaign
+func (_m *Repository) CreateCampaign(ctx context.Context, campaign storage.CampaignInfo) (storage.CampaignInfo, error) {
+	ret := _m.Called(ctx, campaign)
 
-	var r0 bool
-	if rf, ok := ret.Get(0).(func(context.Context, string, string) bool); ok {
-		r0 = rf(ctx, login, password)
+	var r0 storage.CampaignInfo
+	if rf, ok := ret.Get(0).(func(context.Context, storage.CampaignInfo) storage.CampaignInfo); ok {
+		r0 = rf(ctx, campaign)
 	} else {
-		r0 = ret.Get(0).(bool)
+		r0 = ret.Get(0).(storage.CampaignInfo)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
-		r1 = rf(ctx, login, password)
+	if rf, ok := ret.Get(1).(func(context.Context, storage.CampaignInfo) error); ok {
+		r1 = rf(ctx, campaign)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -114,20 +243,20 @@ func (_m *Repository) Login(ctx context.Context, login string, password string)
 	return r0, r1
 }
 
-// OrderOwner provides a mock function with given fields: ctx, order
-func (_m *Repository) OrderOwner(ctx context.Context, order int64) (string, error) {
-	ret := _m.Called(ctx, order)
+// CreateHold provides a mock function with given fields: ctx, login, order, sum, ttl
+func (_m *Repository) CreateHold(ctx context.Context, login string, order string, sum float64, ttl time.Duration) (storage.HoldInfo, error) {
+	ret := _m.Called(ctx, login, order, sum, ttl)
 
-	var r0 string
-	if rf, ok := ret.Get(0).(func(context.Context, int64) string); ok {
-		r0 = rf(ctx, order)
+	var r0 storage.HoldInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, float64, time.Duration) storage.HoldInfo); ok {
+		r0 = rf(ctx, login, order, sum, ttl)
 	} else {
-		r0 = ret.Get(0).(string)
+		r0 = ret.Get(0).(storage.HoldInfo)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, int64) error); ok {
-		r1 = rf(ctx, order)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, float64, time.Duration) error); ok {
+		r1 = rf(ctx, login, order, sum, ttl)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -135,22 +264,92 @@ func (_m *Repository) OrderOwner(ctx context.Context, order int64) (string, erro
 	return r0, r1
 }
 
-// Orders provides a mock function with given fields: ctx, login
-func (_m *Repository) Orders(ctx context.Context, login string) ([]storage.OrderInfo, error) {
-	ret := _m.Called(ctx, login)
+// CreateMerchant provides a mock function with given fields: ctx, merchant
+func (_m *Repository) CreateMerchant(ctx context.Context, merchant storage.MerchantInfo) (storage.MerchantInfo, error) {
+	ret := _m.Called(ctx, merchant)
 
-	var r0 []storage.OrderInfo
-	if rf, ok := ret.Get(0).(func(context.Context, string) []storage.OrderInfo); ok {
-		r0 = rf(ctx, login)
+	var r0 storage.MerchantInfo
+	if rf, ok := ret.Get(0).(func(context.Context, storage.MerchantInfo) storage.MerchantInfo); ok {
+		r0 = rf(ctx, merchant)
+	} else {
+		r0 = ret.Get(0).(storage.MerchantInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, storage.MerchantInfo) error); ok {
+		r1 = rf(ctx, merchant)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CreateWebhook provides a mock function with given fields: ctx, webhook
+func (_m *Repository) CreateWebhook(ctx context.Context, webhook storage.WebhookInfo) (storage.WebhookInfo, error) {
+	ret := _m.Called(ctx, webhook)
+
+	var r0 storage.WebhookInfo
+	if rf, ok := ret.Get(0).(func(context.Context, storage.WebhookInfo) storage.WebhookInfo); ok {
+		r0 = rf(ctx, webhook)
+	} else {
+		r0 = ret.Get(0).(storage.WebhookInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, storage.WebhookInfo) error); ok {
+		r1 = rf(ctx, webhook)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeadLetterOrders provides a mock function with given fields: ctx, maxAge, maxAttempts
+func (_m *Repository) DeadLetterOrders(ctx context.Context, maxAge time.Duration, maxAttempts int) (int64, int64, error) {
+	ret := _m.Called(ctx, maxAge, maxAttempts)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration, int) int64); ok {
+		r0 = rf(ctx, maxAge, maxAttempts)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration, int) int64); ok {
+		r1 = rf(ctx, maxAge, maxAttempts)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, time.Duration, int) error); ok {
+		r2 = rf(ctx, maxAge, maxAttempts)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// DeadLetters provides a mock function with given fields: ctx
+func (_m *Repository) DeadLetters(ctx context.Context) ([]storage.DeadLetterInfo, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []storage.DeadLetterInfo
+	if rf, ok := ret.Get(0).(func(context.Context) []storage.DeadLetterInfo); ok {
+		r0 = rf(ctx)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]storage.OrderInfo)
+			r0 = ret.Get(0).([]storage.DeadLetterInfo)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
-		r1 = rf(ctx, login)
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -158,13 +357,13 @@ func (_m *Repository) Orders(ctx context.Context, login string) ([]storage.Order
 	return r0, r1
 }
 
-// Register provides a mock function with given fields: ctx, login, password
-func (_m *Repository) Register(ctx context.Context, login string, password string) error {
-	ret := _m.Called(ctx, login, password)
+// DeleteCampaign provides a mock function with given fields: ctx, id
+func (_m *Repository) DeleteCampaign(ctx context.Context, id int64) error {
+	ret := _m.Called(ctx, id)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
-		r0 = rf(ctx, login, password)
+	if rf, ok := ret.Get(0).(func(context.Context, int64) error); ok {
+		r0 = rf(ctx, id)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -172,13 +371,13 @@ func (_m *Repository) Register(ctx context.Context, login string, password strin
 	return r0
 }
 
-// UpdateOrder provides a mock function with given fields: ctx, order, status, accrual
-func (_m *Repository) UpdateOrder(ctx context.Context, order int64, status string, accrual float64) error {
-	ret := _m.Called(ctx, order, status, accrual)
+// DeleteWebhook provides a mock function with given fields: ctx, client, id
+func (_m *Repository) DeleteWebhook(ctx context.Context, client string, id int64) error {
+	ret := _m.Called(ctx, client, id)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, int64, string, float64) error); ok {
-		r0 = rf(ctx, order, status, accrual)
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) error); ok {
+		r0 = rf(ctx, client, id)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -186,13 +385,129 @@ func (_m *Repository) UpdateOrder(ctx context.Context, order int64, status strin
 	return r0
 }
 
-// UploadOrder provides a mock function with given fields: ctx, login, order
-func (_m *Repository) UploadOrder(ctx context.Context, login string, order int64) error {
-	ret := _m.Called(ctx, login, order)
+// DryRunCampaigns provides a mock function with given fields: ctx, order, accrual
+func (_m *Repository) DryRunCampaigns(ctx context.Context, order int64, accrual float64) ([]storage.CampaignEvaluation, error) {
+	ret := _m.Called(ctx, order, accrual)
+
+	var r0 []storage.CampaignEvaluation
+	if rf, ok := ret.Get(0).(func(context.Context, int64, float64) []storage.CampaignEvaluation); ok {
+		r0 = rf(ctx, order, accrual)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.CampaignEvaluation)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, float64) error); ok {
+		r1 = rf(ctx, order, accrual)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ExpireHolds provides a mock function with given fields: ctx
+func (_m *Repository) ExpireHolds(ctx context.Context) (int64, error) {
+	ret := _m.Called(ctx)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context) int64); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ExpirePoints provides a mock function with given fields: ctx, ttl
+func (_m *Repository) ExpirePoints(ctx context.Context, ttl time.Duration) (int64, float64, error) {
+	ret := _m.Called(ctx, ttl)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration) int64); ok {
+		r0 = rf(ctx, ttl)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 float64
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration) float64); ok {
+		r1 = rf(ctx, ttl)
+	} else {
+		r1 = ret.Get(1).(float64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, time.Duration) error); ok {
+		r2 = rf(ctx, ttl)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// ExpiringPoints provides a mock function with given fields: ctx, login, ttl, notice
+func (_m *Repository) ExpiringPoints(ctx context.Context, login string, ttl time.Duration, notice time.Duration) ([]storage.ExpiringInfo, error) {
+	ret := _m.Called(ctx, login, ttl, notice)
+
+	var r0 []storage.ExpiringInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Duration, time.Duration) []storage.ExpiringInfo); ok {
+		r0 = rf(ctx, login, ttl, notice)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.ExpiringInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Duration, time.Duration) error); ok {
+		r1 = rf(ctx, login, ttl, notice)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// IsLoginAvailable provides a mock function with given fields: ctx, login
+func (_m *Repository) IsLoginAvailable(ctx context.Context, login string) (bool, error) {
+	ret := _m.Called(ctx, login)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, login)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, login)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListenEvents provides a mock function with given fields: ctx, handle
+func (_m *Repository) ListenEvents(ctx context.Context, handle func(storage.Event)) error {
+	ret := _m.Called(ctx, handle)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, int64) error); ok {
-		r0 = rf(ctx, login, order)
+	if rf, ok := ret.Get(0).(func(context.Context, func(storage.Event)) error); ok {
+		r0 = rf(ctx, handle)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -200,12 +515,570 @@ func (_m *Repository) UploadOrder(ctx context.Context, login string, order int64
 	return r0
 }
 
+// Login provides a mock function with given fields: ctx, login, password
+func (_m *Repository) Login(ctx context.Context, login string, password string) (bool, error) {
+	ret := _m.Called(ctx, login, password)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) bool); ok {
+		r0 = rf(ctx, login, password)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, login, password)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Merchant provides a mock function with given fields: ctx, code
+func (_m *Repository) Merchant(ctx context.Context, code string) (storage.MerchantInfo, error) {
+	ret := _m.Called(ctx, code)
+
+	var r0 storage.MerchantInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string) storage.MerchantInfo); ok {
+		r0 = rf(ctx, code)
+	} else {
+		r0 = ret.Get(0).(storage.MerchantInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, code)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Merchants provides a mock function with given fields: ctx
+func (_m *Repository) Merchants(ctx context.Context) ([]storage.MerchantInfo, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []storage.MerchantInfo
+	if rf, ok := ret.Get(0).(func(context.Context) []storage.MerchantInfo); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.MerchantInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OrderID provides a mock function with given fields: ctx, merchant, number
+func (_m *Repository) OrderID(ctx context.Context, merchant string, number string) (int64, error) {
+	ret := _m.Called(ctx, merchant, number)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) int64); ok {
+		r0 = rf(ctx, merchant, number)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, merchant, number)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OrderOwner provides a mock function with given fields: ctx, merchant, number
+func (_m *Repository) OrderOwner(ctx context.Context, merchant string, number string) (string, error) {
+	ret := _m.Called(ctx, merchant, number)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) string); ok {
+		r0 = rf(ctx, merchant, number)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, merchant, number)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Orders provides a mock function with given fields: ctx, login
+func (_m *Repository) Orders(ctx context.Context, login string) ([]storage.OrderInfo, error) {
+	ret := _m.Called(ctx, login)
+
+	var r0 []storage.OrderInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string) []storage.OrderInfo); ok {
+		r0 = rf(ctx, login)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.OrderInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, login)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Ping provides a mock function with given fields: ctx
+func (_m *Repository) Ping(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Profile provides a mock function with given fields: ctx, login
+func (_m *Repository) Profile(ctx context.Context, login string) (storage.ProfileInfo, error) {
+	ret := _m.Called(ctx, login)
+
+	var r0 storage.ProfileInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string) storage.ProfileInfo); ok {
+		r0 = rf(ctx, login)
+	} else {
+		r0 = ret.Get(0).(storage.ProfileInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, login)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PurgeIdempotencyKeys provides a mock function with given fields: ctx, window
+func (_m *Repository) PurgeIdempotencyKeys(ctx context.Context, window time.Duration) (int64, error) {
+	ret := _m.Called(ctx, window)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration) int64); ok {
+		r0 = rf(ctx, window)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration) error); ok {
+		r1 = rf(ctx, window)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RecalculateTiers provides a mock function with given fields: ctx, tiers, basis, window
+func (_m *Repository) RecalculateTiers(ctx context.Context, tiers []config.Tier, basis string, window time.Duration) (int64, error) {
+	ret := _m.Called(ctx, tiers, basis, window)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, []config.Tier, string, time.Duration) int64); ok {
+		r0 = rf(ctx, tiers, basis, window)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []config.Tier, string, time.Duration) error); ok {
+		r1 = rf(ctx, tiers, basis, window)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RecordWebhookAttempt provides a mock function with given fields: ctx, id, attempt
+func (_m *Repository) RecordWebhookAttempt(ctx context.Context, id int64, attempt storage.WebhookAttempt) error {
+	ret := _m.Called(ctx, id, attempt)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64, storage.WebhookAttempt) error); ok {
+		r0 = rf(ctx, id, attempt)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Referrals provides a mock function with given fields: ctx, login
+func (_m *Repository) Referrals(ctx context.Context, login string) (storage.ReferralsInfo, error) {
+	ret := _m.Called(ctx, login)
+
+	var r0 storage.ReferralsInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string) storage.ReferralsInfo); ok {
+		r0 = rf(ctx, login)
+	} else {
+		r0 = ret.Get(0).(storage.ReferralsInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, login)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RefundWithdrawal provides a mock function with given fields: ctx, order, amount, reference, reason
+func (_m *Repository) RefundWithdrawal(ctx context.Context, order string, amount float64, reference string, reason string) (storage.RefundInfo, error) {
+	ret := _m.Called(ctx, order, amount, reference, reason)
+
+	var r0 storage.RefundInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, float64, string, string) storage.RefundInfo); ok {
+		r0 = rf(ctx, order, amount, reference, reason)
+	} else {
+		r0 = ret.Get(0).(storage.RefundInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, float64, string, string) error); ok {
+		r1 = rf(ctx, order, amount, reference, reason)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Register provides a mock function with given fields: ctx, login, password, referralCode, ip, rewards
+func (_m *Repository) Register(ctx context.Context, login string, password string, referralCode string, ip string, rewards config.Referrals) error {
+	ret := _m.Called(ctx, login, password, referralCode, ip, rewards)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, string, config.Referrals) error); ok {
+		r0 = rf(ctx, login, password, referralCode, ip, rewards)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ReleaseIdempotencyKey provides a mock function with given fields: ctx, scope, key
+func (_m *Repository) ReleaseIdempotencyKey(ctx context.Context, scope string, key string) error {
+	ret := _m.Called(ctx, scope, key)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, scope, key)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ReserveIdempotencyKey provides a mock function with given fields: ctx, scope, key, fingerprint, window, lease
+func (_m *Repository) ReserveIdempotencyKey(ctx context.Context, scope string, key string, fingerprint string, window time.Duration, lease time.Duration) (*storage.IdempotentResponse, error) {
+	ret := _m.Called(ctx, scope, key, fingerprint, window, lease)
+
+	var r0 *storage.IdempotentResponse
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, time.Duration, time.Duration) *storage.IdempotentResponse); ok {
+		r0 = rf(ctx, scope, key, fingerprint, window, lease)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*storage.IdempotentResponse)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, time.Duration, time.Duration) error); ok {
+		r1 = rf(ctx, scope, key, fingerprint, window, lease)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ResolveDeadLetter provides a mock function with given fields: ctx, order, status, accrual
+func (_m *Repository) ResolveDeadLetter(ctx context.Context, order int64, status string, accrual float64) error {
+	ret := _m.Called(ctx, order, status, accrual)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string, float64) error); ok {
+		r0 = rf(ctx, order, status, accrual)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RetryDeadLetter provides a mock function with given fields: ctx, order
+func (_m *Repository) RetryDeadLetter(ctx context.Context, order int64) error {
+	ret := _m.Called(ctx, order)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64) error); ok {
+		r0 = rf(ctx, order)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ReverseAccrual provides a mock function with given fields: ctx, order, amount, reason, allowDebt
+func (_m *Repository) ReverseAccrual(ctx context.Context, order int64, amount float64, reason string, allowDebt bool) (storage.AdjustmentInfo, error) {
+	ret := _m.Called(ctx, order, amount, reason, allowDebt)
+
+	var r0 storage.AdjustmentInfo
+	if rf, ok := ret.Get(0).(func(context.Context, int64, float64, string, bool) storage.AdjustmentInfo); ok {
+		r0 = rf(ctx, order, amount, reason, allowDebt)
+	} else {
+		r0 = ret.Get(0).(storage.AdjustmentInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, float64, string, bool) error); ok {
+		r1 = rf(ctx, order, amount, reason, allowDebt)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SaveIdempotentResponse provides a mock function with given fields: ctx, scope, key, response
+func (_m *Repository) SaveIdempotentResponse(ctx context.Context, scope string, key string, response storage.IdempotentResponse) error {
+	ret := _m.Called(ctx, scope, key, response)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, storage.IdempotentResponse) error); ok {
+		r0 = rf(ctx, scope, key, response)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Transfer provides a mock function with given fields: ctx, from, to, amount, limits
+func (_m *Repository) Transfer(ctx context.Context, from string, to string, amount float64, limits config.Transfers) (storage.TransferInfo, error) {
+	ret := _m.Called(ctx, from, to, amount, limits)
+
+	var r0 storage.TransferInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, float64, config.Transfers) storage.TransferInfo); ok {
+		r0 = rf(ctx, from, to, amount, limits)
+	} else {
+		r0 = ret.Get(0).(storage.TransferInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, float64, config.Transfers) error); ok {
+		r1 = rf(ctx, from, to, amount, limits)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateCampaign provides a mock function with given fields: ctx, campaign
+func (_m *Repository) UpdateCampaign(ctx context.Context, campaign storage.CampaignInfo) (storage.CampaignInfo, error) {
+	ret := _m.Called(ctx, campaign)
+
+	var r0 storage.CampaignInfo
+	if rf, ok := ret.Get(0).(func(context.Context, storage.CampaignInfo) storage.CampaignInfo); ok {
+		r0 = rf(ctx, campaign)
+	} else {
+		r0 = ret.Get(0).(storage.CampaignInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, storage.CampaignInfo) error); ok {
+		r1 = rf(ctx, campaign)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateMerchant provides a mock function with given fields: ctx, merchant
+func (_m *Repository) UpdateMerchant(ctx context.Context, merchant storage.MerchantInfo) (storage.MerchantInfo, error) {
+	ret := _m.Called(ctx, merchant)
+
+	var r0 storage.MerchantInfo
+	if rf, ok := ret.Get(0).(func(context.Context, storage.MerchantInfo) storage.MerchantInfo); ok {
+		r0 = rf(ctx, merchant)
+	} else {
+		r0 = ret.Get(0).(storage.MerchantInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, storage.MerchantInfo) error); ok {
+		r1 = rf(ctx, merchant)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateOrder provides a mock function with given fields: ctx, order, status, accrual
+func (_m *Repository) UpdateOrder(ctx context.Context, order int64, status string, accrual float64) error {
+	ret := _m.Called(ctx, order, status, accrual)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string, float64) error); ok {
+		r0 = rf(ctx, order, status, accrual)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UploadOrder provides a mock function with given fields: ctx, login, merchant, number
+func (_m *Repository) UploadOrder(ctx context.Context, login string, merchant string, number string) error {
+	ret := _m.Called(ctx, login, merchant, number)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) error); ok {
+		r0 = rf(ctx, login, merchant, number)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UploadOrders provides a mock function with given fields: ctx, login, merchant, numbers
+func (_m *Repository) UploadOrders(ctx context.Context, login string, merchant string, numbers []string) ([]storage.OrderUploadResult, error) {
+	ret := _m.Called(ctx, login, merchant, numbers)
+
+	var r0 []storage.OrderUploadResult
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, []string) []storage.OrderUploadResult); ok {
+		r0 = rf(ctx, login, merchant, numbers)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.OrderUploadResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, []string) error); ok {
+		r1 = rf(ctx, login, merchant, numbers)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// VoidHold provides a mock function with given fields: ctx, login, id
+func (_m *Repository) VoidHold(ctx context.Context, login string, id int64) (storage.HoldInfo, error) {
+	ret := _m.Called(ctx, login, id)
+
+	var r0 storage.HoldInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) storage.HoldInfo); ok {
+		r0 = rf(ctx, login, id)
+	} else {
+		r0 = ret.Get(0).(storage.HoldInfo)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, login, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// WebhookDeliveries provides a mock function with given fields: ctx, client, id
+func (_m *Repository) WebhookDeliveries(ctx context.Context, client string, id int64) ([]storage.WebhookDeliveryInfo, error) {
+	ret := _m.Called(ctx, client, id)
+
+	var r0 []storage.WebhookDeliveryInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) []storage.WebhookDeliveryInfo); ok {
+		r0 = rf(ctx, client, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.WebhookDeliveryInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, client, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Webhooks provides a mock function with given fields: ctx, client
+func (_m *Repository) Webhooks(ctx context.Context, client string) ([]storage.WebhookInfo, error) {
+	ret := _m.Called(ctx, client)
+
+	var r0 []storage.WebhookInfo
+	if rf, ok := ret.Get(0).(func(context.Context, string) []storage.WebhookInfo); ok {
+		r0 = rf(ctx, client)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.WebhookInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, client)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Withdraw provides a mock function with given fields: ctx, login, order, sum
-func (_m *Repository) Withdraw(ctx context.Context, login string, order int64, sum float64) error {
+func (_m *Repository) Withdraw(ctx context.Context, login string, order string, sum float64) error {
 	ret := _m.Called(ctx, login, order, sum)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, int64, float64) error); ok {
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, float64) error); ok {
 		r0 = rf(ctx, login, order, sum)
 	} else {
 		r0 = ret.Error(0)